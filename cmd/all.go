@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"github.com/dyammarcano/gin-nats-starter/internal/service"
+
+	"github.com/spf13/cobra"
+)
+
+// allCmd represents the all command
+var allCmd = &cobra.Command{
+	Use:   "all",
+	Short: "Run the api gateway and every worker in one process",
+	Long: `Runs api, cep, cpfcnpj, identity, clima and monitor in a single process,
+each with its own NATS connection. Combine with --embedded-nats to run
+without an external NATS server, for example:
+
+  gin-nats-starter all --config config.yaml --embedded-nats`,
+	RunE: service.All,
+}
+
+func init() {
+	rootCmd.AddCommand(allCmd)
+}
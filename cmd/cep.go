@@ -21,4 +21,6 @@ to quickly create a Cobra application.`,
 
 func init() {
 	rootCmd.AddCommand(cepCmd)
+
+	cepCmd.Flags().Bool("offline", false, "answer only from the imported CEP database, see import-cep")
 }
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"github.com/dyammarcano/gin-nats-starter/internal/service"
+
+	"github.com/spf13/cobra"
+)
+
+// importCepCmd represents the import-cep command
+var importCepCmd = &cobra.Command{
+	Use:   "import-cep <file>",
+	Short: "Load a CEP dataset into the database for offline lookups",
+	Long: `Loads a bulk CEP dataset into the database used by the cep worker, so it
+can run with --offline in air-gapped environments. Two formats are read:
+
+  csv  a header row naming the columns cep, logradouro, bairro, cidade, uf
+       and ibge; rows with a cep_fim column describe the CEP range of a
+       city served by a single generic CEP
+  dne  fixed-width records: cep (8), cep_fim (8), uf (2), cidade (72),
+       bairro (72), logradouro (100) and ibge (7)
+
+Records are upserted, so a dataset can be imported again to update it:
+
+  gin-nats-starter import-cep --config config.yaml --encoding latin1 dne.txt`,
+	Args: cobra.ExactArgs(1),
+	RunE: service.ImportCep,
+}
+
+func init() {
+	rootCmd.AddCommand(importCepCmd)
+
+	importCepCmd.Flags().String("format", "", "csv or dne (default from the file extension)")
+	importCepCmd.Flags().String("encoding", "utf8", "utf8 or latin1")
+	importCepCmd.Flags().Int("batch-size", 1000, "records written per transaction")
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"github.com/dyammarcano/gin-nats-starter/internal/service"
+
+	"github.com/spf13/cobra"
+)
+
+// rekeyCmd represents the rekey command
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "Re-encrypt the identity database under the active key",
+	Long: `Re-encrypts the name, CPF and CNPJ of every identity with a new data key
+wrapped by database.encryption.activeKey, and recomputes the lookup hashes
+with database.encryption.indexKey. Identities stored before encryption was
+enabled are encrypted too.
+
+Keys are read from the environment or from files, never from the config:
+each entry is "env:NAME" or "file:PATH" holding a base64 encoded 32 byte
+key, as generated by "openssl rand -base64 32". To rotate keys, add the new
+key under database.encryption.keys, make it the activeKey and run:
+
+  PII_KEY_NEW=... gin-nats-starter rekey --config config.yaml
+
+Keep the old key in keys until the command finishes; it can be removed
+afterwards. A new indexKey takes effect only once the command has run, so
+stop the identity service while changing it.`,
+	Args: cobra.NoArgs,
+	RunE: service.Rekey,
+}
+
+func init() {
+	rootCmd.AddCommand(rekeyCmd)
+
+	rekeyCmd.Flags().Int("batch-size", 500, "identities re-encrypted per transaction")
+}
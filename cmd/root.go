@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 )
@@ -12,11 +15,16 @@ var rootCmd = &cobra.Command{
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		stop()
 		os.Exit(1)
 	}
 }
 
 func init() {
 	rootCmd.PersistentFlags().String("config", "", "config file (default is $HOME/.github.com/dyammarcano/gin-nats-starter.yaml)")
+	rootCmd.PersistentFlags().Bool("embedded-nats", false, "start an embedded NATS server instead of connecting to nats.url")
 }
@@ -1,20 +1,117 @@
 package model
 
-import "gorm.io/gorm"
+import (
+	"strings"
+	"time"
+	"unicode"
 
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Identity is a person or company. Status is its verification state;
+// Verified is set when that state reaches "verified".
+//
+// Name, CPF and CNPJ are stored encrypted with DataKey, itself encrypted
+// with a configured key; rows are found through the keyed hashes in
+// NameIndex, CPFIndex and CNPJIndex. A CPF or CNPJ belongs to at most one
+// identity that is not deleted.
 type Identity struct {
 	gorm.Model
-	UUID     string `gorm:"uniqueIndex"`
-	CPF      string `gorm:"index"`
-	CNPJ     string `gorm:"index"`
-	Name     string
-	Verified bool
+	UUID      string `gorm:"uniqueIndex"`
+	CPF       string
+	CNPJ      string
+	Name      string
+	CPFIndex  string `gorm:"index;uniqueIndex:idx_identities_cpf_unique,where:cpf_index <> '' AND deleted_at IS NULL"`
+	CNPJIndex string `gorm:"index;uniqueIndex:idx_identities_cnpj_unique,where:cnpj_index <> '' AND deleted_at IS NULL"`
+	NameIndex string `gorm:"index"`
+	DataKey   string
+	Verified  bool
+	Status    string `gorm:"index;default:pending"`
+	Address   *Address
 }
 
+// Address is where an identity lives. The street, neighborhood, city and
+// state are filled in from service.cep when the address is saved and kept
+// as a snapshot: CEP is not a foreign key to model.CEP, which belongs to
+// the cep worker and may live in another database, so later changes to the
+// CEP data do not alter stored addresses.
+type Address struct {
+	gorm.Model
+	IdentityID   uint   `gorm:"uniqueIndex"`
+	CEP          string `gorm:"index"`
+	Street       string
+	Number       string
+	Complement   string
+	Neighborhood string
+	City         string
+	State        string
+	IBGE         string
+}
+
+// PrivacyAudit records a data subject request served, an export or an
+// erasure, with its signed receipt as JSON. Subject is the keyed hash of
+// the document, never the document itself.
+type PrivacyAudit struct {
+	gorm.Model
+	UUID      string `gorm:"uniqueIndex"`
+	Operation string `gorm:"index"`
+	Subject   string `gorm:"index"`
+	Receipt   string
+}
+
+// IdentityTransition records a change of an identity's verification state.
+type IdentityTransition struct {
+	gorm.Model
+	IdentityID uint `gorm:"index"`
+	From       string
+	To         string
+	Reason     string
+}
+
+// CEP caches an upstream CEP lookup. NotFound entries record CEPs the
+// upstreams reported as nonexistent; Provider is the upstream that answered.
 type CEP struct {
 	gorm.Model
-	CEP    string `gorm:"uniqueIndex"`
-	Street string
-	City   string
-	State  string
+	CEP          string `gorm:"uniqueIndex"`
+	Street       string
+	Neighborhood string
+	City         string
+	State        string
+	IBGE         string
+	Provider     string
+	NotFound     bool
+	SearchText   string    `gorm:"index"`
+	FetchedAt    time.Time `gorm:"index"`
+}
+
+// BeforeSave keeps SearchText, the accent-insensitive text the address
+// search matches against, in sync with the address fields.
+func (c *CEP) BeforeSave(*gorm.DB) error {
+	c.SearchText = SearchKey(strings.Join([]string{c.Street, c.Neighborhood, c.City}, " "))
+	return nil
+}
+
+// SearchKey lowercases s and strips its accents, so "São Paulo" and
+// "sao paulo" compare equal.
+func SearchKey(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	out, _, err := transform.String(t, s)
+	if err != nil {
+		out = s
+	}
+	return strings.Join(strings.Fields(strings.ToLower(out)), " ")
+}
+
+// CEPRange maps a CEP range to the locality it belongs to, for cities
+// served by a single generic CEP rather than one per street.
+type CEPRange struct {
+	gorm.Model
+	StartCEP string `gorm:"uniqueIndex:idx_cep_range"`
+	EndCEP   string `gorm:"uniqueIndex:idx_cep_range"`
+	City     string
+	State    string
+	IBGE     string
 }
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/nats-io/nats.go"
+)
+
+// AddressRequest is the address of an identity as given on create and
+// update. With only a CEP, the street, neighborhood, city and state are
+// filled in by service.cep; fields that are given are kept as they are.
+type AddressRequest struct {
+	CEP          string `json:"cep" pattern:"^[0-9]{5}-?[0-9]{3}$"`
+	Number       string `json:"number,omitempty"`
+	Complement   string `json:"complement,omitempty"`
+	Street       string `json:"street,omitempty"`
+	Neighborhood string `json:"neighborhood,omitempty"`
+	City         string `json:"city,omitempty"`
+	State        string `json:"state,omitempty" pattern:"^[A-Za-z]{2}$"`
+}
+
+// AddressRecord is the public form of model.Address.
+type AddressRecord struct {
+	CEP          string `json:"cep"`
+	Street       string `json:"street,omitempty"`
+	Number       string `json:"number,omitempty"`
+	Complement   string `json:"complement,omitempty"`
+	Neighborhood string `json:"neighborhood,omitempty"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+	IBGE         string `json:"ibge,omitempty"`
+}
+
+// resolveAddress builds the address of an identity, asking service.cep for
+// the fields left out. When service.cep is unavailable the address is only
+// accepted if the city and state were given.
+func resolveAddress(ctx context.Context, nc *nats.Conn, req *AddressRequest) (*model.Address, error) {
+	cep := normalizeCEP(req.CEP)
+	if len(cep) != 8 {
+		return nil, errBadRequest("invalid address cep")
+	}
+
+	addr := &model.Address{
+		CEP:          cep,
+		Street:       strings.TrimSpace(req.Street),
+		Number:       strings.TrimSpace(req.Number),
+		Complement:   strings.TrimSpace(req.Complement),
+		Neighborhood: strings.TrimSpace(req.Neighborhood),
+		City:         strings.TrimSpace(req.City),
+		State:        strings.ToUpper(strings.TrimSpace(req.State)),
+	}
+	if addr.Street != "" && addr.Neighborhood != "" && addr.City != "" && addr.State != "" {
+		return addr, nil
+	}
+
+	var found CepAddress
+	status, err := callService(ctx, nc, "service.cep", CepRequest{CEP: cep}, &found)
+	switch {
+	case err == nil && status == http.StatusOK:
+	case err == nil && status == http.StatusNotFound:
+		return nil, errUnprocessable("cep %s not found", cep)
+	default:
+		if err == nil {
+			err = errUnavailable("service.cep replied %d", status)
+		}
+		if addr.City != "" && addr.State != "" {
+			log.Printf("[identity] keeping address of cep %s as given: %v", cep, err)
+			return addr, nil
+		}
+		log.Printf("[identity] error looking up cep %s: %v", cep, err)
+		return nil, errUnavailable("address lookup unavailable")
+	}
+
+	fill := func(field *string, v string) {
+		if *field == "" {
+			*field = v
+		}
+	}
+	fill(&addr.Street, found.Logradouro)
+	fill(&addr.Neighborhood, found.Bairro)
+	fill(&addr.City, found.Cidade)
+	fill(&addr.State, found.UF)
+	addr.IBGE = found.IBGE
+
+	return addr, nil
+}
+
+// sameAddress reports whether a and b, either possibly nil, are the same
+// address.
+func sameAddress(a, b *model.Address) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *addressRecord(a) == *addressRecord(b)
+}
+
+func addressRecord(a *model.Address) *AddressRecord {
+	if a == nil {
+		return nil
+	}
+	return &AddressRecord{
+		CEP:          a.CEP,
+		Street:       a.Street,
+		Number:       a.Number,
+		Complement:   a.Complement,
+		Neighborhood: a.Neighborhood,
+		City:         a.City,
+		State:        a.State,
+		IBGE:         a.IBGE,
+	}
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// allServices lists the services started by the all command, each on its
+// own NATS connection as if it were a separate process.
+var allServices = []struct {
+	name string
+	run  func(cfg *ConfigService) error
+}{
+	{"api", runApi},
+	{"cep", runCep},
+	{"cpfcnpj", runCpfCnpj},
+	{"identity", runIdentity},
+	{"clima", runClima},
+	{"monitor", runMonitor},
+}
+
+// All runs the gateway and every worker in a single process. Combined with
+// --embedded-nats it needs no external infrastructure at all.
+func All(cmd *cobra.Command, _ []string) error {
+	cfg, err := serviceCommon(cmd)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cfg.Close() }()
+
+	// report every missing secret at once rather than the first one each
+	// service stumbles on
+	if missing := missingSecrets(cfg); len(missing) > 0 {
+		return fmt.Errorf("missing secrets: %s (see the README for how to generate them)", strings.Join(missing, ", "))
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for _, svc := range allServices {
+		f, err := cfg.fork(svc.name)
+		if err != nil {
+			cfg.cancel()
+			errs = append(errs, fmt.Errorf("%s: %w", svc.name, err))
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := svc.run(f); err != nil {
+				log.Printf("[all] %s stopped: %v", svc.name, err)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", svc.name, err))
+				mu.Unlock()
+				// one service failing takes the others down with it
+				cfg.cancel()
+			}
+			_ = f.Close()
+		}()
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// missingSecrets names the secrets of the services started by All that
+// cannot be read: by the environment variable or file they are configured
+// with, or by their config key when they are not configured.
+func missingSecrets(cfg *ConfigService) []string {
+	type secret struct{ key, ref string }
+	secrets := []secret{{"announceToken", cfg.AnnounceToken}}
+	for _, id := range slices.Sorted(maps.Keys(cfg.Database.Encryption.Keys)) {
+		secrets = append(secrets, secret{"database.encryption.keys." + id, cfg.Database.Encryption.Keys[id]})
+	}
+	secrets = append(secrets,
+		secret{"database.encryption.indexKey", cfg.Database.Encryption.IndexKey},
+		secret{"privacy.receiptKey", cfg.Privacy.ReceiptKey},
+		secret{"privacy.token", cfg.Privacy.Token},
+	)
+
+	var out []string
+	for _, s := range secrets {
+		if _, err := secretValue(s.ref); err == nil {
+			continue
+		}
+		switch kind, name, _ := strings.Cut(strings.TrimSpace(s.ref), ":"); {
+		case kind == "env" && name != "":
+			out = append(out, strings.TrimSpace(name))
+		case kind == "file" && name != "":
+			out = append(out, "file "+strings.TrimSpace(name))
+		default:
+			out = append(out, s.key)
+		}
+	}
+	return out
+}
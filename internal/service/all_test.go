@@ -0,0 +1,35 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMissingSecrets(t *testing.T) {
+	oldKey := filepath.Join(t.TempDir(), "old.key")
+	cfg := &ConfigService{
+		AnnounceToken: "env:TEST_ANNOUNCE_TOKEN",
+		Database: Database{Encryption: EncryptionConfig{
+			ActiveKey: "main",
+			Keys:      map[string]string{"main": "env:TEST_PII_KEY_MAIN", "old": "file:" + oldKey},
+			IndexKey:  "env:TEST_PII_INDEX_KEY",
+		}},
+		Privacy: PrivacyConfig{Token: "env:TEST_PRIVACY_TOKEN"},
+	}
+	for _, name := range []string{"TEST_ANNOUNCE_TOKEN", "TEST_PII_KEY_MAIN", "TEST_PII_INDEX_KEY", "TEST_PRIVACY_TOKEN"} {
+		t.Setenv(name, "")
+	}
+
+	// every missing secret is named, a missing one by its config key
+	want := []string{"TEST_ANNOUNCE_TOKEN", "TEST_PII_KEY_MAIN", "file " + oldKey, "TEST_PII_INDEX_KEY", "privacy.receiptKey", "TEST_PRIVACY_TOKEN"}
+	if got := missingSecrets(cfg); !equalStrings(got, want) {
+		t.Fatalf("missing = %q, want %q", got, want)
+	}
+
+	setPIIKeys(t, "main")
+	t.Setenv("TEST_ANNOUNCE_TOKEN", "s3cret")
+	want = []string{"file " + oldKey, "TEST_PII_INDEX_KEY", "privacy.receiptKey", "TEST_PRIVACY_TOKEN"}
+	if got := missingSecrets(cfg); !equalStrings(got, want) {
+		t.Fatalf("missing = %q, want %q", got, want)
+	}
+}
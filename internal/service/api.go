@@ -10,65 +10,122 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/go-openapi/loads"
-	"github.com/go-openapi/spec"
 	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
 )
 
 type Route struct {
-	id     string
-	target string
-	method string
+	id        string
+	target    string
+	method    string
+	subject   string
+	timeout   time.Duration
+	batch     int
+	operation *openapi3.Operation
+	params    openapi3.Parameters
+}
+
+// routeMethods lists the operations registered from each path item.
+var routeMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodDelete,
+	http.MethodOptions,
+	http.MethodHead,
+	http.MethodPatch,
 }
 
 type Proxy struct {
 	port             string
-	engine           *gin.Engine
+	engine           atomic.Pointer[gin.Engine]
+	mu               sync.Mutex
 	registeredRoutes map[string]*Route
+	specRoutes       map[string]*Route
+	basePath         string
+	announced        map[string]*announcedInstance
+	announceToken    string
 	nc               *nats.Conn
 }
 
 func Api(cmd *cobra.Command, _ []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	cfg, err := serviceCommon(cmd.Context(), configStr)
+	cfg, err := serviceCommon(cmd)
 	if err != nil {
 		return err
 	}
 
+	return runApi(cfg)
+}
+
+func runApi(cfg *ConfigService) error {
 	doc, err := loadOpenAPI(cfg.OpenApiPath)
 	if err != nil {
 		return err
 	}
+	announceToken, err := secretValue(cfg.AnnounceToken)
+	if err != nil {
+		return fmt.Errorf("failed to load announce token: %w", err)
+	}
 
 	px := &Proxy{
 		registeredRoutes: make(map[string]*Route),
-		engine:           setupRouter(),
+		announced:        make(map[string]*announcedInstance),
+		announceToken:    announceToken,
 		port:             fmt.Sprintf(":%d", cfg.Port),
 		nc:               cfg.nc,
 	}
 
-	for p, pathItem := range doc.Spec().Paths.Paths {
-		if err := checkPathItem(p, pathItem); err != nil {
+	if err := px.apply(doc); err != nil {
+		return err
+	}
+
+	if cfg.OpenApiWatch {
+		if err := px.watchFile(cfg.ctx, cfg.OpenApiPath); err != nil {
 			return err
 		}
+	}
+
+	if cfg.OpenApiKV.Bucket != "" {
+		if err := px.watchKV(cfg.ctx, cfg.OpenApiKV, cfg.OpenApiPath); err != nil {
+			return err
+		}
+	}
+
+	if err := px.watchAnnouncements(cfg.ctx); err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: px.port, Handler: px}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("starting api on %s (openapi %s, %d routes)", px.port, doc.OpenAPI, len(px.registeredRoutes))
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+			cfg.cancel()
+		}
+	}()
 
-		px.registerRoute(p, pathItem.Get, "GET")
-		px.registerRoute(p, pathItem.Post, "POST")
-		px.registerRoute(p, pathItem.Put, "PUT")
-		px.registerRoute(p, pathItem.Delete, "DELETE")
-		px.registerRoute(p, pathItem.Options, "OPTIONS")
-		px.registerRoute(p, pathItem.Head, "HEAD")
-		px.registerRoute(p, pathItem.Patch, "PATCH")
+	// in-flight requests finish before the NATS connection they use is drained
+	shutdownErr := cfg.waitForShutdown("api", srv.Shutdown, cfg.drain)
+	select {
+	case err := <-serveErr:
+		return err
+	default:
+		return shutdownErr
 	}
+}
 
-	port := cfg.Port
-	log.Printf("starting api on :%d", port)
-	return px.engine.Run(fmt.Sprintf(":%d", port))
+// ServeHTTP dispatches to the router built from the current spec, so a
+// reload never interrupts requests already being served.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.engine.Load().ServeHTTP(w, r)
 }
 
 func setupRouter() *gin.Engine {
@@ -113,124 +170,196 @@ func setupHealthEndpoints(r *gin.Engine) {
 	})
 }
 
-func (p *Proxy) registerRoute(pathRoute string, operation *spec.Operation, method string) {
-	if operation != nil {
-		key := fmt.Sprintf("%s-%s", method, pathRoute)
-		if p.registeredRoutes[key] != nil {
+// discoveryWait is how long /services waits for $SRV replies.
+const discoveryWait = 500 * time.Millisecond
+
+// setupServiceEndpoints exposes the micro services found on the bus along
+// with their endpoints and request, error and processing time stats.
+func (p *Proxy) setupServiceEndpoints(r *gin.Engine) {
+	r.GET("/services", func(c *gin.Context) {
+		services, err := discoverServices(p.nc, discoveryWait)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"services": services})
+	})
+}
 
-		s := sha256.New()
-		s.Write([]byte(key))
-
-		subject := getExtensionString(operation.Extensions["x-nats-subject"])
-		timeout := getExtensionDuration(operation.Extensions["x-timeout"], 2*time.Second)
+// buildRoutes collects the proxied routes declared by the spec.
+func (p *Proxy) buildRoutes(doc *openapi3.T) (map[string]*Route, error) {
+	basePath, err := specBasePath(doc)
+	if err != nil {
+		return nil, err
+	}
 
-		p.registeredRoutes[key] = &Route{
-			id:     fmt.Sprintf("%x-%x", s.Sum(nil)[0:3], s.Sum(nil)[5:7]),
-			target: pathRoute,
-			method: method,
+	routes := make(map[string]*Route)
+	for _, pr := range doc.Paths.InMatchingOrder() {
+		pathItem := doc.Paths.Value(pr)
+		if err := checkPathItem(pr, pathItem); err != nil {
+			return nil, err
 		}
 
-		handler := proxyNats(context.Background(), p.nc, subject, timeout)
-		p.engine.Handle(method, pathRoute, handler)
+		for _, method := range routeMethods {
+			registerRoute(routes, basePath+pr, pathItem, pathItem.GetOperation(method), method)
+		}
 	}
+
+	return routes, nil
 }
 
-func checkPathItem(path string, pathItem spec.PathItem) error {
-	if pathItem.Get == nil && pathItem.Post == nil && pathItem.Put == nil &&
-		pathItem.Delete == nil && pathItem.Options == nil && pathItem.Head == nil && pathItem.Patch == nil {
-		return fmt.Errorf("path item is empty for path: %s", path)
+// buildEngine creates a router serving the given routes. Gin panics on
+// conflicting paths; that is reported as an error so a bad spec is rejected.
+func (p *Proxy) buildEngine(routes map[string]*Route) (engine *gin.Engine, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid routes: %v", r)
+		}
+	}()
+
+	engine = setupRouter()
+	p.setupServiceEndpoints(engine)
+	for _, route := range routes {
+		handler := proxyNats(context.Background(), p.nc, route)
+		if route.batch > 0 {
+			handler = proxyBatch(context.Background(), p.nc, route)
+		}
+		engine.Handle(route.method, ginPath(route.target), handler)
 	}
 
-	return nil
+	return engine, nil
 }
 
-func loadOpenAPI(filePath string) (*loads.Document, error) {
-	doc, err := loads.Spec(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("error loading Swagger file: %v", err)
-	}
-
-	if doc.Spec().Paths == nil {
-		return nil, fmt.Errorf("swagger spec is missing paths")
-	}
+func registerRoute(routes map[string]*Route, target string, pathItem *openapi3.PathItem, operation *openapi3.Operation, method string) {
+	if operation != nil {
+		key := fmt.Sprintf("%s-%s", method, target)
+		if routes[key] != nil {
+			return
+		}
 
-	if doc.Spec().Info == nil {
-		return nil, fmt.Errorf("swagger spec is missing info")
-	}
+		s := sha256.New()
+		s.Write([]byte(key))
 
-	if doc.Spec().Info.Title == "" {
-		return nil, fmt.Errorf("swagger spec is missing info title")
+		subject := getExtensionString(operation.Extensions["x-nats-subject"])
+		timeout := getExtensionDuration(operation.Extensions["x-timeout"], 2*time.Second)
+		batch := getExtensionInt(operation.Extensions["x-nats-batch"])
+
+		routes[key] = &Route{
+			id:        fmt.Sprintf("%x-%x", s.Sum(nil)[0:3], s.Sum(nil)[5:7]),
+			target:    target,
+			method:    method,
+			subject:   subject,
+			timeout:   timeout,
+			batch:     batch,
+			operation: operation,
+			params:    operationParameters(pathItem, operation),
+		}
 	}
-
-	return doc, nil
 }
 
-func proxyNats(ctx context.Context, nc *nats.Conn, subject string, timeout time.Duration) gin.HandlerFunc {
+func proxyNats(ctx context.Context, nc *nats.Conn, route *Route) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		ctxTimeout, cancel := context.WithTimeout(ctx, timeout)
+		ctxTimeout, cancel := context.WithTimeout(ctx, route.timeout)
 		defer cancel()
 
-		msg := &nats.Msg{Subject: subject, Data: []byte("empty"), Header: nats.Header{}}
+		msg := &nats.Msg{Subject: route.subject, Data: []byte("empty"), Header: nats.Header{}}
 		if s := c.GetHeader("schema"); s != "" {
 			msg.Header.Set("schema", "1")
-			resp, err := nc.RequestMsgWithContext(ctxTimeout, msg)
+			resp, err := requestMsg(ctxTimeout, nc, msg)
 			if err != nil {
-				if errors.Is(err, nats.ErrNoResponders) {
-					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "service unavailable to process request"})
-					return
-				}
-				c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+				writeNatsError(c, err)
 				return
 			}
-			c.Data(http.StatusOK, "application/json", resp.Data)
+			writeReply(c, resp)
 			return
 		}
 
-		var body map[string]any
-		if err := c.BindJSON(&body); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if details := validateRequestBody(c.Request.Context(), c.Request, route.operation); len(details) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "request body does not match schema", "details": details})
 			return
 		}
-		b, _ := json.Marshal(body)
-		msg.Data = b
+
+		msg.Data = []byte("{}")
+		if c.Request.ContentLength != 0 {
+			var body map[string]any
+			if err := c.BindJSON(&body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			b, _ := json.Marshal(body)
+			msg.Data = b
+		}
+
+		forwardParams(c, msg, route)
 
 		if d := c.GetHeader("data"); d != "" {
 			msg.Header.Set("data", d)
 		}
 
-		resp, err := nc.RequestMsgWithContext(ctx, msg)
+		resp, err := requestMsg(ctxTimeout, nc, msg)
 		if err != nil {
-			if errors.Is(err, nats.ErrNoResponders) {
-				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "service unavailable to process request"})
-				return
-			}
-			c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			writeNatsError(c, err)
 			return
 		}
-		c.Data(http.StatusOK, "application/json", resp.Data)
+		writeReply(c, resp)
 	}
 }
 
-func getExtensionString(ext interface{}) string {
-	if ext == nil {
-		return ""
+// writeReply turns a NATS reply into the HTTP response, honoring the
+// status, content type and response headers set by the responder.
+func writeReply(c *gin.Context, resp *nats.Msg) {
+	for name, values := range replyHeaders(resp) {
+		for _, v := range values {
+			c.Writer.Header().Add(name, v)
+		}
 	}
-	if s, ok := ext.(string); ok {
-		return s
+
+	contentType := resp.Header.Get(headerContentType)
+	if contentType == "" {
+		contentType = "application/json"
 	}
-	return ""
+
+	c.Data(replyStatus(resp), contentType, resp.Data)
 }
 
-func getExtensionDuration(ext interface{}, def time.Duration) time.Duration {
-	if ext == nil {
-		return def
+func writeNatsError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, nats.ErrNoResponders):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "service unavailable to process request"})
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, nats.ErrTimeout):
+		c.JSON(http.StatusGatewayTimeout, gin.H{"error": "service did not respond in time"})
+	default:
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
 	}
-	if s, ok := ext.(string); ok {
-		if d, err := time.ParseDuration(s); err == nil {
-			return d
+}
+
+// forwardParams copies the OpenAPI declared path, query, header and cookie
+// parameters of the request into the NATS message headers.
+func forwardParams(c *gin.Context, msg *nats.Msg, route *Route) {
+	msg.Header.Set(headerMethod, route.method)
+	msg.Header.Set(headerRoute, route.target)
+
+	for _, ref := range route.params {
+		param := ref.Value
+		key := paramHeaderKey(param.In, param.Name)
+
+		switch param.In {
+		case paramPath:
+			if v := c.Param(param.Name); v != "" {
+				msg.Header.Set(key, v)
+			}
+		case paramQuery:
+			for _, v := range c.QueryArray(param.Name) {
+				msg.Header.Add(key, v)
+			}
+		case paramHeader:
+			if v := c.GetHeader(param.Name); v != "" {
+				msg.Header.Set(key, v)
+			}
+		case paramCookie:
+			if v, err := c.Cookie(param.Name); err == nil {
+				msg.Header.Set(key, v)
+			}
 		}
 	}
-	return def
 }
@@ -0,0 +1,356 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// maxBatchItems bounds the items a worker accepts in one message.
+	maxBatchItems = 10000
+	// batchInFlight is how many chunks the gateway keeps in flight at once.
+	batchInFlight = 4
+	// batchTooLarge counts, in the summary, the items the gateway rejected
+	// for not fitting in a message.
+	batchTooLarge = "too_large"
+)
+
+// BatchRequest is the body of a batch endpoint. Offset is the position of
+// the first item in the whole input, so results keep global indexes when
+// the gateway splits a stream into chunks.
+type BatchRequest[T any] struct {
+	Offset int `json:"offset,omitempty"`
+	Items  []T `json:"items"`
+}
+
+// DecodeMessage accepts {"items": [...]}, a bare JSON array or NDJSON with
+// one item per line.
+func (b *BatchRequest[T]) DecodeMessage(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil
+	}
+
+	if data[0] == '{' && json.Unmarshal(data, b) == nil && b.Items != nil {
+		return nil
+	}
+
+	if data[0] == '[' {
+		return json.Unmarshal(data, &b.Items)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var item T
+		err := dec.Decode(&item)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.Items = append(b.Items, item)
+	}
+}
+
+// BatchResponse holds one result per item, in input order, and counters
+// that the gateway adds up across chunks.
+type BatchResponse[R any] struct {
+	Results []R            `json:"results"`
+	Summary map[string]int `json:"summary"`
+}
+
+// BatchItemError is the result the gateway gives, in place of the worker,
+// to an item it could not send, such as one too large for a message.
+type BatchItemError struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// mapParallel applies fn to every item on up to GOMAXPROCS goroutines.
+func mapParallel[T, R any](items []T, fn func(i int, item T) R) []R {
+	results := make([]R, len(items))
+
+	var (
+		next atomic.Int64
+		wg   sync.WaitGroup
+	)
+	for range min(runtime.GOMAXPROCS(0), len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= len(items) {
+					return
+				}
+				results[i] = fn(i, items[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// batchChunk is a slice of the input sent as one message; reply receives
+// the worker answer once it arrives.
+type batchChunk struct {
+	offset int
+	err    error
+	reply  chan batchReply
+}
+
+type batchReply struct {
+	results []json.RawMessage
+	summary map[string]int
+	err     error
+}
+
+// proxyBatch serves a route declaring x-nats-batch. The body, a JSON array
+// or NDJSON, is read as a stream and sent to the worker in chunks of
+// route.batch items, a few chunks in flight at once. Results are streamed
+// back as NDJSON in input order, followed by a {"summary": ...} line. An
+// item too large for a message gets a 413 BatchItemError result, counted
+// in the summary total and as too_large. A failure ends the stream with an
+// {"error": ...} line instead, so a response without a summary is
+// incomplete.
+func proxyBatch(ctx context.Context, nc *nats.Conn, route *Route) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("schema") != "" {
+			proxyNats(ctx, nc, route)(c)
+			return
+		}
+
+		next, err := batchItems(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// parameters are read once, the gin context is not safe to share
+		tmpl := &nats.Msg{Header: nats.Header{}}
+		forwardParams(c, tmpl, route)
+
+		reqCtx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		chunks := make(chan *batchChunk, batchInFlight)
+		go func() {
+			defer close(chunks)
+			readBatchChunks(reqCtx, next, route.batch, int(nc.MaxPayload()/2), chunks, func(offset int, items []json.RawMessage) chan batchReply {
+				reply := make(chan batchReply, 1)
+				go func() { reply <- requestBatchChunk(reqCtx, nc, route, tmpl.Header, offset, items) }()
+				return reply
+			})
+		}()
+
+		c.Header(headerContentType, "application/x-ndjson")
+		c.Status(http.StatusOK)
+
+		enc := json.NewEncoder(c.Writer)
+		summary := make(map[string]int)
+		failed := false
+		for chunk := range chunks {
+			// keep draining so the reader goroutine always finishes
+			if failed {
+				continue
+			}
+
+			var r batchReply
+			if chunk.err != nil {
+				r.err = chunk.err
+			} else {
+				r = <-chunk.reply
+			}
+
+			if r.err != nil {
+				failed = true
+				cancel()
+				_ = enc.Encode(gin.H{"error": r.err.Error(), "offset": chunk.offset})
+				c.Writer.Flush()
+				continue
+			}
+
+			for _, res := range r.results {
+				_, _ = c.Writer.Write(append(res, '\n'))
+			}
+			for k, v := range r.summary {
+				summary[k] += v
+			}
+			c.Writer.Flush()
+		}
+
+		if !failed {
+			_ = enc.Encode(gin.H{"summary": summary})
+		}
+	}
+}
+
+// readBatchChunks groups items into chunks of up to size items and
+// maxBytes bytes, starting each with send and queueing it on chunks in
+// order. An item larger than maxBytes is not sent: it is queued alone,
+// answered with tooLargeReply. A read error is queued as a failed chunk.
+func readBatchChunks(ctx context.Context, next func() (json.RawMessage, error), size, maxBytes int, chunks chan<- *batchChunk, send func(int, []json.RawMessage) chan batchReply) {
+	var (
+		items   []json.RawMessage
+		pending int
+		offset  int
+	)
+
+	flush := func() {
+		if len(items) > 0 {
+			chunks <- &batchChunk{offset: offset, reply: send(offset, items)}
+			offset += len(items)
+			items, pending = nil, 0
+		}
+	}
+
+	for ctx.Err() == nil {
+		item, err := next()
+		if errors.Is(err, io.EOF) {
+			flush()
+			return
+		}
+		if err != nil {
+			flush()
+			chunks <- &batchChunk{offset: offset, err: fmt.Errorf("invalid item: %w", err)}
+			return
+		}
+
+		if len(item) > maxBytes {
+			flush()
+			reply := make(chan batchReply, 1)
+			reply <- tooLargeReply(offset, len(item), maxBytes)
+			chunks <- &batchChunk{offset: offset, reply: reply}
+			offset++
+			continue
+		}
+
+		if pending+len(item) > maxBytes {
+			flush()
+		}
+		items = append(items, item)
+		pending += len(item) + 1
+		if len(items) >= size {
+			flush()
+		}
+	}
+}
+
+// tooLargeReply answers, in place of the worker, the item at index of n
+// bytes that does not fit in maxBytes.
+func tooLargeReply(index, n, maxBytes int) batchReply {
+	res, _ := json.Marshal(BatchItemError{
+		Index:  index,
+		Status: http.StatusRequestEntityTooLarge,
+		Error:  fmt.Sprintf("item of %d bytes exceeds the %d byte limit", n, maxBytes),
+	})
+	return batchReply{results: []json.RawMessage{res}, summary: map[string]int{"total": 1, batchTooLarge: 1}}
+}
+
+// requestBatchChunk sends one chunk to the worker and decodes its reply.
+func requestBatchChunk(ctx context.Context, nc *nats.Conn, route *Route, header nats.Header, offset int, items []json.RawMessage) batchReply {
+	data, err := json.Marshal(BatchRequest[json.RawMessage]{Offset: offset, Items: items})
+	if err != nil {
+		return batchReply{err: err}
+	}
+
+	msg := &nats.Msg{Subject: route.subject, Data: data, Header: nats.Header(http.Header(header).Clone())}
+
+	ctx, cancel := context.WithTimeout(ctx, route.timeout)
+	defer cancel()
+
+	resp, err := requestMsg(ctx, nc, msg)
+	if err != nil {
+		return batchReply{err: fmt.Errorf("error requesting %s: %w", route.subject, err)}
+	}
+
+	if status := replyStatus(resp); status >= http.StatusBadRequest {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(resp.Data, &e) != nil || e.Error == "" {
+			e.Error = string(resp.Data)
+		}
+		return batchReply{err: fmt.Errorf("%s replied %d: %s", route.subject, status, e.Error)}
+	}
+
+	var body BatchResponse[json.RawMessage]
+	if err := json.Unmarshal(resp.Data, &body); err != nil {
+		return batchReply{err: fmt.Errorf("error decoding %s reply: %w", route.subject, err)}
+	}
+
+	return batchReply{results: body.Results, summary: body.Summary}
+}
+
+// batchItems reads the items of a JSON array or of an NDJSON stream one
+// at a time, returning io.EOF after the last one.
+func batchItems(r io.Reader) (func() (json.RawMessage, error), error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("empty request body")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(br)
+	if first != '[' {
+		return func() (json.RawMessage, error) {
+			var item json.RawMessage
+			if err := dec.Decode(&item); err != nil {
+				return nil, err
+			}
+			return item, nil
+		}, nil
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return func() (json.RawMessage, error) {
+		if !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+
+		var item json.RawMessage
+		if err := dec.Decode(&item); err != nil {
+			return nil, err
+		}
+		return item, nil
+	}, nil
+}
+
+// peekNonSpace skips leading whitespace and returns the next byte unread.
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, br.UnreadByte()
+	}
+}
@@ -0,0 +1,283 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBatchRequestDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		offset int
+		items  []string
+		err    bool
+	}{
+		{"object", `{"offset": 4, "items": ["a", "b"]}`, 4, []string{"a", "b"}, false},
+		{"array", ` ["a", "b", "c"] `, 0, []string{"a", "b", "c"}, false},
+		{"ndjson", "\"a\"\n\"b\"\n\n\"c\"\n", 0, []string{"a", "b", "c"}, false},
+		{"empty", "  ", 0, nil, false},
+		{"bad array", `["a", 1]`, 0, nil, true},
+		{"bad ndjson", "\"a\"\n{", 0, nil, true},
+	}
+	for _, tt := range tests {
+		var b BatchRequest[string]
+		err := b.DecodeMessage([]byte(tt.data))
+		if (err != nil) != tt.err {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && (b.Offset != tt.offset || !equalStrings(b.Items, tt.items)) {
+			t.Errorf("%s: decoded %+v", tt.name, b)
+		}
+	}
+}
+
+func TestBatchItems(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		items []string
+		err   bool
+	}{
+		{"array", "\n [\"a\", {\"cpfcnpj\": \"b\"}, 3]", []string{`"a"`, `{"cpfcnpj": "b"}`, `3`}, false},
+		{"ndjson", "\"a\"\n{\"cpfcnpj\": \"b\"}\n", []string{`"a"`, `{"cpfcnpj": "b"}`}, false},
+		{"empty array", "[]", nil, false},
+		{"unterminated array", `["a", "b"`, []string{`"a"`, `"b"`}, true},
+		{"bad ndjson", "\"a\"\nnope\n", []string{`"a"`}, true},
+	}
+	for _, tt := range tests {
+		next, err := batchItems(strings.NewReader(tt.body))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		var items []string
+		for {
+			item, err := next()
+			if errors.Is(err, io.EOF) {
+				if tt.err {
+					t.Errorf("%s: read to the end without an error", tt.name)
+				}
+				break
+			}
+			if err != nil {
+				if !tt.err {
+					t.Errorf("%s: %v", tt.name, err)
+				}
+				break
+			}
+			items = append(items, string(item))
+		}
+		if !equalStrings(items, tt.items) {
+			t.Errorf("%s: items %v, want %v", tt.name, items, tt.items)
+		}
+	}
+
+	if _, err := batchItems(strings.NewReader(" \n")); err == nil {
+		t.Error("empty body accepted")
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	items := []json.RawMessage{
+		json.RawMessage(`"529.982.247-25"`),
+		json.RawMessage(`{"cpfcnpj": "11222333000181"}`),
+		json.RawMessage(`"52998224724"`),
+		json.RawMessage(`42`),
+		json.RawMessage(`"123"`),
+	}
+	resp, err := validateBatch(context.Background(), &Request[BatchRequest[json.RawMessage]]{
+		Body: BatchRequest[json.RawMessage]{Offset: 10, Items: items},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ   string
+		valid bool
+		err   string
+	}{
+		{docCPF, true, ""},
+		{docCNPJ, true, ""},
+		{docCPF, false, "document invalid"},
+		{"", false, "item must be a string or an object with cpfcnpj"},
+		{"", false, "document invalid"},
+	}
+	for i, res := range resp.Results {
+		if res.Index != 10+i || res.Type != want[i].typ || res.IsValid != want[i].valid || res.Error != want[i].err {
+			t.Errorf("result %d: %+v", i, res)
+		}
+	}
+
+	summary := map[string]int{"total": 5, "valid": 2, "invalid": 3, docCPF: 2, docCNPJ: 1}
+	for k, v := range summary {
+		if resp.Summary[k] != v {
+			t.Errorf("summary %v, want %v", resp.Summary, summary)
+			break
+		}
+	}
+}
+
+func TestReadBatchChunks(t *testing.T) {
+	items := []string{`"a"`, `"bb"`, `"` + strings.Repeat("x", 30) + `"`, `"c"`, `"dddddddd"`, `"eeeeeeee"`}
+	i := 0
+	next := func() (json.RawMessage, error) {
+		if i == len(items) {
+			return nil, io.EOF
+		}
+		i++
+		return json.RawMessage(items[i-1]), nil
+	}
+
+	type sent struct {
+		offset int
+		items  []string
+	}
+	var sends []sent
+	chunks := make(chan *batchChunk, len(items))
+	readBatchChunks(context.Background(), next, 3, 20, chunks, func(offset int, items []json.RawMessage) chan batchReply {
+		s := sent{offset: offset}
+		for _, item := range items {
+			s.items = append(s.items, string(item))
+		}
+		sends = append(sends, s)
+		return make(chan batchReply, 1)
+	})
+	close(chunks)
+
+	// the oversized item is answered in place, between the chunks around it
+	want := []sent{
+		{0, []string{`"a"`, `"bb"`}},
+		{3, []string{`"c"`, `"dddddddd"`}},
+		{5, []string{`"eeeeeeee"`}},
+	}
+	if len(sends) != len(want) {
+		t.Fatalf("sent %v, want %v", sends, want)
+	}
+	for i, s := range sends {
+		if s.offset != want[i].offset || !equalStrings(s.items, want[i].items) {
+			t.Fatalf("chunk %d: sent %v, want %v", i, s, want[i])
+		}
+	}
+
+	var offsets []int
+	for chunk := range chunks {
+		offsets = append(offsets, chunk.offset)
+		if chunk.offset != 2 {
+			continue
+		}
+		r := <-chunk.reply
+		var res BatchItemError
+		if len(r.results) != 1 || json.Unmarshal(r.results[0], &res) != nil {
+			t.Fatalf("oversized item reply %+v", r)
+		}
+		if res.Index != 2 || res.Status != http.StatusRequestEntityTooLarge || r.summary["total"] != 1 || r.summary[batchTooLarge] != 1 {
+			t.Fatalf("oversized item result %+v, summary %v", res, r.summary)
+		}
+	}
+	if len(offsets) != 4 || offsets[1] != 2 {
+		t.Fatalf("chunks queued at offsets %v, want 0 2 3 5", offsets)
+	}
+}
+
+func TestProxyBatch(t *testing.T) {
+	nc := testNats(t)
+	batch := NewWorker("cpfcnpj-batch", "service.cpfcnpj.batch", validateBatch)
+	startTestService(t, nc, batch)
+
+	ar := batch.Route(http.MethodPost, "/batch/cpfcnpj", "2s")
+	ar.Batch = 2
+	route, err := announcedRoute(ar, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/batch/cpfcnpj", proxyBatch(context.Background(), nc, route))
+
+	docs := []string{`"52998224725"`, `"11222333000181"`, `"00000000000"`, `{"cpfcnpj": "12ABC34501DE35"}`, `"529.982.247-25"`}
+	for _, body := range []string{
+		strings.Join(docs, "\n"),
+		"[" + strings.Join(docs, ",") + "]",
+	} {
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/batch/cpfcnpj", strings.NewReader(body)))
+		if rec.Code != http.StatusOK || rec.Header().Get(headerContentType) != "application/x-ndjson" {
+			t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get(headerContentType))
+		}
+
+		var lines []string
+		sc := bufio.NewScanner(rec.Body)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if len(lines) != len(docs)+1 {
+			t.Fatalf("%d lines, want %d results and a summary:\n%s", len(lines), len(docs), strings.Join(lines, "\n"))
+		}
+
+		// results keep input order across chunks
+		for i, line := range lines[:len(docs)] {
+			var res BatchResult
+			if err := json.Unmarshal([]byte(line), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Index != i || res.IsValid == (i == 2) {
+				t.Errorf("line %d: %s", i, line)
+			}
+		}
+
+		var last struct {
+			Summary map[string]int `json:"summary"`
+		}
+		if err := json.Unmarshal([]byte(lines[len(docs)]), &last); err != nil {
+			t.Fatal(err)
+		}
+		if s := last.Summary; s["total"] != 5 || s["valid"] != 4 || s["invalid"] != 1 || s[docCPF] != 3 || s[docCNPJ] != 2 {
+			t.Errorf("summary %v", s)
+		}
+	}
+
+	// an item too large for a message is rejected on its own
+	huge := `"` + strings.Repeat("1", int(nc.MaxPayload())) + `"`
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/batch/cpfcnpj", strings.NewReader(docs[0]+"\n"+huge+"\n"+docs[1])))
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("%d lines, want 3 results and a summary:\n%.500s", len(lines), rec.Body.String())
+	}
+	var tooLarge BatchItemError
+	if err := json.Unmarshal([]byte(lines[1]), &tooLarge); err != nil {
+		t.Fatal(err)
+	}
+	if tooLarge.Index != 1 || tooLarge.Status != http.StatusRequestEntityTooLarge || tooLarge.Error == "" {
+		t.Errorf("oversized item result %s", lines[1])
+	}
+	var last struct {
+		Summary map[string]int `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if s := last.Summary; s["total"] != 3 || s["valid"] != 2 || s[batchTooLarge] != 1 {
+		t.Errorf("summary %v", s)
+	}
+
+	// an unreadable item ends the stream with an error line
+	rec = httptest.NewRecorder()
+	engine.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/batch/cpfcnpj", strings.NewReader("\"52998224725\"\n{")))
+	if !strings.Contains(rec.Body.String(), `"error"`) || strings.Contains(rec.Body.String(), `"summary"`) {
+		t.Errorf("body of a broken stream:\n%s", rec.Body.String())
+	}
+}
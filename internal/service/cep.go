@@ -1,86 +1,307 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
 
-	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
 )
 
+// CepRequest is the body accepted by service.cep; GET routes pass the CEP
+// as the {cep} path parameter instead.
+type CepRequest struct {
+	CEP string `json:"cep" pattern:"^[0-9]{5}-?[0-9]{3}$"`
+}
+
 func Cep(cmd *cobra.Command, _ []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	cfg, err := serviceCommon(cmd.Context(), configStr)
+	cfg, err := serviceCommon(cmd)
 	if err != nil {
 		return err
 	}
 
-	return handleCepMsg(cfg)
+	if f := cmd.Flag("offline"); f != nil && f.Changed {
+		cfg.Cep.Offline = f.Value.String() == "true"
+	}
+
+	return runCep(cfg)
 }
 
-func handleCepMsg(cfg *ConfigService) error {
-	_, err := cfg.nc.QueueSubscribe("service.cep", "cep-workers", cepWorkers)
+func runCep(cfg *ConfigService) error {
+	providers, err := newCepProviders(cfg.Cep.Providers)
 	if err != nil {
-		log.Printf("[cep] error subscribing to service.cep: %v", err)
 		return err
 	}
 
-	log.Println("CEP proxy service listening")
-	select {}
-}
+	db, err := newDatabase(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
 
-func cepWorkers(m *nats.Msg) {
-	log.Printf("[cep] headers=%v data=%s", m.Header, string(m.Data))
+	if err := db.AutoMigrate(&model.CEP{}, &model.CEPRange{}); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
 
-	if _, ok := m.Header["schema"]; ok {
-		schema := map[string]string{"cep": "string"}
-		b, _ := json.Marshal(schema)
-		_ = m.RespondMsg(&nats.Msg{Data: b, Header: nats.Header{"schema": {string(b)}}})
-		return
+	strategy := cfg.Cep.Strategy
+	if strategy == "" {
+		strategy = cepStrategyFallback
 	}
+	if cfg.Cep.Offline {
+		// answer from the imported data only
+		strategy, providers = "offline", nil
+	}
+
+	cache := newCepCache(db, cfg.Cep)
+	cache.setupSearch()
 
-	var req map[string]string
-	if err := json.Unmarshal(m.Data, &req); err != nil {
-		_ = m.Respond([]byte(`{"error":"bad request"}`))
-		return
+	w := NewWorker("cep", "service.cep", lookupCep(cache, providers, strategy))
+	search := NewWorker("cep-search", "service.cep.search", searchCep(cache, providers))
+	svc := NewService("cep", "CEP address lookup", WithMetadata(map[string]string{
+		"strategy": strategy,
+	})).Add(w, search)
+	if err := svc.Start(cfg.ctx, cfg.nc); err != nil {
+		return err
 	}
 
-	cepQ := req["cep"]
-	if cepQ == "" {
-		_ = m.Respond([]byte(`{"error":"missing cep"}`))
-		return
+	searchRoute := search.Route(http.MethodGet, "/search/cep", "5s")
+	searchRoute.Query = []string{"uf", "cidade", "logradouro", "limit"}
+	routes := []AnnouncedRoute{
+		w.Route(http.MethodPost, "/lookup/cep", "5s"),
+		w.Route(http.MethodGet, "/lookup/cep/{cep}", "5s"),
+		search.Route(http.MethodPost, "/search/cep", "5s"),
+		searchRoute,
+	}
+	if err := cfg.announceRoutes("cep", routes); err != nil {
+		return err
 	}
 
-	respMsg, err := queryCEP(cepQ)
-	if err != nil {
-		log.Printf("[cep] error querying CEP: %v", err)
-		_ = m.Respond([]byte(`{"error":"service unavailable"}`))
-		return
+	if cfg.Cep.Offline {
+		log.Println("CEP proxy service listening (offline)")
+	} else {
+		log.Printf("CEP proxy service listening (%s over %d providers)", strategy, len(providers))
 	}
+	return cfg.waitForShutdown("cep", svc.Stop, cfg.drain, closeDatabase(db))
+}
+
+func lookupCep(cache *cepCache, providers []CepProvider, strategy string) HandlerFunc[CepRequest, *CepAddress] {
+	return func(ctx context.Context, req *Request[CepRequest]) (*CepAddress, error) {
+		cepQ := req.Body.CEP
+		if cepQ == "" {
+			cepQ = req.Param(paramPath, "cep")
+		}
+		if cepQ == "" {
+			return nil, errBadRequest("missing cep")
+		}
+
+		cepQ = normalizeCEP(cepQ)
+		if len(cepQ) != 8 {
+			return nil, errBadRequest("invalid cep")
+		}
 
-	_ = m.Respond(respMsg)
+		cached, fresh, err := cache.get(ctx, cepQ)
+		if err != nil {
+			log.Printf("[cep] error reading cache: %v", err)
+		}
+		if cached != nil && (fresh || len(providers) == 0) {
+			return answerCEP(ctx, cache, cached)
+		}
+
+		if len(providers) == 0 {
+			return rangeCEP(ctx, cache, cepQ, nil)
+		}
+
+		entry := &model.CEP{CEP: cepQ}
+		addr, provider, err := lookupCepProviders(ctx, providers, strategy, cepQ)
+		switch {
+		case errors.Is(err, ErrCEPNotFound):
+			entry.NotFound = true
+		case err != nil:
+			if cached != nil {
+				log.Printf("[cep] error querying CEP, serving stale entry for %s: %v", cepQ, err)
+				return answerCEP(ctx, cache, cached)
+			}
+			log.Printf("[cep] error querying CEP: %v", err)
+			return rangeCEP(ctx, cache, cepQ, errUnavailable("service unavailable"))
+		default:
+			entry.Street = addr.Logradouro
+			entry.Neighborhood = addr.Bairro
+			entry.City = addr.Cidade
+			entry.State = addr.UF
+			entry.IBGE = addr.IBGE
+			entry.Provider = provider
+		}
+
+		if err := cache.put(ctx, entry); err != nil {
+			log.Printf("[cep] error writing cache: %v", err)
+		}
+
+		return answerCEP(ctx, cache, entry)
+	}
 }
 
-func queryCEP(cep string) ([]byte, error) {
-	url := fmt.Sprintf("https://viacep.com.br/ws/%s/json/", cep)
+// answerCEP answers with entry or, for a CEP no provider knows, with the
+// imported range holding it.
+func answerCEP(ctx context.Context, cache *cepCache, entry *model.CEP) (*CepAddress, error) {
+	if entry.NotFound {
+		return rangeCEP(ctx, cache, entry.CEP, nil)
+	}
+	return cachedCEP(entry)
+}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
+func cachedCEP(entry *model.CEP) (*CepAddress, error) {
+	if entry.NotFound {
+		return nil, errNotFound("cep %s not found", entry.CEP)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error en consulta viacep, status: %s", resp.Status)
+	return &CepAddress{
+		CEP:        entry.CEP,
+		Logradouro: entry.Street,
+		Bairro:     entry.Neighborhood,
+		Cidade:     entry.City,
+		UF:         entry.State,
+		IBGE:       entry.IBGE,
+	}, nil
+}
+
+// CepSearchRequest is the body accepted by service.cep.search; GET routes
+// pass the same fields as query parameters instead.
+type CepSearchRequest struct {
+	UF         string `json:"uf,omitempty" pattern:"^[A-Za-z]{2}$"`
+	Cidade     string `json:"cidade,omitempty"`
+	Logradouro string `json:"logradouro,omitempty"`
+	Limit      int    `json:"limit,omitempty"`
+}
+
+// CepSearchResponse lists the candidate CEPs of an address search.
+type CepSearchResponse struct {
+	Results []CepAddress `json:"results"`
+}
+
+const (
+	defaultCepSearchLimit = 20
+	maxCepSearchLimit     = 100
+)
+
+// searchCep finds the CEPs of an address from fragments of its city and
+// street, accents and case ignored. The local database is searched first;
+// when it has too few candidates the first provider supporting search is
+// asked too, and what it returns is cached.
+func searchCep(cache *cepCache, providers []CepProvider) HandlerFunc[CepSearchRequest, *CepSearchResponse] {
+	return func(ctx context.Context, req *Request[CepSearchRequest]) (*CepSearchResponse, error) {
+		body := req.Body
+		if body.UF == "" {
+			body.UF = req.Param(paramQuery, "uf")
+		}
+		if body.Cidade == "" {
+			body.Cidade = req.Param(paramQuery, "cidade")
+		}
+		if body.Logradouro == "" {
+			body.Logradouro = req.Param(paramQuery, "logradouro")
+		}
+		if body.Limit == 0 {
+			body.Limit, _ = strconv.Atoi(req.Param(paramQuery, "limit"))
+		}
+
+		body.UF = strings.ToUpper(strings.TrimSpace(body.UF))
+		body.Cidade = strings.TrimSpace(body.Cidade)
+		body.Logradouro = strings.TrimSpace(body.Logradouro)
+		if body.UF != "" && len(body.UF) != 2 {
+			return nil, errBadRequest("invalid uf")
+		}
+		if len([]rune(body.Cidade+body.Logradouro)) < 3 {
+			return nil, errBadRequest("cidade or logradouro must have at least 3 characters")
+		}
+		if body.Limit <= 0 {
+			body.Limit = defaultCepSearchLimit
+		}
+		body.Limit = min(body.Limit, maxCepSearchLimit)
+
+		found, err := cache.search(ctx, body.UF, body.Cidade+" "+body.Logradouro, body.Limit)
+		if err != nil {
+			log.Printf("[cep-search] error searching local ceps: %v", err)
+		}
+
+		resp := &CepSearchResponse{Results: make([]CepAddress, 0, len(found))}
+		seen := make(map[string]bool)
+		for i := range found {
+			addr, _ := cachedCEP(&found[i])
+			resp.Results = append(resp.Results, *addr)
+			seen[addr.CEP] = true
+		}
+
+		// the provider search endpoints need the full UF, city and street
+		if len(resp.Results) >= body.Limit || body.UF == "" || body.Cidade == "" || len([]rune(body.Logradouro)) < 3 {
+			return resp, nil
+		}
+
+		for _, p := range providers {
+			addrs, err := p.Search(ctx, body.UF, body.Cidade, body.Logradouro)
+			if errors.Is(err, ErrSearchUnsupported) {
+				continue
+			}
+			if err != nil {
+				log.Printf("[cep-search] error searching %s: %v", p.Name(), err)
+				continue
+			}
+
+			for _, addr := range addrs {
+				if seen[addr.CEP] || len(resp.Results) >= body.Limit {
+					continue
+				}
+				seen[addr.CEP] = true
+				resp.Results = append(resp.Results, addr)
+
+				entry := &model.CEP{
+					CEP:          addr.CEP,
+					Street:       addr.Logradouro,
+					Neighborhood: addr.Bairro,
+					City:         addr.Cidade,
+					State:        addr.UF,
+					IBGE:         addr.IBGE,
+					Provider:     p.Name(),
+				}
+				if err := cache.put(ctx, entry); err != nil {
+					log.Printf("[cep-search] error writing cache: %v", err)
+				}
+			}
+			break
+		}
+
+		return resp, nil
 	}
+}
 
-	data, err := io.ReadAll(resp.Body)
+// rangeCEP answers with the locality of the imported range holding cep,
+// or with notFound, a 404 when nil, if there is none.
+func rangeCEP(ctx context.Context, cache *cepCache, cep string, notFound error) (*CepAddress, error) {
+	rng, err := cache.getRange(ctx, cep)
 	if err != nil {
-		return nil, err
+		log.Printf("[cep] error reading cep ranges: %v", err)
+		return nil, errUnavailable("service unavailable")
+	}
+
+	if rng == nil {
+		if notFound != nil {
+			return nil, notFound
+		}
+		return nil, errNotFound("cep %s not found", cep)
 	}
 
-	return data, nil
+	return &CepAddress{CEP: cep, Cidade: rng.City, UF: rng.State, IBGE: rng.IBGE}, nil
+}
+
+// normalizeCEP strips the mask, leaving only the digits.
+func normalizeCEP(cep string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, cep)
 }
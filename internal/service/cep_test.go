@@ -0,0 +1,64 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+)
+
+func TestLookupCepRanges(t *testing.T) {
+	db := testDB(t, &model.CEP{}, &model.CEPRange{})
+	ctx := context.Background()
+	cache := newCepCache(db, CepConfig{})
+
+	// Bonito, MS is served by a generic CEP range
+	if err := db.Create(&model.CEPRange{StartCEP: "79290000", EndCEP: "79299999", City: "Bonito", State: "MS", IBGE: "5002209"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, cep := range []string{"79290123", "01009999"} {
+		if err := cache.put(ctx, &model.CEP{CEP: cep, NotFound: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notFound := cepServer(t, http.StatusNotFound, ``, 0)
+	online := testProviders(t, CepProviderConfig{Name: "brasilapi", Url: notFound.URL + "/%s"})
+
+	tests := []struct {
+		name      string
+		providers []CepProvider
+		cep       string
+		city      string
+	}{
+		{"offline cached not found in range", nil, "79290-123", "Bonito"},
+		{"offline uncached in range", nil, "79295000", "Bonito"},
+		{"offline cached not found", nil, "01009999", ""},
+		{"online cached not found in range", online, "79290123", "Bonito"},
+		{"online not found in range", online, "79299999", "Bonito"},
+		{"online not found", online, "01008888", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := lookupCep(cache, tt.providers, cepStrategyFallback)
+			addr, err := lookup(ctx, &Request[CepRequest]{Body: CepRequest{CEP: tt.cep}})
+
+			if tt.city == "" {
+				var svcErr *ServiceError
+				if !errors.As(err, &svcErr) || svcErr.Status != http.StatusNotFound {
+					t.Fatalf("err = %v, want 404", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.Cidade != tt.city || addr.UF != "MS" || addr.CEP != normalizeCEP(tt.cep) {
+				t.Fatalf("got %+v", addr)
+			}
+		})
+	}
+}
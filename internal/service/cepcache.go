@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultCepCacheTTL    = 30 * 24 * time.Hour
+	defaultCepNegativeTTL = 24 * time.Hour
+)
+
+// CepConfig selects the CEP providers and tunes the cache kept in model.CEP.
+type CepConfig struct {
+	Offline     bool                `yaml:"offline"`
+	Strategy    string              `yaml:"strategy"`
+	Providers   []CepProviderConfig `yaml:"providers"`
+	CacheTTL    time.Duration       `yaml:"cacheTTL"`
+	NegativeTTL time.Duration       `yaml:"negativeTTL"`
+}
+
+// cepUpsertColumns are refreshed when a cached or imported CEP is written again.
+var cepUpsertColumns = []string{"street", "neighborhood", "city", "state", "ibge", "provider", "not_found", "search_text", "fetched_at", "updated_at"}
+
+// cepCache reads through and writes through the model.CEP table. Entries
+// past their TTL are still returned, marked stale, so the worker can fall
+// back to them when the upstream is down.
+type cepCache struct {
+	db          *gorm.DB
+	ttl         time.Duration
+	negativeTTL time.Duration
+	fts         bool
+}
+
+func newCepCache(db *gorm.DB, cfg CepConfig) *cepCache {
+	c := &cepCache{db: db, ttl: cfg.CacheTTL, negativeTTL: cfg.NegativeTTL}
+	if c.ttl <= 0 {
+		c.ttl = defaultCepCacheTTL
+	}
+	if c.negativeTTL <= 0 {
+		c.negativeTTL = defaultCepNegativeTTL
+	}
+	return c
+}
+
+// get returns the cached entry for cep, or nil, and whether it is fresh.
+func (c *cepCache) get(ctx context.Context, cep string) (*model.CEP, bool, error) {
+	var entry model.CEP
+	err := c.db.WithContext(ctx).Where("cep = ?", cep).First(&entry).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	ttl := c.ttl
+	if entry.NotFound {
+		ttl = c.negativeTTL
+	}
+
+	return &entry, time.Since(entry.FetchedAt) < ttl, nil
+}
+
+// put stores or refreshes the entry for entry.CEP.
+func (c *cepCache) put(ctx context.Context, entry *model.CEP) error {
+	entry.FetchedAt = time.Now()
+	return c.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "cep"}},
+		DoUpdates: clause.AssignmentColumns(cepUpsertColumns),
+	}).Create(entry).Error
+}
+
+// getRange returns the narrowest imported range holding cep, or nil.
+func (c *cepCache) getRange(ctx context.Context, cep string) (*model.CEPRange, error) {
+	var rng model.CEPRange
+	err := c.db.WithContext(ctx).
+		Where("start_cep <= ? AND end_cep >= ?", cep, cep).
+		Order("CAST(end_cep AS INTEGER) - CAST(start_cep AS INTEGER)").
+		First(&rng).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rng, nil
+}
+
+// ftsTriggers keep ceps_fts in sync with every write to ceps.
+var ftsTriggers = []string{"ceps_fts_ai", "ceps_fts_ad", "ceps_fts_au"}
+
+// setupSearch creates the FTS5 index over model.CEP, kept in sync by
+// triggers. The index is only rebuilt from ceps when it is new or its
+// triggers were missing, since writes made meanwhile were not indexed.
+// FTS5 is only compiled into go-sqlite3 with the sqlite_fts5 build tag;
+// without it searches use LIKE over the search_text column.
+func (c *cepCache) setupSearch() {
+	var synced int64
+	if err := c.db.Raw("SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN ?", ftsTriggers).
+		Scan(&synced).Error; err != nil {
+		log.Printf("[cep] error checking full-text search triggers: %v", err)
+	}
+
+	stmts := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS ceps_fts USING fts5(search_text, content='ceps', content_rowid='id', tokenize='unicode61 remove_diacritics 2')`,
+		`CREATE TRIGGER IF NOT EXISTS ceps_fts_ai AFTER INSERT ON ceps BEGIN
+			INSERT INTO ceps_fts(rowid, search_text) VALUES (new.id, new.search_text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS ceps_fts_ad AFTER DELETE ON ceps BEGIN
+			INSERT INTO ceps_fts(ceps_fts, rowid, search_text) VALUES ('delete', old.id, old.search_text);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS ceps_fts_au AFTER UPDATE ON ceps BEGIN
+			INSERT INTO ceps_fts(ceps_fts, rowid, search_text) VALUES ('delete', old.id, old.search_text);
+			INSERT INTO ceps_fts(rowid, search_text) VALUES (new.id, new.search_text);
+		END`,
+	}
+	if synced < int64(len(ftsTriggers)) {
+		stmts = append(stmts, `INSERT INTO ceps_fts(ceps_fts) VALUES ('rebuild')`)
+	}
+
+	for _, stmt := range stmts {
+		if err := c.db.Exec(stmt).Error; err != nil {
+			log.Printf("[cep] full-text search unavailable, using LIKE: %v", err)
+			// triggers left by a build with FTS5 would make every write fail;
+			// the index is rebuilt when such a build starts again
+			for _, t := range ftsTriggers {
+				_ = c.db.Exec("DROP TRIGGER IF EXISTS " + t).Error
+			}
+			return
+		}
+	}
+
+	c.fts = true
+}
+
+// search finds cached or imported CEPs in uf whose address matches every
+// word of text, accents and case ignored.
+func (c *cepCache) search(ctx context.Context, uf, text string, limit int) ([]model.CEP, error) {
+	words := strings.Fields(model.SearchKey(text))
+	if len(words) == 0 {
+		return nil, nil
+	}
+
+	q := c.db.WithContext(ctx).Model(&model.CEP{}).
+		Where("ceps.not_found = ?", false).
+		Limit(limit)
+	if uf != "" {
+		q = q.Where("ceps.state = ?", strings.ToUpper(uf))
+	}
+
+	if c.fts {
+		terms := make([]string, len(words))
+		for i, w := range words {
+			terms[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"*`
+		}
+		q = q.Joins("JOIN ceps_fts ON ceps_fts.rowid = ceps.id").
+			Where("ceps_fts MATCH ?", strings.Join(terms, " ")).
+			Order("ceps_fts.rank")
+	} else {
+		for _, w := range words {
+			q = q.Where("ceps.search_text LIKE ? ESCAPE '\\'", "%"+escapeLike(w)+"%")
+		}
+		q = q.Order("ceps.cep")
+	}
+
+	var out []model.CEP
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testDB opens a fresh SQLite database migrated for models.
+func testDB(t *testing.T, models ...any) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000&_journal_mode=WAL"), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return db
+}
+
+func searchCEPs(t *testing.T, c *cepCache, uf, text string) []string {
+	t.Helper()
+	found, err := c.search(context.Background(), uf, text, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]string, 0, len(found))
+	for _, f := range found {
+		out = append(out, f.CEP)
+	}
+	return out
+}
+
+func TestCepCacheSearch(t *testing.T) {
+	db := testDB(t, &model.CEP{}, &model.CEPRange{})
+	ctx := context.Background()
+
+	c := newCepCache(db, CepConfig{})
+	put := func(cep, street, city, uf string) {
+		t.Helper()
+		if err := c.put(ctx, &model.CEP{CEP: cep, Street: street, Neighborhood: "Centro", City: city, State: uf}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// written before the index exists, picked up when it is built
+	put("01001000", "Praça da Sé", "São Paulo", "SP")
+	c.setupSearch()
+	t.Logf("full-text search: %v", c.fts)
+
+	// written while the index exists, kept in sync by the triggers
+	put("20040002", "Rua da Assembleia", "Rio de Janeiro", "RJ")
+	put("01310100", "Avenida Paulista", "São Paulo", "SP")
+
+	tests := []struct {
+		uf, text string
+		want     []string
+	}{
+		{"SP", "praca se", []string{"01001000"}},
+		{"sp", "PAULISTA", []string{"01310100"}},
+		{"", "assembleia rio", []string{"20040002"}},
+		{"SP", "assembleia", []string{}},
+		{"", "nowhere", []string{}},
+	}
+	for _, tt := range tests {
+		if got := searchCEPs(t, c, tt.uf, tt.text); !equalStrings(got, tt.want) {
+			t.Errorf("search(%q, %q) = %v, want %v", tt.uf, tt.text, got, tt.want)
+		}
+	}
+
+	// an update moves the CEP in the index
+	put("01310100", "Rua Augusta", "São Paulo", "SP")
+	if got := searchCEPs(t, c, "SP", "paulista"); len(got) != 0 {
+		t.Errorf("updated CEP still found by its old street: %v", got)
+	}
+	if got := searchCEPs(t, c, "SP", "augusta"); !equalStrings(got, []string{"01310100"}) {
+		t.Errorf("updated CEP not found by its new street: %v", got)
+	}
+
+	// a start without FTS5 drops the triggers; the next start with it
+	// rebuilds the index to pick up what was written meanwhile
+	for _, trigger := range ftsTriggers {
+		if err := db.Exec("DROP TRIGGER IF EXISTS " + trigger).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("30130000", "Praça Sete de Setembro", "Belo Horizonte", "MG")
+
+	c = newCepCache(db, CepConfig{})
+	c.setupSearch()
+	if got := searchCEPs(t, c, "MG", "sete setembro"); !equalStrings(got, []string{"30130000"}) {
+		t.Errorf("CEP written without triggers not found after restart: %v", got)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,401 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/spf13/cobra"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	importFormatCSV = "csv"
+	importFormatDNE = "dne"
+
+	defaultImportBatchSize = 1000
+)
+
+// dneLayout is the fixed-width record read by the dne format, in
+// characters. A record with an end CEP describes the range of a locality
+// served by a single generic CEP; the street fields are then blank.
+var dneLayout = []struct {
+	field string
+	width int
+}{
+	{"cep", 8},
+	{"cep_fim", 8},
+	{"uf", 2},
+	{"cidade", 72},
+	{"bairro", 72},
+	{"logradouro", 100},
+	{"ibge", 7},
+}
+
+// csvColumns maps accepted CSV header names to record fields.
+var csvColumns = map[string]string{
+	"cep":          "cep",
+	"cep_inicio":   "cep",
+	"cep_ini":      "cep",
+	"cep_fim":      "cep_fim",
+	"cep_final":    "cep_fim",
+	"logradouro":   "logradouro",
+	"street":       "logradouro",
+	"bairro":       "bairro",
+	"neighborhood": "bairro",
+	"cidade":       "cidade",
+	"localidade":   "cidade",
+	"city":         "cidade",
+	"uf":           "uf",
+	"estado":       "uf",
+	"state":        "uf",
+	"ibge":         "ibge",
+	"codigo_ibge":  "ibge",
+}
+
+// cepRecord is one row of an import file, keyed by the field names above.
+type cepRecord map[string]string
+
+// ImportCep loads a CEP dataset into model.CEP and model.CEPRange so the
+// cep worker can answer offline. Only the database is used, NATS is not.
+func ImportCep(cmd *cobra.Command, args []string) error {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	format, _ := cmd.Flags().GetString("format")
+	encoding, _ := cmd.Flags().GetString("encoding")
+	batchSize, _ := cmd.Flags().GetInt("batch-size")
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+
+	path := args[0]
+	if format == "" {
+		format = importFormatDNE
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			format = importFormatCSV
+		}
+	}
+
+	db, err := newDatabase(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	defer func() { _ = closeDatabase(db)(context.Background()) }()
+
+	if err := db.AutoMigrate(&model.CEP{}, &model.CEPRange{}); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	counter := &countingReader{r: f}
+	var r io.Reader = counter
+	switch strings.ToLower(encoding) {
+	case "", "utf8", "utf-8":
+	case "latin1", "iso-8859-1":
+		r = &latin1Reader{r: r}
+	default:
+		return fmt.Errorf("unsupported encoding %q", encoding)
+	}
+
+	var next func() (cepRecord, error)
+	switch format {
+	case importFormatCSV:
+		next, err = csvRecords(r)
+	case importFormatDNE:
+		next, err = dneRecords(r)
+	default:
+		err = fmt.Errorf("unsupported format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	imp := &cepImporter{db: db, batchSize: batchSize, started: time.Now()}
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	log.Printf("[import] loading %s (%s, %d bytes)", path, format, st.Size())
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			_ = imp.flush(ctx)
+			return fmt.Errorf("import interrupted after %d ceps and %d ranges: %w", imp.ceps, imp.ranges, err)
+		}
+
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %w", n, err)
+		}
+
+		if err := imp.add(rec); err != nil {
+			imp.skipped++
+			if imp.skipped <= 10 {
+				log.Printf("[import] skipping record %d: %v", n, err)
+			}
+			continue
+		}
+
+		if imp.pending() >= batchSize {
+			if err := imp.flush(ctx); err != nil {
+				return err
+			}
+			imp.progress(counter.n, st.Size())
+		}
+	}
+
+	if err := imp.flush(ctx); err != nil {
+		return err
+	}
+	imp.progress(counter.n, st.Size())
+
+	log.Printf("[import] done: %d ceps, %d ranges, %d skipped in %s",
+		imp.ceps, imp.ranges, imp.skipped, time.Since(imp.started).Round(time.Millisecond))
+	return nil
+}
+
+// cepImporter upserts records in batches.
+type cepImporter struct {
+	db        *gorm.DB
+	batchSize int
+	started   time.Time
+	batchCEP  []model.CEP
+	batchRng  []model.CEPRange
+	ceps      int
+	ranges    int
+	skipped   int
+}
+
+func (imp *cepImporter) add(rec cepRecord) error {
+	start := normalizeCEP(rec["cep"])
+	end := normalizeCEP(rec["cep_fim"])
+	if len(start) != 8 || (end != "" && len(end) != 8) {
+		return fmt.Errorf("invalid cep %q", rec["cep"])
+	}
+	if rec["cidade"] == "" || len(rec["uf"]) != 2 {
+		return fmt.Errorf("cidade and uf are required")
+	}
+
+	if end != "" && end != start {
+		if end < start {
+			return fmt.Errorf("range %s-%s is reversed", start, end)
+		}
+		imp.batchRng = append(imp.batchRng, model.CEPRange{
+			StartCEP: start,
+			EndCEP:   end,
+			City:     rec["cidade"],
+			State:    strings.ToUpper(rec["uf"]),
+			IBGE:     rec["ibge"],
+		})
+		return nil
+	}
+
+	imp.batchCEP = append(imp.batchCEP, model.CEP{
+		CEP:          start,
+		Street:       rec["logradouro"],
+		Neighborhood: rec["bairro"],
+		City:         rec["cidade"],
+		State:        strings.ToUpper(rec["uf"]),
+		IBGE:         rec["ibge"],
+		Provider:     "import",
+		FetchedAt:    time.Now(),
+	})
+	return nil
+}
+
+func (imp *cepImporter) pending() int {
+	return len(imp.batchCEP) + len(imp.batchRng)
+}
+
+func (imp *cepImporter) flush(ctx context.Context) error {
+	// a batch outlives an interrupt so what was read is not lost
+	db := imp.db.WithContext(context.WithoutCancel(ctx))
+
+	if len(imp.batchCEP) > 0 {
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "cep"}},
+			DoUpdates: clause.AssignmentColumns(cepUpsertColumns),
+		}).CreateInBatches(imp.batchCEP, imp.batchSize).Error
+		if err != nil {
+			return fmt.Errorf("error importing ceps: %w", err)
+		}
+		imp.ceps += len(imp.batchCEP)
+		imp.batchCEP = imp.batchCEP[:0]
+	}
+
+	if len(imp.batchRng) > 0 {
+		err := db.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "start_cep"}, {Name: "end_cep"}},
+			DoUpdates: clause.AssignmentColumns([]string{"city", "state", "ibge", "updated_at"}),
+		}).CreateInBatches(imp.batchRng, imp.batchSize).Error
+		if err != nil {
+			return fmt.Errorf("error importing cep ranges: %w", err)
+		}
+		imp.ranges += len(imp.batchRng)
+		imp.batchRng = imp.batchRng[:0]
+	}
+
+	return nil
+}
+
+func (imp *cepImporter) progress(read, size int64) {
+	elapsed := time.Since(imp.started)
+	rate := float64(imp.ceps+imp.ranges) / max(elapsed.Seconds(), 0.001)
+
+	pct := 100.0
+	if size > 0 {
+		pct = float64(read) * 100 / float64(size)
+	}
+
+	log.Printf("[import] %5.1f%% %d ceps, %d ranges (%.0f records/s)", pct, imp.ceps, imp.ranges, rate)
+}
+
+// csvRecords reads a CSV file with a header naming its columns; the
+// delimiter, comma or semicolon, is taken from the header line.
+func csvRecords(r io.Reader) (func() (cepRecord, error), error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(min(br.Size(), 4096))
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return nil, err
+	}
+	if i := strings.IndexByte(string(header), '\n'); i >= 0 {
+		header = header[:i]
+	}
+
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	if strings.Count(string(header), ";") > strings.Count(string(header), ",") {
+		cr.Comma = ';'
+	}
+
+	names, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading csv header: %w", err)
+	}
+
+	fields := make([]string, len(names))
+	seen := make(map[string]bool)
+	for i, name := range names {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		fields[i] = csvColumns[name]
+		seen[fields[i]] = true
+	}
+	for _, required := range []string{"cep", "cidade", "uf"} {
+		if !seen[required] {
+			return nil, fmt.Errorf("csv header is missing the %s column", required)
+		}
+	}
+
+	return func() (cepRecord, error) {
+		row, err := cr.Read()
+		if err != nil {
+			return nil, err
+		}
+
+		rec := make(cepRecord, len(fields))
+		for i, v := range row {
+			if i < len(fields) && fields[i] != "" {
+				rec[fields[i]] = strings.TrimSpace(v)
+			}
+		}
+		return rec, nil
+	}, nil
+}
+
+// dneRecords reads fixed-width records laid out as dneLayout.
+func dneRecords(r io.Reader) (func() (cepRecord, error), error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	return func() (cepRecord, error) {
+		for sc.Scan() {
+			line := []rune(strings.TrimRight(sc.Text(), "\r"))
+			if len(line) == 0 {
+				continue
+			}
+
+			rec := make(cepRecord, len(dneLayout))
+			pos := 0
+			for _, col := range dneLayout {
+				end := min(pos+col.width, len(line))
+				if pos < end {
+					rec[col.field] = strings.TrimSpace(string(line[pos:end]))
+				}
+				pos += col.width
+			}
+			return rec, nil
+		}
+
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}, nil
+}
+
+// countingReader counts the bytes read, for progress reporting.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// latin1Reader decodes ISO-8859-1, the encoding of the Correios files, to UTF-8.
+type latin1Reader struct {
+	r   io.Reader
+	buf []byte
+	err error
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	for len(l.buf) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+
+		in := make([]byte, max(len(p)/2, 1))
+		n, err := l.r.Read(in)
+		for _, b := range in[:n] {
+			l.buf = utf8.AppendRune(l.buf, rune(b))
+		}
+		l.err = err
+	}
+
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
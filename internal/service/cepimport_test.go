@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+)
+
+// readRecords returns every record next yields.
+func readRecords(t *testing.T, next func() (cepRecord, error)) []cepRecord {
+	t.Helper()
+	var out []cepRecord
+	for {
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, maps.Clone(rec))
+	}
+}
+
+func equalRecords(got, want []cepRecord) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !maps.Equal(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCSVRecords(t *testing.T) {
+	se := cepRecord{"cep": "01001-000", "logradouro": "Praça da Sé", "cidade": "São Paulo", "uf": "SP"}
+
+	tests := []struct {
+		name string
+		in   string
+		want []cepRecord
+		err  bool
+	}{
+		{"comma", "cep,logradouro,cidade,uf\n01001-000,Praça da Sé,São Paulo,SP\n", []cepRecord{se}, false},
+		{"semicolon", "cep;logradouro;cidade;uf\n01001-000;Praça da Sé;São Paulo;SP\n", []cepRecord{se}, false},
+		// commas inside the fields do not outvote the delimiter of the header
+		{"semicolon with commas", "CEP;Street;City;State\r\n01001-000;Praça da Sé, lado ímpar;São Paulo;SP\r\n",
+			[]cepRecord{{"cep": "01001-000", "logradouro": "Praça da Sé, lado ímpar", "cidade": "São Paulo", "uf": "SP"}}, false},
+		{"bom", "\ufeffcep,logradouro,cidade,uf\n01001-000,Praça da Sé,São Paulo,SP\n", []cepRecord{se}, false},
+		{"aliases and unknown columns", "cep_inicio,cep_final,localidade,estado,codigo_ibge,extra\n01000-000,09999-999,São Paulo,SP,3550308,x\n",
+			[]cepRecord{{"cep": "01000-000", "cep_fim": "09999-999", "cidade": "São Paulo", "uf": "SP", "ibge": "3550308"}}, false},
+		{"short row", "cep,logradouro,cidade,uf\n01001-000,Praça da Sé\n", []cepRecord{{"cep": "01001-000", "logradouro": "Praça da Sé"}}, false},
+		{"missing uf", "cep,cidade\n01001-000,São Paulo\n", nil, true},
+		{"empty", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, err := csvRecords(strings.NewReader(tt.in))
+			if tt.err {
+				if err == nil {
+					t.Fatal("read a file without a valid header")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readRecords(t, next); !equalRecords(got, tt.want) {
+				t.Fatalf("records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// dneLine lays out fields as dneLayout, padding each to its width in
+// characters.
+func dneLine(fields ...string) string {
+	var b strings.Builder
+	for i, f := range fields {
+		b.WriteString(f)
+		b.WriteString(strings.Repeat(" ", dneLayout[i].width-len([]rune(f))))
+	}
+	return b.String()
+}
+
+func TestDNERecords(t *testing.T) {
+	// accented fields take more bytes than characters: the next field must
+	// still start at its column
+	street := dneLine("01001000", "", "SP", "São Paulo", "Sé", "Praça da Sé", "3550308")
+	locality := dneLine("69900001", "69923999", "AC", "Rio Branco", "", "", "1200401")
+
+	next, err := dneRecords(strings.NewReader(street + "\r\n\n" + locality + "\n" + dneLine("12345678", "", "RJ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cepRecord{
+		{"cep": "01001000", "cep_fim": "", "uf": "SP", "cidade": "São Paulo", "bairro": "Sé", "logradouro": "Praça da Sé", "ibge": "3550308"},
+		{"cep": "69900001", "cep_fim": "69923999", "uf": "AC", "cidade": "Rio Branco", "bairro": "", "logradouro": "", "ibge": "1200401"},
+		// a short line fills the fields it reaches
+		{"cep": "12345678", "cep_fim": "", "uf": "RJ"},
+	}
+	if got := readRecords(t, next); !equalRecords(got, want) {
+		t.Fatalf("records = %v, want %v", got, want)
+	}
+}
+
+// latin1 encodes s, which must only hold characters of ISO-8859-1.
+func latin1(s string) string {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return string(b)
+}
+
+func TestLatin1Reader(t *testing.T) {
+	const text = "São João; Açaí; Guaraí; ÀÉÎÕÜ ç ñ"
+
+	for name, r := range map[string]io.Reader{
+		"whole":    strings.NewReader(latin1(text)),
+		"one byte": iotest.OneByteReader(strings.NewReader(latin1(text))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := io.ReadAll(&latin1Reader{r: r})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != text {
+				t.Fatalf("got %q, want %q", got, text)
+			}
+		})
+	}
+
+	// Correios files are Latin-1 fixed-width records
+	line := dneLine("01001000", "", "SP", "São Paulo", "Sé", "Praça da Sé", "3550308")
+	next, err := dneRecords(&latin1Reader{r: strings.NewReader(latin1(line))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs := readRecords(t, next)
+	if len(recs) != 1 || recs[0]["logradouro"] != "Praça da Sé" || recs[0]["ibge"] != "3550308" {
+		t.Fatalf("records = %v", recs)
+	}
+}
+
+func TestCepImporterAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		rec    cepRecord
+		ceps   int
+		ranges int
+		err    bool
+	}{
+		{"cep", cepRecord{"cep": "01001-000", "cidade": "São Paulo", "uf": "sp"}, 1, 0, false},
+		{"range", cepRecord{"cep": "69900001", "cep_fim": "69923999", "cidade": "Rio Branco", "uf": "AC"}, 0, 1, false},
+		{"range of one", cepRecord{"cep": "01001000", "cep_fim": "01001-000", "cidade": "São Paulo", "uf": "SP"}, 1, 0, false},
+		{"reversed range", cepRecord{"cep": "69923999", "cep_fim": "69900001", "cidade": "Rio Branco", "uf": "AC"}, 0, 0, true},
+		{"short cep", cepRecord{"cep": "0100100", "cidade": "São Paulo", "uf": "SP"}, 0, 0, true},
+		{"short range end", cepRecord{"cep": "69900001", "cep_fim": "6992399", "cidade": "Rio Branco", "uf": "AC"}, 0, 0, true},
+		{"letters", cepRecord{"cep": "0100A000", "cidade": "São Paulo", "uf": "SP"}, 0, 0, true},
+		{"no city", cepRecord{"cep": "01001000", "uf": "SP"}, 0, 0, true},
+		{"bad uf", cepRecord{"cep": "01001000", "cidade": "São Paulo", "uf": "São Paulo"}, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imp := &cepImporter{}
+			err := imp.add(tt.rec)
+			if (err != nil) != tt.err {
+				t.Fatalf("err = %v, want error %v", err, tt.err)
+			}
+			if len(imp.batchCEP) != tt.ceps || len(imp.batchRng) != tt.ranges {
+				t.Fatalf("%d ceps and %d ranges, want %d and %d", len(imp.batchCEP), len(imp.batchRng), tt.ceps, tt.ranges)
+			}
+			for _, c := range imp.batchCEP {
+				if c.CEP != "01001000" || c.State != "SP" || c.Provider != "import" {
+					t.Fatalf("cep = %+v", c)
+				}
+			}
+		})
+	}
+}
+
+func TestCepImporterReimport(t *testing.T) {
+	db := testDB(t, &model.CEP{}, &model.CEPRange{})
+	ctx := context.Background()
+
+	load := func(street, city string) {
+		t.Helper()
+		imp := &cepImporter{db: db, batchSize: 10}
+		recs := []cepRecord{
+			{"cep": "01001000", "logradouro": street, "cidade": "São Paulo", "uf": "SP"},
+			{"cep": "69900001", "cep_fim": "69923999", "cidade": city, "uf": "AC"},
+		}
+		for _, rec := range recs {
+			if err := imp.add(rec); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := imp.flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if imp.ceps != 1 || imp.ranges != 1 || imp.pending() != 0 {
+			t.Fatalf("imported %d ceps and %d ranges, %d pending", imp.ceps, imp.ranges, imp.pending())
+		}
+	}
+
+	load("Praça da Sé", "Rio Branco")
+	load("Praça da Sé, lado ímpar", "Rio Branco (AC)")
+
+	// the second import updates the rows of the first
+	var ceps []model.CEP
+	if err := db.Find(&ceps).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(ceps) != 1 || ceps[0].Street != "Praça da Sé, lado ímpar" {
+		t.Fatalf("ceps = %+v", ceps)
+	}
+	var ranges []model.CEPRange
+	if err := db.Find(&ranges).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 1 || ranges[0].City != "Rio Branco (AC)" {
+		t.Fatalf("ranges = %+v", ranges)
+	}
+}
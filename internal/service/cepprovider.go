@@ -0,0 +1,358 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrCEPNotFound is returned by a provider that does not know a CEP.
+	ErrCEPNotFound = errors.New("cep not found")
+	// ErrSearchUnsupported is returned by a provider without address search.
+	ErrSearchUnsupported = errors.New("address search not supported")
+)
+
+// CepAddress is the normalized answer of service.cep, whatever the provider.
+type CepAddress struct {
+	CEP        string `json:"cep"`
+	Logradouro string `json:"logradouro"`
+	Bairro     string `json:"bairro"`
+	Cidade     string `json:"cidade"`
+	UF         string `json:"uf"`
+	IBGE       string `json:"ibge"`
+}
+
+// CepProvider looks up a CEP, given as 8 digits, on one upstream. Search
+// finds the CEPs of a street; providers without it return ErrSearchUnsupported.
+type CepProvider interface {
+	Name() string
+	Lookup(ctx context.Context, cep string) (*CepAddress, error)
+	Search(ctx context.Context, uf, city, street string) ([]CepAddress, error)
+}
+
+// CepProviderConfig overrides the URLs or timeout of a provider. Url is a
+// format string receiving the CEP digits and SearchUrl one receiving the
+// UF, city and street, which lets local stand-ins replace the public APIs.
+type CepProviderConfig struct {
+	Name      string        `yaml:"name"`
+	Url       string        `yaml:"url"`
+	SearchUrl string        `yaml:"searchUrl"`
+	Timeout   time.Duration `yaml:"timeout"`
+}
+
+const (
+	cepStrategyFallback = "fallback"
+	cepStrategyRace     = "race"
+
+	defaultCepProviderTimeout = 1500 * time.Millisecond
+)
+
+// cepProviders maps a provider name to its default URL and decoder.
+var cepProviders = map[string]struct {
+	url          string
+	decode       func(status int, body []byte) (*CepAddress, error)
+	searchUrl    string
+	decodeSearch func(status int, body []byte) ([]CepAddress, error)
+}{
+	"viacep":    {"https://viacep.com.br/ws/%s/json/", decodeViaCEP, "https://viacep.com.br/ws/%s/%s/%s/json/", decodeViaCEPSearch},
+	"brasilapi": {"https://brasilapi.com.br/api/cep/v1/%s", decodeBrasilAPI, "", nil},
+	"opencep":   {"https://opencep.com/v1/%s", decodeOpenCEP, "", nil},
+	"postmon":   {"https://api.postmon.com.br/v1/cep/%s", decodePostmon, "", nil},
+}
+
+// defaultCepProviderOrder is used when no providers are configured.
+var defaultCepProviderOrder = []string{"viacep", "brasilapi", "opencep", "postmon"}
+
+// newCepProviders builds the configured providers, in fallback order.
+func newCepProviders(cfgs []CepProviderConfig) ([]CepProvider, error) {
+	if len(cfgs) == 0 {
+		for _, name := range defaultCepProviderOrder {
+			cfgs = append(cfgs, CepProviderConfig{Name: name})
+		}
+	}
+
+	providers := make([]CepProvider, 0, len(cfgs))
+	for _, c := range cfgs {
+		def, ok := cepProviders[strings.ToLower(c.Name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cep provider %q", c.Name)
+		}
+
+		p := &httpCepProvider{
+			name:         strings.ToLower(c.Name),
+			url:          c.Url,
+			decode:       def.decode,
+			searchUrl:    c.SearchUrl,
+			decodeSearch: def.decodeSearch,
+			client:       &http.Client{Timeout: c.Timeout},
+		}
+		if p.url == "" {
+			p.url = def.url
+		}
+		if p.searchUrl == "" {
+			p.searchUrl = def.searchUrl
+		}
+		if p.client.Timeout <= 0 {
+			p.client.Timeout = defaultCepProviderTimeout
+		}
+		providers = append(providers, p)
+	}
+
+	return providers, nil
+}
+
+// httpCepProvider queries a JSON API at url and normalizes the reply.
+type httpCepProvider struct {
+	name         string
+	url          string
+	decode       func(status int, body []byte) (*CepAddress, error)
+	searchUrl    string
+	decodeSearch func(status int, body []byte) ([]CepAddress, error)
+	client       *http.Client
+}
+
+func (p *httpCepProvider) Name() string {
+	return p.name
+}
+
+func (p *httpCepProvider) Lookup(ctx context.Context, cep string) (*CepAddress, error) {
+	status, body, err := p.get(ctx, fmt.Sprintf(p.url, cep))
+	if err != nil {
+		return nil, err
+	}
+
+	addr, err := p.decode(status, body)
+	if err != nil {
+		return nil, err
+	}
+
+	addr.CEP = cep
+	return addr, nil
+}
+
+func (p *httpCepProvider) Search(ctx context.Context, uf, city, street string) ([]CepAddress, error) {
+	if p.searchUrl == "" || p.decodeSearch == nil {
+		return nil, ErrSearchUnsupported
+	}
+
+	status, body, err := p.get(ctx, fmt.Sprintf(p.searchUrl, url.PathEscape(uf), url.PathEscape(city), url.PathEscape(street)))
+	if err != nil {
+		return nil, err
+	}
+
+	return p.decodeSearch(status, body)
+}
+
+func (p *httpCepProvider) get(ctx context.Context, u string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, body, nil
+}
+
+// lookupCepProviders asks the providers for a CEP. With the fallback
+// strategy they are tried in order; with race they are all asked at once
+// and the first address wins. A CEP is only reported missing when every
+// provider answered that it does not exist; if any of them failed, the
+// answer is an upstream error, so a provider outage is not cached as a
+// missing CEP.
+func lookupCepProviders(ctx context.Context, providers []CepProvider, strategy, cep string) (*CepAddress, string, error) {
+	type result struct {
+		provider string
+		addr     *CepAddress
+		err      error
+	}
+
+	var results []result
+	switch strategy {
+	case cepStrategyRace:
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		ch := make(chan result, len(providers))
+		for _, p := range providers {
+			go func() {
+				addr, err := p.Lookup(ctx, cep)
+				ch <- result{p.Name(), addr, err}
+			}()
+		}
+
+		for range providers {
+			r := <-ch
+			if r.err == nil {
+				return r.addr, r.provider, nil
+			}
+			results = append(results, r)
+		}
+
+	default:
+		for _, p := range providers {
+			addr, err := p.Lookup(ctx, cep)
+			if err == nil {
+				return addr, p.Name(), nil
+			}
+			results = append(results, result{p.Name(), nil, err})
+		}
+	}
+
+	var errs []error
+	for _, r := range results {
+		if !errors.Is(r.err, ErrCEPNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", r.provider, r.err))
+		}
+	}
+
+	if len(errs) == 0 && len(results) > 0 {
+		return nil, "", ErrCEPNotFound
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// decodeStatus maps the HTTP status of a provider reply to an error.
+func decodeStatus(status int) error {
+	switch {
+	case status == http.StatusNotFound:
+		return ErrCEPNotFound
+	case status != http.StatusOK:
+		return fmt.Errorf("unexpected status %d", status)
+	default:
+		return nil
+	}
+}
+
+// decodeViaCEP decodes ViaCEP, which answers 200 {"erro": true} for a CEP
+// that does not exist.
+func decodeViaCEP(status int, body []byte) (*CepAddress, error) {
+	if err := decodeStatus(status); err != nil {
+		return nil, err
+	}
+
+	var v struct {
+		Erro       any    `json:"erro"`
+		Logradouro string `json:"logradouro"`
+		Bairro     string `json:"bairro"`
+		Localidade string `json:"localidade"`
+		UF         string `json:"uf"`
+		IBGE       string `json:"ibge"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	if v.Erro != nil {
+		return nil, ErrCEPNotFound
+	}
+
+	return &CepAddress{Logradouro: v.Logradouro, Bairro: v.Bairro, Cidade: v.Localidade, UF: v.UF, IBGE: v.IBGE}, nil
+}
+
+// decodeViaCEPSearch decodes the street search of ViaCEP, a list of the
+// same objects its lookup returns.
+func decodeViaCEPSearch(status int, body []byte) ([]CepAddress, error) {
+	if err := decodeStatus(status); err != nil {
+		return nil, err
+	}
+
+	var list []struct {
+		CEP        string `json:"cep"`
+		Logradouro string `json:"logradouro"`
+		Bairro     string `json:"bairro"`
+		Localidade string `json:"localidade"`
+		UF         string `json:"uf"`
+		IBGE       string `json:"ibge"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	out := make([]CepAddress, 0, len(list))
+	for _, v := range list {
+		out = append(out, CepAddress{
+			CEP:        normalizeCEP(v.CEP),
+			Logradouro: v.Logradouro,
+			Bairro:     v.Bairro,
+			Cidade:     v.Localidade,
+			UF:         v.UF,
+			IBGE:       v.IBGE,
+		})
+	}
+	return out, nil
+}
+
+func decodeBrasilAPI(status int, body []byte) (*CepAddress, error) {
+	if err := decodeStatus(status); err != nil {
+		return nil, err
+	}
+
+	var v struct {
+		Street       string `json:"street"`
+		Neighborhood string `json:"neighborhood"`
+		City         string `json:"city"`
+		State        string `json:"state"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return &CepAddress{Logradouro: v.Street, Bairro: v.Neighborhood, Cidade: v.City, UF: v.State}, nil
+}
+
+func decodeOpenCEP(status int, body []byte) (*CepAddress, error) {
+	if err := decodeStatus(status); err != nil {
+		return nil, err
+	}
+
+	var v struct {
+		Logradouro string `json:"logradouro"`
+		Bairro     string `json:"bairro"`
+		Localidade string `json:"localidade"`
+		UF         string `json:"uf"`
+		IBGE       string `json:"ibge"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return &CepAddress{Logradouro: v.Logradouro, Bairro: v.Bairro, Cidade: v.Localidade, UF: v.UF, IBGE: v.IBGE}, nil
+}
+
+func decodePostmon(status int, body []byte) (*CepAddress, error) {
+	if err := decodeStatus(status); err != nil {
+		return nil, err
+	}
+
+	var v struct {
+		Logradouro string `json:"logradouro"`
+		Bairro     string `json:"bairro"`
+		Cidade     string `json:"cidade"`
+		Estado     string `json:"estado"`
+		CidadeInfo struct {
+			CodigoIBGE string `json:"codigo_ibge"`
+		} `json:"cidade_info"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, fmt.Errorf("error decoding response: %w", err)
+	}
+
+	return &CepAddress{Logradouro: v.Logradouro, Bairro: v.Bairro, Cidade: v.Cidade, UF: v.Estado, IBGE: v.CidadeInfo.CodigoIBGE}, nil
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cepServer serves body with status for every request, after delay.
+func cepServer(t *testing.T, status int, body string, delay time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testProviders(t *testing.T, cfgs ...CepProviderConfig) []CepProvider {
+	t.Helper()
+	providers, err := newCepProviders(cfgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return providers
+}
+
+const (
+	viaCEPBody    = `{"cep":"01001-000","logradouro":"Praça da Sé","bairro":"Sé","localidade":"São Paulo","uf":"SP","ibge":"3550308"}`
+	brasilAPIBody = `{"cep":"01001000","street":"Praça da Sé","neighborhood":"Sé","city":"São Paulo","state":"SP"}`
+	openCEPBody   = `{"cep":"01001-000","logradouro":"Praça da Sé","bairro":"Sé","localidade":"São Paulo","uf":"SP","ibge":"3550308"}`
+	postmonBody   = `{"cep":"01001000","logradouro":"Praça da Sé","bairro":"Sé","cidade":"São Paulo","estado":"SP","cidade_info":{"codigo_ibge":"3550308"}}`
+)
+
+func TestCepProviderDecoders(t *testing.T) {
+	want := CepAddress{CEP: "01001000", Logradouro: "Praça da Sé", Bairro: "Sé", Cidade: "São Paulo", UF: "SP", IBGE: "3550308"}
+
+	tests := []struct {
+		provider string
+		status   int
+		body     string
+		want     *CepAddress
+		err      error
+	}{
+		{"viacep", http.StatusOK, viaCEPBody, &want, nil},
+		{"viacep", http.StatusOK, `{"erro": true}`, nil, ErrCEPNotFound},
+		{"viacep", http.StatusOK, `{"erro": "true"}`, nil, ErrCEPNotFound},
+		{"brasilapi", http.StatusOK, brasilAPIBody, &CepAddress{CEP: "01001000", Logradouro: "Praça da Sé", Bairro: "Sé", Cidade: "São Paulo", UF: "SP"}, nil},
+		{"brasilapi", http.StatusNotFound, `{"message":"not found"}`, nil, ErrCEPNotFound},
+		{"opencep", http.StatusOK, openCEPBody, &want, nil},
+		{"opencep", http.StatusNotFound, ``, nil, ErrCEPNotFound},
+		{"postmon", http.StatusOK, postmonBody, &want, nil},
+		{"postmon", http.StatusNotFound, ``, nil, ErrCEPNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			srv := cepServer(t, tt.status, tt.body, 0)
+			p := testProviders(t, CepProviderConfig{Name: tt.provider, Url: srv.URL + "/%s"})[0]
+
+			got, err := p.Lookup(context.Background(), "01001000")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.want != nil && *got != *tt.want {
+				t.Fatalf("got %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestCepProviderDecodeErrors(t *testing.T) {
+	for _, name := range defaultCepProviderOrder {
+		t.Run(name, func(t *testing.T) {
+			for _, tt := range []struct {
+				status int
+				body   string
+			}{
+				{http.StatusInternalServerError, `{}`},
+				{http.StatusOK, `not json`},
+			} {
+				srv := cepServer(t, tt.status, tt.body, 0)
+				p := testProviders(t, CepProviderConfig{Name: name, Url: srv.URL + "/%s"})[0]
+
+				_, err := p.Lookup(context.Background(), "01001000")
+				if err == nil || errors.Is(err, ErrCEPNotFound) {
+					t.Fatalf("status %d %q: err = %v, want an upstream error", tt.status, tt.body, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCepProviderSearch(t *testing.T) {
+	srv := cepServer(t, http.StatusOK, `[`+viaCEPBody+`]`, 0)
+	providers := testProviders(t,
+		CepProviderConfig{Name: "viacep", SearchUrl: srv.URL + "/%s/%s/%s"},
+		CepProviderConfig{Name: "brasilapi"},
+	)
+
+	got, err := providers[0].Search(context.Background(), "SP", "São Paulo", "Sé")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].CEP != "01001000" || got[0].Cidade != "São Paulo" {
+		t.Fatalf("got %+v", got)
+	}
+
+	if _, err := providers[1].Search(context.Background(), "SP", "São Paulo", "Sé"); !errors.Is(err, ErrSearchUnsupported) {
+		t.Fatalf("err = %v, want ErrSearchUnsupported", err)
+	}
+}
+
+func TestNewCepProvidersUnknown(t *testing.T) {
+	if _, err := newCepProviders([]CepProviderConfig{{Name: "nope"}}); err == nil {
+		t.Fatal("expected an error for an unknown provider")
+	}
+}
+
+func TestLookupCepProvidersFallback(t *testing.T) {
+	failing := cepServer(t, http.StatusInternalServerError, `{}`, 0)
+	ok := cepServer(t, http.StatusOK, openCEPBody, 0)
+	unused := cepServer(t, http.StatusOK, postmonBody, 0)
+
+	providers := testProviders(t,
+		CepProviderConfig{Name: "viacep", Url: failing.URL + "/%s"},
+		CepProviderConfig{Name: "opencep", Url: ok.URL + "/%s"},
+		CepProviderConfig{Name: "postmon", Url: unused.URL + "/%s"},
+	)
+
+	addr, provider, err := lookupCepProviders(context.Background(), providers, cepStrategyFallback, "01001000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "opencep" || addr.Cidade != "São Paulo" {
+		t.Fatalf("got %s %+v, want opencep", provider, addr)
+	}
+}
+
+func TestLookupCepProvidersRace(t *testing.T) {
+	slow := cepServer(t, http.StatusOK, viaCEPBody, time.Second)
+	fast := cepServer(t, http.StatusOK, postmonBody, 0)
+
+	providers := testProviders(t,
+		CepProviderConfig{Name: "viacep", Url: slow.URL + "/%s", Timeout: 5 * time.Second},
+		CepProviderConfig{Name: "postmon", Url: fast.URL + "/%s"},
+	)
+
+	started := time.Now()
+	_, provider, err := lookupCepProviders(context.Background(), providers, cepStrategyRace, "01001000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "postmon" {
+		t.Fatalf("provider = %s, want postmon", provider)
+	}
+	if d := time.Since(started); d >= time.Second {
+		t.Fatalf("race waited for the slow provider: %s", d)
+	}
+
+	// with fallback the slow provider is asked first and answers
+	_, provider, err = lookupCepProviders(context.Background(), providers, cepStrategyFallback, "01001000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "viacep" {
+		t.Fatalf("provider = %s, want viacep", provider)
+	}
+}
+
+func TestLookupCepProvidersTimeout(t *testing.T) {
+	hanging := cepServer(t, http.StatusOK, viaCEPBody, 2*time.Second)
+	ok := cepServer(t, http.StatusOK, openCEPBody, 0)
+
+	providers := testProviders(t,
+		CepProviderConfig{Name: "viacep", Url: hanging.URL + "/%s", Timeout: 50 * time.Millisecond},
+		CepProviderConfig{Name: "opencep", Url: ok.URL + "/%s"},
+	)
+
+	started := time.Now()
+	_, provider, err := lookupCepProviders(context.Background(), providers, cepStrategyFallback, "01001000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider != "opencep" {
+		t.Fatalf("provider = %s, want opencep", provider)
+	}
+	if d := time.Since(started); d >= time.Second {
+		t.Fatalf("provider timeout not applied: %s", d)
+	}
+}
+
+func TestLookupCepProvidersNotFound(t *testing.T) {
+	notFound := cepServer(t, http.StatusNotFound, ``, 0)
+	viaNotFound := cepServer(t, http.StatusOK, `{"erro": true}`, 0)
+	failing := cepServer(t, http.StatusBadGateway, ``, 0)
+	hanging := cepServer(t, http.StatusOK, postmonBody, 2*time.Second)
+
+	tests := []struct {
+		name      string
+		cfgs      []CepProviderConfig
+		cacheable bool
+	}{
+		{
+			name: "all not found",
+			cfgs: []CepProviderConfig{
+				{Name: "viacep", Url: viaNotFound.URL + "/%s"},
+				{Name: "brasilapi", Url: notFound.URL + "/%s"},
+			},
+			cacheable: true,
+		},
+		{
+			name: "not found and failure",
+			cfgs: []CepProviderConfig{
+				{Name: "brasilapi", Url: notFound.URL + "/%s"},
+				{Name: "opencep", Url: failing.URL + "/%s"},
+			},
+		},
+		{
+			name: "not found and timeout",
+			cfgs: []CepProviderConfig{
+				{Name: "brasilapi", Url: notFound.URL + "/%s"},
+				{Name: "postmon", Url: hanging.URL + "/%s", Timeout: 50 * time.Millisecond},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, strategy := range []string{cepStrategyFallback, cepStrategyRace} {
+			t.Run(tt.name+"/"+strategy, func(t *testing.T) {
+				_, _, err := lookupCepProviders(context.Background(), testProviders(t, tt.cfgs...), strategy, "99999999")
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if got := errors.Is(err, ErrCEPNotFound); got != tt.cacheable {
+					t.Fatalf("err = %v, not found = %v, want %v", err, got, tt.cacheable)
+				}
+			})
+		}
+	}
+}
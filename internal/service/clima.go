@@ -1,13 +1,136 @@
 package service
 
-import "github.com/spf13/cobra"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+)
+
+// ClimaRequest is the body accepted by service.clima. Exactly one way of
+// locating the place is used: coordinates, a CEP or a city name.
+type ClimaRequest struct {
+	City      string   `json:"city,omitempty"`
+	State     string   `json:"state,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	CEP       string   `json:"cep,omitempty" pattern:"^[0-9]{5}-?[0-9]{3}$"`
+}
+
+// ClimaResponse is the normalized answer of service.clima.
+type ClimaResponse struct {
+	Provider string     `json:"provider"`
+	Location Location   `json:"location"`
+	Current  Conditions `json:"current"`
+}
 
 func Clima(cmd *cobra.Command, _ []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	_, err := serviceCommon(cmd.Context(), configStr)
+	cfg, err := serviceCommon(cmd)
+	if err != nil {
+		return err
+	}
+
+	return runClima(cfg)
+}
+
+func runClima(cfg *ConfigService) error {
+	provider, err := newWeatherProvider(cfg.Clima)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	w := NewWorker("clima", "service.clima", lookupClima(cfg.nc, provider, cfg.Clima.Country))
+	svc := NewService("clima", "Current weather conditions", WithMetadata(map[string]string{
+		"provider": provider.Name(),
+	})).Add(w)
+	if err := svc.Start(cfg.ctx, cfg.nc); err != nil {
+		return err
+	}
+
+	routes := []AnnouncedRoute{
+		w.Route(http.MethodPost, "/lookup/clima", "5s"),
+	}
+	if err := cfg.announceRoutes("clima", routes); err != nil {
+		return err
+	}
+
+	log.Printf("Clima service listening (provider %s)", provider.Name())
+	return cfg.waitForShutdown("clima", svc.Stop, cfg.drain)
+}
+
+func lookupClima(nc *nats.Conn, provider WeatherProvider, country string) HandlerFunc[ClimaRequest, *ClimaResponse] {
+	if country == "" {
+		country = "BR"
+	}
+
+	return func(ctx context.Context, req *Request[ClimaRequest]) (*ClimaResponse, error) {
+		loc, err := resolveLocation(ctx, nc, provider, country, req.Body)
+		if err != nil {
+			var svcErr *ServiceError
+			switch {
+			case errors.As(err, &svcErr):
+				return nil, err
+			case errors.Is(err, ErrLocationNotFound):
+				return nil, errNotFound("location not found")
+			default:
+				log.Printf("[clima] error resolving location: %v", err)
+				return nil, errUnavailable("service unavailable")
+			}
+		}
+
+		current, err := provider.Current(ctx, loc)
+		if err != nil {
+			log.Printf("[clima] error querying %s: %v", provider.Name(), err)
+			return nil, errUnavailable("service unavailable")
+		}
+
+		return &ClimaResponse{Provider: provider.Name(), Location: loc, Current: current}, nil
+	}
+}
+
+// resolveLocation turns the request into coordinates, asking service.cep
+// for the city and state of a CEP and the provider for the coordinates of
+// the city with that name in the state.
+func resolveLocation(ctx context.Context, nc *nats.Conn, provider WeatherProvider, country string, body ClimaRequest) (Location, error) {
+	switch {
+	case body.Latitude != nil || body.Longitude != nil:
+		if body.Latitude == nil || body.Longitude == nil {
+			return Location{}, errBadRequest("latitude and longitude must be given together")
+		}
+		lat, lon := *body.Latitude, *body.Longitude
+		if lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+			return Location{}, errBadRequest("coordinates out of range")
+		}
+		return Location{
+			Name:      body.City,
+			Latitude:  lat,
+			Longitude: lon,
+		}, nil
+
+	case body.CEP != "":
+		var addr CepAddress
+		status, err := callService(ctx, nc, "service.cep", CepRequest{CEP: body.CEP}, &addr)
+		switch {
+		case err != nil:
+			return Location{}, err
+		case status == http.StatusNotFound || status == http.StatusBadRequest:
+			return Location{}, errNotFound("cep %s not found", body.CEP)
+		case status != http.StatusOK:
+			return Location{}, fmt.Errorf("service.cep replied %d", status)
+		case addr.Cidade == "":
+			return Location{}, errNotFound("cep %s not found", body.CEP)
+		}
+		return provider.Geocode(ctx, addr.Cidade, addr.UF, country)
+
+	case strings.TrimSpace(body.City) != "":
+		return provider.Geocode(ctx, strings.TrimSpace(body.City), strings.TrimSpace(body.State), country)
+
+	default:
+		return Location{}, errBadRequest("one of city, cep or latitude and longitude is required")
+	}
 }
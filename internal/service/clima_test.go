@@ -0,0 +1,193 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// testNats connects to an embedded server that only accepts in process
+// connections.
+func testNats(t *testing.T) *nats.Conn {
+	t.Helper()
+	ns, err := startEmbeddedNats(EmbeddedNats{Port: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// startTestService serves the endpoints until the test ends.
+func startTestService(t *testing.T, nc *nats.Conn, eps ...endpoint) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := NewService("test", "test service").Add(eps...)
+	if err := svc.Start(ctx, nc); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = svc.Stop(context.Background())
+		cancel()
+	})
+}
+
+// openMeteoServer stands in for the Open-Meteo geocoding and forecast APIs,
+// knowing three cities named Bonito.
+func openMeteoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("count") != "10" {
+			t.Errorf("geocoding count = %q, want 10", r.URL.Query().Get("count"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("name") != "Bonito" {
+			_, _ = w.Write([]byte(`{}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"results":[
+			{"name":"Bonito","admin1":"Pernambuco","country_code":"BR","latitude":-8.47,"longitude":-35.73},
+			{"name":"Bonito","admin1":"Mato Grosso do Sul","country_code":"BR","latitude":-21.12,"longitude":-56.48},
+			{"name":"Bonito","admin1":"Pará","country_code":"BR","latitude":-1.36,"longitude":-47.31}
+		]}`))
+	})
+	mux.HandleFunc("/forecast", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"current":{"time":1760000000,"temperature_2m":27.5,"apparent_temperature":29.1,
+			"relative_humidity_2m":61,"precipitation":0.2,"wind_speed_10m":11.3,"wind_direction_10m":140,
+			"weather_code":61,"is_day":1}}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func testOpenMeteo(t *testing.T) WeatherProvider {
+	t.Helper()
+	srv := openMeteoServer(t)
+	p, err := newWeatherProvider(ClimaConfig{
+		Provider:     providerOpenMeteo,
+		BaseUrl:      srv.URL + "/forecast",
+		GeocodingUrl: srv.URL + "/search",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestOpenMeteoGeocode(t *testing.T) {
+	p := testOpenMeteo(t)
+
+	tests := []struct {
+		city, state string
+		want        string
+		err         error
+	}{
+		{"Bonito", "", "Pernambuco", nil},
+		{"Bonito", "MS", "Mato Grosso do Sul", nil},
+		{"Bonito", "ms", "Mato Grosso do Sul", nil},
+		{"Bonito", "mato grosso do sul", "Mato Grosso do Sul", nil},
+		{"Bonito", "PA", "Pará", nil},
+		{"Bonito", "Para", "Pará", nil},
+		{"Bonito", "SP", "", ErrLocationNotFound},
+		{"Nowhere", "", "", ErrLocationNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.city+"/"+tt.state, func(t *testing.T) {
+			loc, err := p.Geocode(context.Background(), tt.city, tt.state, "BR")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if loc.State != tt.want {
+				t.Fatalf("state = %q, want %q", loc.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenMeteoCurrent(t *testing.T) {
+	p := testOpenMeteo(t)
+
+	got, err := p.Current(context.Background(), Location{Latitude: -21.12, Longitude: -56.48})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Conditions{
+		Temperature:         27.5,
+		ApparentTemperature: 29.1,
+		Humidity:            61,
+		Precipitation:       0.2,
+		WindSpeed:           11.3,
+		WindDirection:       140,
+		WeatherCode:         61,
+		Description:         "chuva fraca",
+		IsDay:               true,
+		ObservedAt:          time.Unix(1760000000, 0).UTC(),
+	}
+	if got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLookupClima(t *testing.T) {
+	nc := testNats(t)
+
+	// service.cep stand-in knowing a single CEP of Bonito, MS
+	cep := NewWorker("cep", "service.cep", func(_ context.Context, req *Request[CepRequest]) (*CepAddress, error) {
+		if normalizeCEP(req.Body.CEP) != "79290000" {
+			return nil, errNotFound("cep %s not found", req.Body.CEP)
+		}
+		return &CepAddress{CEP: "79290000", Cidade: "Bonito", UF: "MS"}, nil
+	})
+	clima := NewWorker("clima", "service.clima", lookupClima(nc, testOpenMeteo(t), "BR"))
+	startTestService(t, nc, cep, clima)
+
+	tests := []struct {
+		name   string
+		req    ClimaRequest
+		status int
+		state  string
+	}{
+		{"cep", ClimaRequest{CEP: "79290-000"}, http.StatusOK, "Mato Grosso do Sul"},
+		{"unknown cep", ClimaRequest{CEP: "01001-000"}, http.StatusNotFound, ""},
+		{"city", ClimaRequest{City: "Bonito"}, http.StatusOK, "Pernambuco"},
+		{"city and state", ClimaRequest{City: "Bonito", State: "PA"}, http.StatusOK, "Pará"},
+		{"city not in state", ClimaRequest{City: "Bonito", State: "SP"}, http.StatusNotFound, ""},
+		{"nothing", ClimaRequest{}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ClimaResponse
+			status, err := callService(context.Background(), nc, "service.clima", tt.req, &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			if resp.Location.State != tt.state || resp.Current.Description != "chuva fraca" {
+				t.Fatalf("got %+v", resp)
+			}
+		})
+	}
+}
@@ -2,32 +2,114 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/inovacc/config"
+	"github.com/nats-io/nats-server/v2/server"
 	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
 )
 
+// defaultGracePeriod bounds shutdown when gracePeriod is not configured.
+const defaultGracePeriod = 10 * time.Second
+
 type ConfigService struct {
-	nc          *nats.Conn
-	ctx         context.Context
-	cancel      context.CancelFunc
-	BaseConfig  *config.Config `yaml:"-"`
-	OpenApiPath string         `yaml:"openapiPath"`
-	Port        int            `yaml:"port"`
-	Nats        NatsConfig     `yaml:"nats"`
-	Database    Database       `yaml:"database"`
+	nc           *nats.Conn
+	natsServer   *server.Server
+	ownsServer   bool
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closed       chan struct{}
+	GracePeriod  time.Duration  `yaml:"gracePeriod"`
+	BaseConfig   *config.Config `yaml:"-"`
+	OpenApiPath  string         `yaml:"openapiPath"`
+	OpenApiWatch bool           `yaml:"openapiWatch"`
+	OpenApiKV    OpenApiKV      `yaml:"openapiKV"`
+	// AnnounceToken is shared by the gateway and the workers announcing
+	// routes to it, read from "env:NAME" or "file:PATH" like other secrets.
+	AnnounceToken string        `yaml:"announceToken"`
+	Port          int           `yaml:"port"`
+	Nats          NatsConfig    `yaml:"nats"`
+	Database      Database      `yaml:"database"`
+	Clima         ClimaConfig   `yaml:"clima"`
+	Monitor       MonitorConfig `yaml:"monitor"`
+	Cep           CepConfig     `yaml:"cep"`
+	Privacy       PrivacyConfig `yaml:"privacy"`
 }
 
 func (c *ConfigService) Close() error {
 	c.cancel()
 	c.nc.Close()
+	c.shutdownEmbedded()
 	return nil
 }
 
+// shutdownFunc releases a resource, giving up when ctx expires.
+type shutdownFunc func(ctx context.Context) error
+
+// waitForShutdown blocks until the command context is cancelled (SIGINT or
+// SIGTERM) and then runs fns in order, all bounded by the grace period.
+func (c *ConfigService) waitForShutdown(name string, fns ...shutdownFunc) error {
+	<-c.ctx.Done()
+
+	grace := c.GracePeriod
+	if grace <= 0 {
+		grace = defaultGracePeriod
+	}
+	log.Printf("[%s] shutting down, grace period %s", name, grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	var errs []error
+	for _, fn := range fns {
+		if err := fn(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c.shutdownEmbedded()
+
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("[%s] shutdown finished with errors: %v", name, err)
+		return err
+	}
+
+	log.Printf("[%s] shutdown complete", name)
+	return nil
+}
+
+// drain stops receiving on every subscription, lets in-flight handlers
+// finish, flushes pending publishes and closes the NATS connection.
+func (c *ConfigService) drain(ctx context.Context) error {
+	if err := c.nc.Drain(); err != nil {
+		if errors.Is(err, nats.ErrConnectionClosed) {
+			return nil
+		}
+		return fmt.Errorf("failed to drain NATS connection: %w", err)
+	}
+
+	select {
+	case <-c.closed:
+		return nil
+	case <-ctx.Done():
+		c.nc.Close()
+		return fmt.Errorf("failed to drain NATS connection: %w", ctx.Err())
+	}
+}
+
+// OpenApiKV points at a NATS KV entry holding the spec, watched for updates.
+type OpenApiKV struct {
+	Bucket string `yaml:"bucket"`
+	Key    string `yaml:"key"`
+}
+
 type Database struct {
-	DBPath string `yaml:"db_path"`
+	DBPath     string           `yaml:"db_path" mapstructure:"db_path"`
+	Encryption EncryptionConfig `yaml:"encryption"`
 }
 
 type NatsConfig struct {
@@ -35,9 +117,13 @@ type NatsConfig struct {
 	Name          string        `yaml:"name"`
 	ReconnectWait time.Duration `yaml:"reconnectWait"`
 	MaxReconnects int           `yaml:"maxReconnects"`
+	Embedded      EmbeddedNats  `yaml:"embedded"`
 }
 
-func serviceCommon(ctx context.Context, configPath string) (*ConfigService, error) {
+// loadConfig reads the service configuration without connecting to NATS,
+// for commands that only need the database.
+func loadConfig(cmd *cobra.Command) (*ConfigService, error) {
+	configPath := cmd.Flag("config").Value.String()
 	if err := config.InitServiceConfig(&ConfigService{}, configPath); err != nil {
 		return nil, fmt.Errorf("failed to load config: %v", err)
 	}
@@ -48,24 +134,83 @@ func serviceCommon(ctx context.Context, configPath string) (*ConfigService, erro
 	}
 
 	cfg.BaseConfig = config.GetBaseConfig()
+	return cfg, nil
+}
 
-	if cfg.Nats.Url == "" {
+func serviceCommon(cmd *cobra.Command) (*ConfigService, error) {
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if f := cmd.Flag("embedded-nats"); f != nil && f.Changed {
+		cfg.Nats.Embedded.Enabled = f.Value.String() == "true"
+	}
+
+	if cfg.Nats.Embedded.Enabled {
+		cfg.natsServer, err = startEmbeddedNats(cfg.Nats.Embedded)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ownsServer = true
+	} else if cfg.Nats.Url == "" {
 		return nil, fmt.Errorf("nats url is required")
 	}
 
-	cfg.nc, err = nats.Connect(
-		cfg.Nats.Url,
-		nats.Name(cfg.Nats.Name),
-		nats.MaxReconnects(cfg.Nats.MaxReconnects),
-		nats.ReconnectWait(cfg.Nats.ReconnectWait*time.Second),
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	if err := cfg.connect(cfg.Nats.Name); err != nil {
+		cfg.shutdownEmbedded()
+		return nil, err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx := cmd.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	cfg.ctx = ctx
 	cfg.cancel = cancel
 
 	return cfg, nil
 }
+
+// connect opens the NATS connection of the service, in process when the
+// server is embedded.
+func (c *ConfigService) connect(name string) error {
+	closed := make(chan struct{})
+	c.closed = closed
+
+	url := c.Nats.Url
+	opts := []nats.Option{
+		nats.Name(name),
+		nats.MaxReconnects(c.Nats.MaxReconnects),
+		nats.ReconnectWait(c.Nats.ReconnectWait * time.Second),
+		nats.ClosedHandler(func(*nats.Conn) { close(closed) }),
+	}
+
+	if c.natsServer != nil {
+		url = c.natsServer.ClientURL()
+		opts = append(opts, nats.InProcessServer(c.natsServer))
+	}
+
+	nc, err := nats.Connect(url, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	c.nc = nc
+	return nil
+}
+
+// fork returns a copy of the config with its own NATS connection and a
+// child context, so services sharing a process shut down independently.
+func (c *ConfigService) fork(name string) (*ConfigService, error) {
+	f := *c
+	f.ownsServer = false
+
+	if err := f.connect(fmt.Sprintf("%s-%s", c.Nats.Name, name)); err != nil {
+		return nil, err
+	}
+
+	f.ctx, f.cancel = context.WithCancel(c.ctx)
+	return &f, nil
+}
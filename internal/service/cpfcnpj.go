@@ -1,15 +1,16 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/nats-io/nats.go"
 	"github.com/spf13/cobra"
 )
 
@@ -31,6 +32,30 @@ type (
 	}
 )
 
+// Document types reported by service.cpfcnpj.
+const (
+	docCPF  = "cpf"
+	docCNPJ = "cnpj"
+)
+
+// CpfCnpjRequest is the body accepted by service.cpfcnpj. CNPJs may use
+// the alphanumeric format, so letters are accepted too.
+type CpfCnpjRequest struct {
+	CpfCnpj string `json:"cpfcnpj" pattern:"^[0-9A-Za-z./-]{11,18}$"`
+}
+
+// CpfCnpjResponse is the validation result returned by service.cpfcnpj.
+// Origin is the fiscal region of a CPF; Branch is the order number of a
+// CNPJ, 0001 being the headquarters.
+type CpfCnpjResponse struct {
+	Document     string `json:"document"`
+	Type         string `json:"type"`
+	IsValid      bool   `json:"is_valid"`
+	Origin       string `json:"origin,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+	Alphanumeric bool   `json:"alphanumeric,omitempty"`
+}
+
 func init() {
 	notAccepted = make([]string, 0)
 	for i := 0; i < 10; i++ {
@@ -40,72 +65,299 @@ func init() {
 }
 
 func CpfCnpj(cmd *cobra.Command, _ []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	cfg, err := serviceCommon(cmd.Context(), configStr)
+	cfg, err := serviceCommon(cmd)
 	if err != nil {
 		return err
 	}
 
-	_, err = cfg.nc.QueueSubscribe("service.cpfcnpj", "cpfcnpj-workers", cpfcnpjWorkers)
-	if err != nil {
-		log.Printf("[cpfcnpj] error subscribing to service.cpfcnpj: %v", err)
+	return runCpfCnpj(cfg)
+}
+
+func runCpfCnpj(cfg *ConfigService) error {
+	w := NewWorker("cpfcnpj", "service.cpfcnpj", validateCpfCnpj)
+	gen := NewWorker("cpfcnpj-generate", "service.cpfcnpj.generate", generateDocuments)
+	batch := NewWorker("cpfcnpj-batch", "service.cpfcnpj.batch", validateBatch)
+	docs, docRoutes := documentWorkers()
+	svc := NewService("cpfcnpj", "CPF, CNPJ and other document validation").Add(w, gen, batch).Add(docs...)
+	if err := svc.Start(cfg.ctx, cfg.nc); err != nil {
+		return err
+	}
+
+	batchRoute := batch.Route(http.MethodPost, "/batch/cpfcnpj", "10s")
+	batchRoute.Batch = batchChunkSize
+
+	routes := []AnnouncedRoute{
+		w.Route(http.MethodPost, "/lookup/cpfcnpj", "2s"),
+		gen.Route(http.MethodPost, "/generate/cpfcnpj", "2s"),
+		batchRoute,
+	}
+	routes = append(routes, docRoutes...)
+	if err := cfg.announceRoutes("cpfcnpj", routes); err != nil {
 		return err
 	}
 
 	log.Println("CPFCNPJ proxy service listening")
-	select {}
+	return cfg.waitForShutdown("cpfcnpj", svc.Stop, cfg.drain)
+}
+
+// GenerateRequest is the body accepted by service.cpfcnpj.generate.
+// Valid and Masked default to true; Region only applies to CPFs and
+// Alphanumeric only to CNPJs. The same Seed always yields the same
+// documents.
+type GenerateRequest struct {
+	Type         string `json:"type" pattern:"^(cpf|cnpj)$"`
+	Count        int    `json:"count,omitempty"`
+	Valid        *bool  `json:"valid,omitempty"`
+	Masked       *bool  `json:"masked,omitempty"`
+	Region       *int   `json:"region,omitempty"`
+	Alphanumeric bool   `json:"alphanumeric,omitempty"`
+	Seed         *int64 `json:"seed,omitempty"`
+}
+
+// GenerateResponse lists the generated documents and the seed that
+// reproduces them.
+type GenerateResponse struct {
+	Type      string   `json:"type"`
+	Seed      int64    `json:"seed"`
+	Documents []string `json:"documents"`
 }
 
-func cpfcnpjWorkers(m *nats.Msg) {
-	log.Printf("[cpfcnpj] headers=%v data=%s", m.Header, string(m.Data))
+// maxGenerateCount bounds the documents generated by one request.
+const maxGenerateCount = 1000
 
-	obj := &CPF{}
+func generateDocuments(_ context.Context, req *Request[GenerateRequest]) (*GenerateResponse, error) {
+	body := req.Body
 
-	if _, ok := m.Header["schema"]; ok {
-		schema := map[string]string{"cpfcnpj": "string"}
-		b, _ := json.Marshal(schema)
-		_ = m.RespondMsg(&nats.Msg{Data: b, Header: nats.Header{"schema": {string(b)}}})
-		return
+	count := body.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 || count > maxGenerateCount {
+		return nil, errBadRequest("count must be between 1 and %d", maxGenerateCount)
 	}
 
-	var req map[string]string
-	if err := json.Unmarshal(m.Data, &req); err != nil {
-		_ = m.Respond([]byte(`{"error":"bad request"}`))
-		return
+	region := -1
+	if body.Region != nil {
+		if body.Type != docCPF || *body.Region < 0 || *body.Region > 9 {
+			return nil, errBadRequest("region is a digit from 0 to 9 and only applies to cpf")
+		}
+		region = *body.Region
+	}
+	if body.Alphanumeric && body.Type != docCNPJ {
+		return nil, errBadRequest("alphanumeric only applies to cnpj")
 	}
 
-	cepQ := req["cpfcnpj"]
-	if cepQ == "" {
-		_ = m.Respond([]byte(`{"error":"missing cpfcnpj"}`))
-		return
+	seed := time.Now().UnixNano()
+	if body.Seed != nil {
+		seed = *body.Seed
 	}
+	rng := rand.New(rand.NewSource(seed))
+
+	resp := &GenerateResponse{Type: body.Type, Seed: seed, Documents: make([]string, 0, count)}
+	for range count {
+		var doc string
+		switch body.Type {
+		case docCPF:
+			doc = (&CPF{}).generate(rng, region)
+		case docCNPJ:
+			doc = (&CNPJ{}).generate(rng, body.Alphanumeric)
+		default:
+			return nil, errBadRequest("type must be cpf or cnpj")
+		}
+
+		if body.Valid != nil && !*body.Valid {
+			doc = corruptCheckDigit(rng, doc)
+		}
+		if body.Masked != nil && !*body.Masked {
+			doc = unmask(doc)
+		}
+		resp.Documents = append(resp.Documents, doc)
+	}
+
+	return resp, nil
+}
+
+// corruptCheckDigit replaces the last check digit of a masked document
+// with a different digit, making the document invalid.
+func corruptCheckDigit(rng *rand.Rand, doc string) string {
+	last := int(doc[len(doc)-1] - '0')
+	return doc[:len(doc)-1] + strconv.Itoa((last+1+rng.Intn(9))%10)
+}
+
+// unmask keeps only the digits and letters of a document.
+func unmask(doc string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') {
+			return r
+		}
+		return -1
+	}, doc)
+}
 
-	if !obj.Validate(cepQ) {
-		_ = m.Respond([]byte(`{"error":"document invalid"}`))
+func validateCpfCnpj(_ context.Context, req *Request[CpfCnpjRequest]) (*CpfCnpjResponse, error) {
+	doc := req.Body.CpfCnpj
+	if doc == "" {
+		return nil, errBadRequest("missing cpfcnpj")
 	}
 
-	data, _ := json.Marshal(struct {
-		Document string `json:"document"`
-		IsValid  bool   `json:"is_valid"`
-		Origin   string `json:"origin"`
-	}{
-		Document: obj.Format(cepQ),
-		IsValid:  obj.Validate(cepQ),
-		Origin:   obj.CheckOrigin(cepQ),
+	resp := checkDocument(doc)
+	if !resp.IsValid {
+		return nil, errUnprocessable("document invalid")
+	}
+	return resp, nil
+}
+
+// checkDocument validates a CPF or CNPJ. An invalid document is returned
+// as given, with the type it looks like, if any.
+func checkDocument(doc string) *CpfCnpjResponse {
+	switch detectDocument(doc) {
+	case docCPF:
+		obj := &CPF{}
+		if !obj.Validate(doc) {
+			return &CpfCnpjResponse{Document: doc, Type: docCPF}
+		}
+
+		return &CpfCnpjResponse{
+			Document: obj.Format(doc),
+			Type:     docCPF,
+			IsValid:  true,
+			Origin:   obj.CheckOrigin(doc),
+		}
+
+	case docCNPJ:
+		obj := &CNPJ{}
+		if !obj.Validate(doc) {
+			return &CpfCnpjResponse{Document: doc, Type: docCNPJ}
+		}
+
+		formatted := obj.Format(doc)
+		return &CpfCnpjResponse{
+			Document:     formatted,
+			Type:         docCNPJ,
+			IsValid:      true,
+			Branch:       formatted[11:15],
+			Alphanumeric: obj.IsAlphanumeric(doc),
+		}
+
+	default:
+		return &CpfCnpjResponse{Document: doc}
+	}
+}
+
+// batchChunkSize is the number of documents the gateway sends per message
+// to service.cpfcnpj.batch.
+const batchChunkSize = 500
+
+// BatchResult is the outcome for one document of a batch. Index is the
+// position of the document in the input.
+type BatchResult struct {
+	Index int `json:"index"`
+	CpfCnpjResponse
+	Error string `json:"error,omitempty"`
+}
+
+// validateBatch validates the documents of service.cpfcnpj.batch in
+// parallel. Items are document strings or CpfCnpjRequest objects; an item
+// that is neither gets an error result instead of failing the batch.
+func validateBatch(_ context.Context, req *Request[BatchRequest[json.RawMessage]]) (*BatchResponse[BatchResult], error) {
+	items := req.Body.Items
+	if len(items) > maxBatchItems {
+		return nil, errBadRequest("at most %d documents per message", maxBatchItems)
+	}
+
+	results := mapParallel(items, func(i int, item json.RawMessage) BatchResult {
+		res := BatchResult{Index: req.Body.Offset + i}
+
+		doc, err := batchDocument(item)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+
+		res.CpfCnpjResponse = *checkDocument(doc)
+		if !res.IsValid {
+			res.Error = "document invalid"
+		}
+		return res
 	})
 
-	_ = m.Respond(data)
+	summary := map[string]int{"total": len(results), "valid": 0, "invalid": 0, docCPF: 0, docCNPJ: 0}
+	for _, res := range results {
+		if res.IsValid {
+			summary["valid"]++
+		} else {
+			summary["invalid"]++
+		}
+		if res.Type != "" {
+			summary[res.Type]++
+		}
+	}
+
+	return &BatchResponse[BatchResult]{Results: results, Summary: summary}, nil
+}
+
+// batchDocument reads a batch item, either "<document>" or {"cpfcnpj": "<document>"}.
+func batchDocument(item json.RawMessage) (string, error) {
+	var doc string
+	if err := json.Unmarshal(item, &doc); err != nil {
+		var body CpfCnpjRequest
+		if err := json.Unmarshal(item, &body); err != nil {
+			return "", fmt.Errorf("item must be a string or an object with cpfcnpj")
+		}
+		doc = body.CpfCnpj
+	}
+
+	if doc == "" {
+		return "", fmt.Errorf("missing cpfcnpj")
+	}
+	return doc, nil
+}
+
+// detectDocument tells a CPF, 11 digits, from a CNPJ, 14 characters of
+// which the first 12 may be letters, ignoring the mask.
+func detectDocument(doc string) string {
+	var digits, letters int
+	for _, r := range strings.ToUpper(doc) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r >= 'A' && r <= 'Z':
+			letters++
+		}
+	}
+
+	switch {
+	case letters == 0 && digits == 11:
+		return docCPF
+	case digits+letters == 14:
+		return docCNPJ
+	default:
+		return ""
+	}
 }
 
 func (c *CPF) Generate() string {
-	rand.Seed(time.Now().UnixNano())
-	number := make([]int, 9)
-	for i := 0; i < 9; i++ {
-		number[i] = rand.Intn(10)
+	return c.generate(rand.New(rand.NewSource(time.Now().UnixNano())), -1)
+}
+
+// generate returns a valid CPF drawn from rng; region, when 0 to 9, is the
+// fiscal region digit reported by CheckOrigin.
+func (c *CPF) generate(rng *rand.Rand, region int) string {
+	for {
+		number := make([]int, 9)
+		for i := 0; i < 9; i++ {
+			number[i] = rng.Intn(10)
+		}
+		if region >= 0 && region <= 9 {
+			number[8] = region
+		}
+		number = append(number, c.calculateFirstDigit(number))
+		number = append(number, c.calculateSecondDigit(number))
+
+		if cpf := c.maskCPF(number); c.isAccepted(unmask(cpf)) {
+			return cpf
+		}
 	}
-	number = append(number, c.calculateFirstDigit(number))
-	number = append(number, c.calculateSecondDigit(number))
-	return c.maskCPF(number)
 }
 
 func (c *CPF) maskCPF(values []int) string {
@@ -161,8 +413,10 @@ func (c *CPF) Validate(values string) bool {
 	return c.isAccepted(values) && c.length(c.cpfNumber) && c.validate(c.cpfNumber)
 }
 
+// isAccepted rejects CPFs made of a single repeated digit, masked or not,
+// which pass the check digit calculation.
 func (c *CPF) isAccepted(values string) bool {
-	cpf := strings.ReplaceAll(values, "-", "")
+	cpf := unmask(values)
 	for _, notAccepted := range notAccepted {
 		if cpf == notAccepted {
 			return false
@@ -207,3 +461,125 @@ func (c *CPF) Format(s string) string {
 	c.clean(s)
 	return c.maskCPF(c.cpfNumber)
 }
+
+// cnpjFirstWeights and cnpjSecondWeights weigh the characters summed for
+// the first and second check digits.
+var (
+	cnpjFirstWeights  = []int{5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}
+	cnpjSecondWeights = []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}
+)
+
+// cnpjAlphabet holds the characters of the alphanumeric CNPJ base.
+const cnpjAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// Generate returns a random, valid, numeric CNPJ of a headquarters.
+func (c *CNPJ) Generate() string {
+	return c.generate(rand.New(rand.NewSource(time.Now().UnixNano())), false)
+}
+
+// GenerateAlphanumeric returns a random, valid CNPJ in the alphanumeric
+// format of IN RFB 2.229/2024.
+func (c *CNPJ) GenerateAlphanumeric() string {
+	return c.generate(rand.New(rand.NewSource(time.Now().UnixNano())), true)
+}
+
+func (c *CNPJ) generate(rng *rand.Rand, alphanumeric bool) string {
+	alphabet := cnpjAlphabet[:10]
+	if alphanumeric {
+		alphabet = cnpjAlphabet
+	}
+
+	for {
+		number := make([]int, 0, 14)
+		for i := 0; i < 8; i++ {
+			number = append(number, int(alphabet[rng.Intn(len(alphabet))]-'0'))
+		}
+		number = append(number, 0, 0, 0, 1)
+		number = append(number, c.calculateDigit(number, cnpjFirstWeights))
+		number = append(number, c.calculateDigit(number, cnpjSecondWeights))
+
+		if c.isAccepted(number) {
+			return c.maskCNPJ(number)
+		}
+	}
+}
+
+func (c *CNPJ) maskCNPJ(values []int) string {
+	var sb strings.Builder
+	for _, item := range values {
+		sb.WriteRune(rune('0' + item))
+	}
+	cnpj := sb.String()
+	return fmt.Sprintf("%s.%s.%s/%s-%s", cnpj[:2], cnpj[2:5], cnpj[5:8], cnpj[8:12], cnpj[12:])
+}
+
+// clean keeps the digits and letters of values, each as its ASCII code
+// minus 48, the value the alphanumeric format gives a character.
+func (c *CNPJ) clean(values string) {
+	c.cnpjNumber = nil
+	for _, item := range strings.ToUpper(values) {
+		if (item >= '0' && item <= '9') || (item >= 'A' && item <= 'Z') {
+			c.cnpjNumber = append(c.cnpjNumber, int(item-'0'))
+		}
+	}
+}
+
+// calculateDigit computes a check digit over the first len(weights) values.
+func (c *CNPJ) calculateDigit(values []int, weights []int) int {
+	sum := 0
+	for i, w := range weights {
+		sum += values[i] * w
+	}
+	rest := sum % 11
+	if rest < 2 {
+		return 0
+	}
+	return 11 - rest
+}
+
+func (c *CNPJ) validate(values []int) bool {
+	// the check digits are always numeric, only the base may hold letters
+	for _, v := range values[12:] {
+		if v > 9 {
+			return false
+		}
+	}
+	return c.calculateDigit(values, cnpjFirstWeights) == values[12] &&
+		c.calculateDigit(values, cnpjSecondWeights) == values[13]
+}
+
+func (c *CNPJ) Validate(values string) bool {
+	c.clean(values)
+	return c.length(c.cnpjNumber) && c.isAccepted(c.cnpjNumber) && c.validate(c.cnpjNumber)
+}
+
+// isAccepted rejects CNPJs made of a single repeated character, which
+// pass the check digit calculation.
+func (c *CNPJ) isAccepted(values []int) bool {
+	for _, v := range values[1:] {
+		if v != values[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CNPJ) length(values []int) bool {
+	return len(values) == 14
+}
+
+// IsAlphanumeric reports whether the CNPJ uses letters in its base.
+func (c *CNPJ) IsAlphanumeric(values string) bool {
+	c.clean(values)
+	for _, v := range c.cnpjNumber {
+		if v > 9 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CNPJ) Format(s string) string {
+	c.clean(s)
+	return c.maskCNPJ(c.cnpjNumber)
+}
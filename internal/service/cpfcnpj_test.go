@@ -0,0 +1,109 @@
+package service
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestCheckDocument(t *testing.T) {
+	tests := []struct {
+		doc          string
+		typ          string
+		valid        bool
+		formatted    string
+		branch       string
+		alphanumeric bool
+	}{
+		{"52998224725", docCPF, true, "529.982.247-25", "", false},
+		{"529.982.247-25", docCPF, true, "529.982.247-25", "", false},
+		{"529.982.247-24", docCPF, false, "", "", false},
+		{"529.982.247-15", docCPF, false, "", "", false},
+		{"11111111111", docCPF, false, "", "", false},
+		{"111.111.111-11", docCPF, false, "", "", false},
+		{"11222333000181", docCNPJ, true, "11.222.333/0001-81", "0001", false},
+		{"11.222.333/0001-81", docCNPJ, true, "11.222.333/0001-81", "0001", false},
+		{"11.222.333/0001-82", docCNPJ, false, "", "", false},
+		{"00.000.000/0000-00", docCNPJ, false, "", "", false},
+		{"12ABC34501DE35", docCNPJ, true, "12.ABC.345/01DE-35", "01DE", true},
+		{"12.abc.345/01de-35", docCNPJ, true, "12.ABC.345/01DE-35", "01DE", true},
+		{"12.ABC.345/01DE-36", docCNPJ, false, "", "", false},
+		{"12.ABC.345/01DE-3A", docCNPJ, false, "", "", false},
+		{"AAAAAAAAAAAA00", docCNPJ, false, "", "", false},
+		{"5299822472", "", false, "", "", false},
+		{"ABC.982.247-25", "", false, "", "", false},
+	}
+	for _, tt := range tests {
+		got := checkDocument(tt.doc)
+		if got.Type != tt.typ || got.IsValid != tt.valid {
+			t.Errorf("%s: type %q valid %v, want %q %v", tt.doc, got.Type, got.IsValid, tt.typ, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			if got.Document != tt.doc {
+				t.Errorf("%s: invalid document returned as %s", tt.doc, got.Document)
+			}
+			continue
+		}
+		if got.Document != tt.formatted || got.Branch != tt.branch || got.Alphanumeric != tt.alphanumeric {
+			t.Errorf("%s: got %+v", tt.doc, got)
+		}
+	}
+}
+
+func TestCPFCheckDigits(t *testing.T) {
+	tests := []struct {
+		base          []int
+		first, second int
+	}{
+		{[]int{5, 2, 9, 9, 8, 2, 2, 4, 7}, 2, 5},
+		{[]int{1, 2, 3, 4, 5, 6, 7, 8, 9}, 0, 9},
+		{[]int{0, 0, 0, 0, 0, 0, 0, 0, 1}, 9, 1},
+	}
+	c := &CPF{}
+	for _, tt := range tests {
+		first := c.calculateFirstDigit(tt.base)
+		second := c.calculateSecondDigit(append(append([]int{}, tt.base...), first))
+		if first != tt.first || second != tt.second {
+			t.Errorf("%v: check digits %d%d, want %d%d", tt.base, first, second, tt.first, tt.second)
+		}
+	}
+}
+
+func TestCPFOrigin(t *testing.T) {
+	c := &CPF{}
+	for region := 0; region <= 9; region++ {
+		doc := c.generate(rand.New(rand.NewSource(int64(region))), region)
+		if !c.Validate(doc) {
+			t.Fatalf("generated CPF %s is invalid", doc)
+		}
+		if doc[10] != byte('0'+region) || c.CheckOrigin(doc) == "" {
+			t.Errorf("CPF %s generated for region %d reports %q", doc, region, c.CheckOrigin(doc))
+		}
+	}
+	if got := c.CheckOrigin("529.982.247-25"); got != "Rio de Janeiro e Espírito Santo" {
+		t.Errorf("origin = %q", got)
+	}
+}
+
+func TestGenerateDocuments(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for range 200 {
+		cpf := (&CPF{}).generate(rng, -1)
+		if res := checkDocument(cpf); !res.IsValid || res.Type != docCPF {
+			t.Fatalf("generated CPF %s: %+v", cpf, res)
+		}
+		if res := checkDocument(corruptCheckDigit(rng, cpf)); res.IsValid {
+			t.Fatalf("corrupted CPF %s is valid", res.Document)
+		}
+
+		cnpj := (&CNPJ{}).generate(rng, false)
+		if res := checkDocument(cnpj); !res.IsValid || res.Alphanumeric || res.Branch != "0001" {
+			t.Fatalf("generated CNPJ %s: %+v", cnpj, res)
+		}
+
+		alnum := (&CNPJ{}).generate(rng, true)
+		if res := checkDocument(unmask(alnum)); !res.IsValid || res.Type != docCNPJ || res.Document != alnum {
+			t.Fatalf("generated alphanumeric CNPJ %s: %+v", alnum, res)
+		}
+	}
+}
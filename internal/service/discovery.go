@@ -0,0 +1,329 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// Subjects used by workers to announce the routes they serve. Workers
+// publish an announcement at startup and then every announceInterval as a
+// heartbeat; the gateway drops an instance's routes once its TTL expires.
+// Announcements and withdrawals carry the shared announce token in the
+// Announce-Token header, so only workers holding it can change routes.
+const (
+	subjectRoutesAnnounce = "gateway.routes.announce"
+	subjectRoutesWithdraw = "gateway.routes.withdraw"
+	subjectRoutesDiscover = "gateway.routes.discover"
+
+	headerAnnounceToken = "Announce-Token"
+
+	announceInterval = 10 * time.Second
+	announceTTL      = 3 * announceInterval
+)
+
+// RouteAnnouncement is the heartbeat a worker instance publishes.
+type RouteAnnouncement struct {
+	Service  string           `json:"service"`
+	Instance string           `json:"instance"`
+	TTL      int              `json:"ttl_seconds"`
+	Routes   []AnnouncedRoute `json:"routes,omitempty"`
+}
+
+// AnnouncedRoute describes one HTTP route backed by a NATS subject. Path
+// uses the OpenAPI template syntax, e.g. /lookup/cep/{cep}, and like the
+// paths of the spec is served under the base path of its servers. Query
+// and Headers name the parameters forwarded to the worker. Batch, when
+// set, is the x-nats-batch chunk size of a streaming batch route.
+type AnnouncedRoute struct {
+	Path        string          `json:"path"`
+	Method      string          `json:"method"`
+	Subject     string          `json:"subject"`
+	Timeout     string          `json:"timeout,omitempty"`
+	Query       []string        `json:"query,omitempty"`
+	Headers     []string        `json:"headers,omitempty"`
+	Batch       int             `json:"batch,omitempty"`
+	RequestBody json.RawMessage `json:"request_body,omitempty"`
+}
+
+// announcedInstance holds the valid routes of an instance; they are turned
+// into gateway routes on every rebuild, under the current base path.
+// announced is the announcement as received, to tell when it changes.
+type announcedInstance struct {
+	service   string
+	expires   time.Time
+	routes    []AnnouncedRoute
+	announced string
+}
+
+// announceRoutes keeps the routes of a worker instance registered on the
+// gateway until the command stops, then withdraws them.
+func (c *ConfigService) announceRoutes(service string, routes []AnnouncedRoute) error {
+	token, err := secretValue(c.AnnounceToken)
+	if err != nil {
+		return fmt.Errorf("failed to load announce token: %w", err)
+	}
+	ctx, nc := c.ctx, c.nc
+
+	ann := RouteAnnouncement{
+		Service:  service,
+		Instance: nuid.Next(),
+		TTL:      int(announceTTL / time.Second),
+		Routes:   routes,
+	}
+
+	data, err := json.Marshal(ann)
+	if err != nil {
+		return fmt.Errorf("error encoding route announcement: %w", err)
+	}
+
+	send := func(subject string, data []byte) error {
+		return nc.PublishMsg(&nats.Msg{Subject: subject, Data: data, Header: nats.Header{headerAnnounceToken: {token}}})
+	}
+	publish := func() {
+		if err := send(subjectRoutesAnnounce, data); err != nil {
+			log.Printf("[%s] error announcing routes: %v", service, err)
+		}
+	}
+
+	// a gateway starting later asks every worker to announce right away
+	sub, err := nc.Subscribe(subjectRoutesDiscover, func(*nats.Msg) { publish() })
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", subjectRoutesDiscover, err)
+	}
+
+	publish()
+
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		defer func() { _ = sub.Unsubscribe() }()
+
+		for {
+			select {
+			case <-ctx.Done():
+				withdraw, _ := json.Marshal(RouteAnnouncement{Service: service, Instance: ann.Instance})
+				_ = send(subjectRoutesWithdraw, withdraw)
+				_ = nc.Flush()
+				return
+			case <-ticker.C:
+				publish()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// watchAnnouncements adds and removes routes announced by workers at runtime.
+func (p *Proxy) watchAnnouncements(ctx context.Context) error {
+	announce, err := p.nc.Subscribe(subjectRoutesAnnounce, func(m *nats.Msg) {
+		if !p.announceAllowed(m) {
+			log.Printf("[api] ignoring route announcement without a valid token")
+			return
+		}
+		var ann RouteAnnouncement
+		if err := json.Unmarshal(m.Data, &ann); err != nil || ann.Instance == "" {
+			log.Printf("[api] ignoring malformed route announcement: %s", string(m.Data))
+			return
+		}
+		p.announce(ann)
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", subjectRoutesAnnounce, err)
+	}
+
+	withdraw, err := p.nc.Subscribe(subjectRoutesWithdraw, func(m *nats.Msg) {
+		if !p.announceAllowed(m) {
+			log.Printf("[api] ignoring route withdrawal without a valid token")
+			return
+		}
+		var ann RouteAnnouncement
+		if err := json.Unmarshal(m.Data, &ann); err == nil {
+			p.withdraw(ann.Instance, "withdrawn")
+		}
+	})
+	if err != nil {
+		_ = announce.Unsubscribe()
+		return fmt.Errorf("error subscribing to %s: %w", subjectRoutesWithdraw, err)
+	}
+
+	if err := p.nc.Publish(subjectRoutesDiscover, nil); err != nil {
+		log.Printf("[api] error requesting route announcements: %v", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(announceInterval)
+		defer ticker.Stop()
+		defer func() {
+			_ = announce.Unsubscribe()
+			_ = withdraw.Unsubscribe()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				p.expireAnnouncements(now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// announceAllowed checks the announce token of a message.
+func (p *Proxy) announceAllowed(m *nats.Msg) bool {
+	got := []byte(m.Header.Get(headerAnnounceToken))
+	return subtle.ConstantTimeCompare(got, []byte(p.announceToken)) == 1
+}
+
+// announce registers the routes of a new instance, or refreshes a known
+// one, rebuilding its routes when they differ from its last announcement.
+func (p *Proxy) announce(ann RouteAnnouncement) {
+	ttl := time.Duration(ann.TTL) * time.Second
+	if ttl <= 0 {
+		ttl = announceTTL
+	}
+	announced, _ := json.Marshal(ann.Routes)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prev, known := p.announced[ann.Instance]
+	if known {
+		prev.expires = time.Now().Add(ttl)
+		if prev.announced == string(announced) {
+			return
+		}
+	}
+
+	var routes []AnnouncedRoute
+	for _, ar := range ann.Routes {
+		if _, err := announcedRoute(ar, p.basePath); err != nil {
+			log.Printf("[api] ignoring route %s %s from %s: %v", ar.Method, ar.Path, ann.Service, err)
+			continue
+		}
+		routes = append(routes, ar)
+	}
+
+	p.announced[ann.Instance] = &announcedInstance{
+		service:   ann.Service,
+		expires:   time.Now().Add(ttl),
+		routes:    routes,
+		announced: string(announced),
+	}
+
+	if err := p.rebuildLocked(); err != nil {
+		if known {
+			p.announced[ann.Instance] = prev
+		} else {
+			delete(p.announced, ann.Instance)
+		}
+		log.Printf("[api] rejected routes from %s/%s: %v", ann.Service, ann.Instance, err)
+		return
+	}
+
+	if known {
+		log.Printf("[api] updated routes from %s/%s, now %d", ann.Service, ann.Instance, len(routes))
+		return
+	}
+	log.Printf("[api] registered %d routes from %s/%s", len(routes), ann.Service, ann.Instance)
+}
+
+func (p *Proxy) withdraw(instance, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	inst, ok := p.announced[instance]
+	if !ok {
+		return
+	}
+
+	delete(p.announced, instance)
+	if err := p.rebuildLocked(); err != nil {
+		log.Printf("[api] error removing routes from %s/%s: %v", inst.service, instance, err)
+		return
+	}
+
+	log.Printf("[api] removed routes from %s/%s (%s)", inst.service, instance, reason)
+}
+
+func (p *Proxy) expireAnnouncements(now time.Time) {
+	p.mu.Lock()
+	var expired []string
+	for id, inst := range p.announced {
+		if now.After(inst.expires) {
+			expired = append(expired, id)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, id := range expired {
+		p.withdraw(id, "heartbeat expired")
+	}
+}
+
+// announcedRoute turns an announcement into a route served under
+// basePath, synthesizing the OpenAPI operation so requests go through the
+// same validation and parameter forwarding as spec routes.
+func announcedRoute(ar AnnouncedRoute, basePath string) (*Route, error) {
+	method := strings.ToUpper(ar.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	if !strings.HasPrefix(ar.Path, "/") || ar.Subject == "" {
+		return nil, fmt.Errorf("path and subject are required")
+	}
+
+	operation := openapi3.NewOperation()
+	operation.Extensions = map[string]any{
+		"x-nats-subject": ar.Subject,
+		"x-timeout":      ar.Timeout,
+	}
+	if ar.Batch > 0 {
+		operation.Extensions["x-nats-batch"] = ar.Batch
+	}
+
+	for _, match := range templateParam.FindAllStringSubmatch(ar.Path, -1) {
+		operation.AddParameter(openapi3.NewPathParameter(match[1]).WithSchema(openapi3.NewStringSchema()))
+	}
+
+	for _, name := range ar.Query {
+		operation.AddParameter(openapi3.NewQueryParameter(name).WithSchema(openapi3.NewStringSchema()))
+	}
+
+	for _, name := range ar.Headers {
+		operation.AddParameter(openapi3.NewHeaderParameter(name).WithSchema(openapi3.NewStringSchema()))
+	}
+
+	if len(ar.RequestBody) > 0 {
+		schema := openapi3.NewSchema()
+		if err := json.Unmarshal(ar.RequestBody, schema); err != nil {
+			return nil, fmt.Errorf("invalid request body schema: %w", err)
+		}
+		operation.RequestBody = &openapi3.RequestBodyRef{
+			Value: openapi3.NewRequestBody().WithRequired(true).WithJSONSchema(schema),
+		}
+	}
+
+	routes := make(map[string]*Route)
+	registerRoute(routes, basePath+ar.Path, &openapi3.PathItem{}, operation, method)
+
+	for _, route := range routes {
+		return route, nil
+	}
+
+	return nil, fmt.Errorf("no route registered")
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const discoverySpec = `openapi: 3.0.3
+info:
+  title: test
+  version: "1"
+servers:
+  - url: /v1
+paths:
+  /health/spec:
+    get:
+      x-nats-subject: service.spec
+      responses:
+        "200":
+          description: ok
+`
+
+func testProxy(t *testing.T, nc *nats.Conn, token string) *Proxy {
+	t.Helper()
+	doc, err := loadOpenAPIData(filepath.Join(t.TempDir(), "openapi.yaml"), []byte(discoverySpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	px := &Proxy{
+		registeredRoutes: make(map[string]*Route),
+		announced:        make(map[string]*announcedInstance),
+		announceToken:    token,
+		nc:               nc,
+	}
+	if err := px.apply(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := px.watchAnnouncements(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return px
+}
+
+func proxyRoutes(px *Proxy) []string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	out := make([]string, 0, len(px.registeredRoutes))
+	for k, r := range px.registeredRoutes {
+		out = append(out, fmt.Sprintf("%s %s", k, r.subject))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// waitRoutes polls the proxy until it serves want.
+func waitRoutes(t *testing.T, px *Proxy, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := proxyRoutes(px)
+		if equalStrings(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("routes = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAnnounceRoutes(t *testing.T) {
+	nc := testNats(t)
+	px := testProxy(t, nc, "s3cret")
+
+	publish := func(subject, token string, ann RouteAnnouncement) {
+		t.Helper()
+		data, err := json.Marshal(ann)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := &nats.Msg{Subject: subject, Data: data, Header: nats.Header{}}
+		if token != "" {
+			msg.Header.Set(headerAnnounceToken, token)
+		}
+		if err := nc.PublishMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	route := func(path, subject string) RouteAnnouncement {
+		return RouteAnnouncement{Service: "echo", Instance: "a", Routes: []AnnouncedRoute{
+			{Path: path, Method: "get", Subject: subject},
+		}}
+	}
+	spec := "GET-/v1/health/spec service.spec"
+
+	// announced paths are served under the base path of the spec
+	publish(subjectRoutesAnnounce, "s3cret", route("/echo", "service.echo"))
+	waitRoutes(t, px, spec, "GET-/v1/echo service.echo")
+
+	// a known instance announcing other routes replaces its own
+	publish(subjectRoutesAnnounce, "s3cret", route("/echo/{id}", "service.echo.id"))
+	waitRoutes(t, px, spec, "GET-/v1/echo/{id} service.echo.id")
+
+	// messages without the token are ignored; the valid announcement that
+	// follows is handled after them
+	publish(subjectRoutesAnnounce, "", route("/open", "service.open"))
+	publish(subjectRoutesAnnounce, "wrong", route("/open", "service.open"))
+	publish(subjectRoutesWithdraw, "wrong", RouteAnnouncement{Service: "echo", Instance: "a"})
+	other := route("/other", "service.other")
+	other.Instance = "b"
+	publish(subjectRoutesAnnounce, "s3cret", other)
+	waitRoutes(t, px, spec, "GET-/v1/echo/{id} service.echo.id", "GET-/v1/other service.other")
+
+	publish(subjectRoutesWithdraw, "s3cret", RouteAnnouncement{Service: "echo", Instance: "a"})
+	waitRoutes(t, px, spec, "GET-/v1/other service.other")
+}
+
+func TestAnnounceRoutesToken(t *testing.T) {
+	nc := testNats(t)
+	px := testProxy(t, nc, "s3cret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &ConfigService{ctx: ctx, nc: nc, AnnounceToken: "env:TEST_ANNOUNCE_TOKEN"}
+	if err := cfg.announceRoutes("echo", nil); err == nil {
+		t.Fatal("announced routes without a token")
+	}
+
+	t.Setenv("TEST_ANNOUNCE_TOKEN", "s3cret")
+	routes := []AnnouncedRoute{{Path: "/echo", Subject: "service.echo"}}
+	if err := cfg.announceRoutes("echo", routes); err != nil {
+		t.Fatal(err)
+	}
+	waitRoutes(t, px, "GET-/v1/health/spec service.spec", "POST-/v1/echo service.echo")
+
+	// stopping the worker withdraws its routes
+	cancel()
+	waitRoutes(t, px, "GET-/v1/health/spec service.spec")
+}
@@ -0,0 +1,495 @@
+package service
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DocumentType validates, formats and generates one kind of document.
+// Format expects a valid document; Generate returns a valid, masked one.
+type DocumentType interface {
+	Label() string
+	Validate(doc string) bool
+	Format(doc string) string
+	Generate(rng *rand.Rand) string
+}
+
+// documentTypes is the registry served by service.documents, keyed by
+// type name. State registrations are keyed "ie-<uf>", see ie.go.
+var documentTypes = map[string]DocumentType{}
+
+// documentAliases maps alternative names to a registered type.
+var documentAliases = map[string]string{
+	"pasep":          "pis",
+	"nit":            "pis",
+	"titulo_eleitor": "titulo",
+	"sus":            "cns",
+}
+
+// registerDocumentType adds a document type to the registry.
+func registerDocumentType(name string, t DocumentType) {
+	documentTypes[name] = t
+}
+
+func init() {
+	registerDocumentType(docCPF, cpfDocument{})
+	registerDocumentType(docCNPJ, cnpjDocument{})
+
+	registerDocumentType("pis", &digitDocument{
+		label:    "PIS/PASEP/NIT",
+		lengths:  []int{11},
+		mask:     "###.#####.##-#",
+		complete: completePIS,
+		accept:   notRepeated,
+	})
+	registerDocumentType("cnh", &digitDocument{
+		label:    "Carteira Nacional de Habilitação",
+		lengths:  []int{11},
+		complete: completeCNH,
+		accept:   notRepeated,
+	})
+	registerDocumentType("titulo", &digitDocument{
+		label:    "Título de Eleitor",
+		lengths:  []int{12},
+		mask:     "#### #### ####",
+		complete: completeTitulo,
+		accept:   tituloState,
+	})
+	registerDocumentType("renavam", &digitDocument{
+		label:    "RENAVAM",
+		lengths:  []int{11},
+		complete: completeRenavam,
+		accept:   notRepeated,
+	})
+	registerDocumentType("cns", &digitDocument{
+		label:    "Cartão Nacional de Saúde",
+		lengths:  []int{15},
+		mask:     "### #### #### ####",
+		complete: completeCNS,
+		accept:   cnsPrefix,
+	})
+}
+
+// documentType resolves a type name, and for "ie" the state, to its
+// registry key and implementation.
+func documentType(name, state string) (string, DocumentType, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := documentAliases[name]; ok {
+		name = alias
+	}
+
+	if name == "ie" {
+		if state == "" {
+			return "", nil, errBadRequest("state is required for ie")
+		}
+		name = "ie-" + strings.ToLower(state)
+	}
+
+	t, ok := documentTypes[name]
+	if !ok {
+		return "", nil, errBadRequest("unsupported document type %q", name)
+	}
+	return name, t, nil
+}
+
+// DocumentRequest is the body accepted by service.documents.validate.
+// State is the UF of an Inscrição Estadual.
+type DocumentRequest struct {
+	Type     string `json:"type"`
+	Document string `json:"document"`
+	State    string `json:"state,omitempty" pattern:"^[A-Za-z]{2}$"`
+}
+
+// DocumentResponse is the result of a validation, with the document formatted.
+type DocumentResponse struct {
+	Type     string `json:"type"`
+	Label    string `json:"label"`
+	Document string `json:"document"`
+	IsValid  bool   `json:"is_valid"`
+}
+
+// DocumentGenerateRequest is the body accepted by service.documents.generate.
+type DocumentGenerateRequest struct {
+	Type   string `json:"type"`
+	State  string `json:"state,omitempty" pattern:"^[A-Za-z]{2}$"`
+	Count  int    `json:"count,omitempty"`
+	Masked *bool  `json:"masked,omitempty"`
+	Seed   *int64 `json:"seed,omitempty"`
+}
+
+// DocumentTypeInfo describes a registered type; States lists the UFs of
+// the ie type.
+type DocumentTypeInfo struct {
+	Type   string   `json:"type"`
+	Label  string   `json:"label"`
+	States []string `json:"states,omitempty"`
+}
+
+// DocumentTypesResponse lists the registered document types.
+type DocumentTypesResponse struct {
+	Types []DocumentTypeInfo `json:"types"`
+}
+
+// documentWorkers returns the service.documents endpoints and the routes
+// they announce, served alongside service.cpfcnpj.
+func documentWorkers() ([]endpoint, []AnnouncedRoute) {
+	validate := NewWorker("documents-validate", "service.documents.validate", validateDocument)
+	generate := NewWorker("documents-generate", "service.documents.generate", generateDocumentType)
+	types := NewWorker("documents-types", "service.documents.types", listDocumentTypes)
+
+	return []endpoint{validate, generate, types}, []AnnouncedRoute{
+		validate.Route(http.MethodPost, "/documents/validate", "2s"),
+		generate.Route(http.MethodPost, "/documents/generate", "2s"),
+		types.Route(http.MethodGet, "/documents/types", "2s"),
+	}
+}
+
+func validateDocument(_ context.Context, req *Request[DocumentRequest]) (*DocumentResponse, error) {
+	name, t, err := documentType(req.Body.Type, req.Body.State)
+	if err != nil {
+		return nil, err
+	}
+	if req.Body.Document == "" {
+		return nil, errBadRequest("missing document")
+	}
+
+	if !t.Validate(req.Body.Document) {
+		return nil, errUnprocessable("document invalid")
+	}
+
+	return &DocumentResponse{Type: name, Label: t.Label(), Document: t.Format(req.Body.Document), IsValid: true}, nil
+}
+
+func generateDocumentType(_ context.Context, req *Request[DocumentGenerateRequest]) (*GenerateResponse, error) {
+	body := req.Body
+
+	name, t, err := documentType(body.Type, body.State)
+	if err != nil {
+		return nil, err
+	}
+
+	count := body.Count
+	if count == 0 {
+		count = 1
+	}
+	if count < 0 || count > maxGenerateCount {
+		return nil, errBadRequest("count must be between 1 and %d", maxGenerateCount)
+	}
+
+	seed := time.Now().UnixNano()
+	if body.Seed != nil {
+		seed = *body.Seed
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	resp := &GenerateResponse{Type: name, Seed: seed, Documents: make([]string, 0, count)}
+	for range count {
+		doc := t.Generate(rng)
+		if body.Masked != nil && !*body.Masked {
+			doc = unmask(doc)
+		}
+		resp.Documents = append(resp.Documents, doc)
+	}
+
+	return resp, nil
+}
+
+func listDocumentTypes(_ context.Context, _ *Request[struct{}]) (*DocumentTypesResponse, error) {
+	resp := &DocumentTypesResponse{}
+	var states []string
+	for name, t := range documentTypes {
+		if uf, ok := strings.CutPrefix(name, "ie-"); ok {
+			states = append(states, strings.ToUpper(uf))
+			continue
+		}
+		resp.Types = append(resp.Types, DocumentTypeInfo{Type: name, Label: t.Label()})
+	}
+
+	if len(states) > 0 {
+		sort.Strings(states)
+		resp.Types = append(resp.Types, DocumentTypeInfo{Type: "ie", Label: "Inscrição Estadual", States: states})
+	}
+
+	sort.Slice(resp.Types, func(i, j int) bool { return resp.Types[i].Type < resp.Types[j].Type })
+	return resp, nil
+}
+
+// cpfDocument and cnpjDocument plug the CPF and CNPJ validators into the registry.
+type (
+	cpfDocument  struct{}
+	cnpjDocument struct{}
+)
+
+func (cpfDocument) Label() string {
+	return "CPF"
+}
+
+func (cpfDocument) Validate(doc string) bool {
+	return detectDocument(doc) == docCPF && (&CPF{}).Validate(doc)
+}
+
+func (cpfDocument) Format(doc string) string {
+	return (&CPF{}).Format(doc)
+}
+
+func (cpfDocument) Generate(rng *rand.Rand) string {
+	return (&CPF{}).generate(rng, -1)
+}
+
+func (cnpjDocument) Label() string {
+	return "CNPJ"
+}
+
+func (cnpjDocument) Validate(doc string) bool {
+	return detectDocument(doc) == docCNPJ && (&CNPJ{}).Validate(doc)
+}
+
+func (cnpjDocument) Format(doc string) string {
+	return (&CNPJ{}).Format(doc)
+}
+
+func (cnpjDocument) Generate(rng *rand.Rand) string {
+	return (&CNPJ{}).generate(rng, false)
+}
+
+// digitDocument is a numeric document whose check digits are computed by
+// complete, which overwrites them in place. A number is valid when it has
+// one of the accepted lengths, starts with prefix, passes accept and
+// complete leaves it unchanged. A check digit complete cannot compute is
+// set to -1, so the number never validates and generation retries.
+type digitDocument struct {
+	label    string
+	lengths  []int
+	prefix   string
+	mask     string
+	accept   func(d []int) bool
+	complete func(d []int)
+}
+
+func (t *digitDocument) Label() string {
+	return t.label
+}
+
+func (t *digitDocument) Validate(doc string) bool {
+	d, ok := docDigits(doc)
+	if !ok || !slices.Contains(t.lengths, len(d)) || !t.hasPrefix(d) {
+		return false
+	}
+	if t.accept != nil && !t.accept(d) {
+		return false
+	}
+
+	c := slices.Clone(d)
+	t.complete(c)
+	return slices.Equal(c, d)
+}
+
+func (t *digitDocument) Format(doc string) string {
+	d, _ := docDigits(doc)
+	return t.maskDigits(d)
+}
+
+func (t *digitDocument) Generate(rng *rand.Rand) string {
+	for {
+		d := make([]int, t.lengths[0])
+		for i := range d {
+			d[i] = rng.Intn(10)
+		}
+		for i, r := range t.prefix {
+			d[i] = int(r - '0')
+		}
+
+		t.complete(d)
+		if t.Validate(digitString(d)) {
+			return t.maskDigits(d)
+		}
+	}
+}
+
+func (t *digitDocument) hasPrefix(d []int) bool {
+	return strings.HasPrefix(digitString(d), t.prefix)
+}
+
+// maskDigits fills the '#' placeholders of mask; a number of another
+// length is returned as plain digits.
+func (t *digitDocument) maskDigits(d []int) string {
+	if strings.Count(t.mask, "#") != len(d) {
+		return digitString(d)
+	}
+
+	var sb strings.Builder
+	i := 0
+	for _, r := range t.mask {
+		if r == '#' {
+			sb.WriteByte(byte('0' + d[i]))
+			i++
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// docDigits returns the digits of doc, ignoring the mask; documents with
+// letters are rejected.
+func docDigits(doc string) ([]int, bool) {
+	d := make([]int, 0, len(doc))
+	for _, r := range doc {
+		switch {
+		case r >= '0' && r <= '9':
+			d = append(d, int(r-'0'))
+		case r == '.' || r == '-' || r == '/' || r == ' ':
+		default:
+			return nil, false
+		}
+	}
+	return d, true
+}
+
+func digitString(d []int) string {
+	var sb strings.Builder
+	for _, v := range d {
+		if v < 0 || v > 9 {
+			sb.WriteByte('?')
+			continue
+		}
+		sb.WriteByte(byte('0' + v))
+	}
+	return sb.String()
+}
+
+// weightedSum multiplies the first len(weights) digits by weights.
+func weightedSum(d []int, weights ...int) int {
+	sum := 0
+	for i, w := range weights {
+		sum += d[i] * w
+	}
+	return sum
+}
+
+// mod11 is the most common check digit: 11 minus the remainder, 0 when
+// that gives 10 or 11.
+func mod11(sum int) int {
+	if r := 11 - sum%11; r < 10 {
+		return r
+	}
+	return 0
+}
+
+func notRepeated(d []int) bool {
+	for _, v := range d[1:] {
+		if v != d[0] {
+			return true
+		}
+	}
+	return false
+}
+
+func completePIS(d []int) {
+	d[10] = mod11(weightedSum(d, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+// completeCNH follows the DENATRAN rule: when the first digit overflows
+// to 0, the second is lowered by 2.
+func completeCNH(d []int) {
+	sum := 0
+	for i := range 9 {
+		sum += d[i] * (9 - i)
+	}
+	first, dsc := sum%11, 0
+	if first >= 10 {
+		first, dsc = 0, 2
+	}
+
+	sum = 0
+	for i := range 9 {
+		sum += d[i] * (i + 1)
+	}
+	second := sum%11 - dsc
+	if second < 0 {
+		second += 11
+	}
+	if second >= 10 {
+		second = 0
+	}
+
+	d[9], d[10] = first, second
+}
+
+// completeTitulo computes the digits of a voter id: a sequence of 8, the
+// state code and 2 check digits. In São Paulo and Minas Gerais a
+// remainder of 0 gives 1.
+func completeTitulo(d []int) {
+	state := d[8]*10 + d[9]
+	digit := func(sum int) int {
+		r := sum % 11
+		switch {
+		case r == 10:
+			return 0
+		case r == 0 && (state == 1 || state == 2):
+			return 1
+		}
+		return r
+	}
+
+	d[10] = digit(weightedSum(d, 2, 3, 4, 5, 6, 7, 8, 9))
+	d[11] = digit(d[8]*7 + d[9]*8 + d[10]*9)
+}
+
+// tituloState accepts the state codes 01 to 28, 28 being voters abroad.
+func tituloState(d []int) bool {
+	state := d[8]*10 + d[9]
+	return state >= 1 && state <= 28
+}
+
+func completeRenavam(d []int) {
+	d[10] = (weightedSum(d, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2) * 10) % 11 % 10
+}
+
+// completeCNS computes a health card number. Definitive cards, starting
+// with 1 or 2, derive from the holder's PIS; provisional ones, starting
+// with 7, 8 or 9, only need a weighted sum divisible by 11.
+func completeCNS(d []int) {
+	if d[0] == 1 || d[0] == 2 {
+		sum := 0
+		for i := range 11 {
+			sum += d[i] * (15 - i)
+		}
+
+		dv, tail := 11-sum%11, []int{0, 0, 0}
+		if dv == 11 {
+			dv = 0
+		}
+		if dv == 10 {
+			sum += 2
+			dv, tail = 11-sum%11, []int{0, 0, 1}
+			switch dv {
+			case 11:
+				dv = 0
+			case 10:
+				dv = -1
+			}
+		}
+		copy(d[11:14], tail)
+		d[14] = dv
+		return
+	}
+
+	sum := 0
+	for i := range 14 {
+		sum += d[i] * (15 - i)
+	}
+	d[14] = (11 - sum%11) % 11
+	if d[14] == 10 {
+		d[14] = -1
+	}
+}
+
+func cnsPrefix(d []int) bool {
+	return slices.Contains([]int{1, 2, 7, 8, 9}, d[0])
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"testing"
+)
+
+func TestDocumentTypesValidate(t *testing.T) {
+	// examples published by SINTEGRA for each state, and by the issuers of
+	// the other documents
+	tests := []struct {
+		name, state, doc, formatted string
+	}{
+		{"ie", "ac", "0100482300112", "01.004.823/001-12"},
+		{"ie", "al", "240000048", "240000048"},
+		{"ie", "ap", "030123459", "030123459"},
+		{"ie", "am", "999999990", "999999990"},
+		{"ie", "ba", "12345663", "12345663"},
+		{"ie", "ba", "100000306", "1000003-06"},
+		{"ie", "ce", "060000015", "060000015"},
+		{"ie", "df", "0730000100109", "07.300001.001-09"},
+		{"ie", "es", "999999990", "999999990"},
+		{"ie", "go", "109876547", "10.987.654-7"},
+		{"ie", "ma", "120000385", "120000385"},
+		{"ie", "mt", "00130000019", "00130000019"},
+		{"ie", "ms", "283115947", "283115947"},
+		{"ie", "mg", "0623079040081", "062.307.904/0081"},
+		{"ie", "pa", "159999995", "159999995"},
+		{"ie", "pb", "060000015", "060000015"},
+		{"ie", "pr", "1234567850", "12345678-50"},
+		{"ie", "pe", "032141840", "0321418-40"},
+		{"ie", "pi", "012345679", "012345679"},
+		{"ie", "rj", "99999993", "99.999.99-3"},
+		{"ie", "rn", "200400401", "200400401"},
+		{"ie", "rn", "2000400400", "2000400400"},
+		{"ie", "rs", "2243658792", "224/3658792"},
+		{"ie", "ro", "00000000625213", "00000000625213"},
+		{"ie", "rr", "240066281", "240066281"},
+		{"ie", "sc", "251040852", "251.040.852"},
+		{"ie", "sp", "110042490114", "110.042.490.114"},
+		{"ie", "se", "271234563", "271234563"},
+		{"ie", "to", "29010227836", "29010227836"},
+		{"ie", "to", "290227836", "290227836"},
+		{"pis", "", "17033259504", "170.33259.50-4"},
+		{"nit", "", "170.33259.50-4", "170.33259.50-4"},
+		{"cnh", "", "02650306461", "02650306461"},
+		{"titulo", "", "102385010671", "1023 8501 0671"},
+		{"titulo_eleitor", "", "0043 5687 0906", "0043 5687 0906"},
+		{"renavam", "", "00639884962", "00639884962"},
+		{"cns", "", "123456789010000", "123 4567 8901 0000"},
+		{"cns", "", "100000000060018", "100 0000 0006 0018"},
+		{"sus", "", "700000000000005", "700 0000 0000 0005"},
+	}
+	for _, tt := range tests {
+		key, typ, err := documentType(tt.name, tt.state)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.name, tt.state, err)
+		}
+		if !typ.Validate(tt.doc) {
+			t.Errorf("%s: %s is invalid", key, tt.doc)
+			continue
+		}
+		if got := typ.Format(tt.doc); got != tt.formatted {
+			t.Errorf("%s: %s formatted as %s, want %s", key, tt.doc, got, tt.formatted)
+		}
+		if typ.Validate(corruptCheckDigit(rand.New(rand.NewSource(1)), tt.doc)) {
+			t.Errorf("%s: %s with another check digit is valid", key, tt.doc)
+		}
+	}
+}
+
+func TestDocumentTypesReject(t *testing.T) {
+	tests := []struct {
+		name, state, doc string
+	}{
+		{"ie", "al", "250000048"},      // not a company type of Alagoas
+		{"ie", "ap", "040123459"},      // outside the Amapá prefix
+		{"ie", "sp", "11004249011"},    // too short
+		{"ie", "sp", "P011004243002"},  // rural producer
+		{"ie", "to", "29040227836"},    // not a company type of Tocantins
+		{"pis", "", "11111111111"},     // repeated digits
+		{"titulo", "", "102385299971"}, // state 29 does not exist
+		{"cns", "", "300000000000005"}, // no card starts with 3
+	}
+	for _, tt := range tests {
+		key, typ, err := documentType(tt.name, tt.state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ.Validate(tt.doc) {
+			t.Errorf("%s: %s is valid", key, tt.doc)
+		}
+	}
+}
+
+func TestDocumentTypesGenerate(t *testing.T) {
+	names := make([]string, 0, len(documentTypes))
+	for name := range documentTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rng := rand.New(rand.NewSource(1))
+	for _, name := range names {
+		typ := documentTypes[name]
+		for range 50 {
+			doc := typ.Generate(rng)
+			if !typ.Validate(doc) {
+				t.Fatalf("%s: generated %s is invalid", name, doc)
+			}
+			if got := typ.Format(doc); got != doc {
+				t.Fatalf("%s: generated %s formats as %s", name, doc, got)
+			}
+		}
+	}
+}
+
+func TestDocumentTypeLookup(t *testing.T) {
+	if _, _, err := documentType("ie", ""); err == nil {
+		t.Error("ie without a state resolved")
+	}
+	wantStatus(t, func() error { _, _, err := documentType("passport", ""); return err }(), http.StatusBadRequest)
+
+	for _, tt := range []struct{ name, state, key string }{
+		{"PASEP", "", "pis"},
+		{" sus ", "", "cns"},
+		{"IE", "SP", "ie-sp"},
+		{"cpf", "", docCPF},
+	} {
+		key, _, err := documentType(tt.name, tt.state)
+		if err != nil || key != tt.key {
+			t.Errorf("documentType(%q, %q) = %q, %v, want %q", tt.name, tt.state, key, err, tt.key)
+		}
+	}
+}
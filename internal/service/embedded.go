@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// EmbeddedNats runs a NATS server inside the process, for local
+// development, demos and integration tests without an external server.
+type EmbeddedNats struct {
+	Enabled   bool   `yaml:"enabled"`
+	Host      string `yaml:"host"`
+	Port      int    `yaml:"port"`
+	JetStream bool   `yaml:"jetstream"`
+	StoreDir  string `yaml:"storeDir"`
+}
+
+// embeddedStartTimeout bounds how long the embedded server may take to accept clients.
+const embeddedStartTimeout = 5 * time.Second
+
+// startEmbeddedNats starts the server. A port of 0 picks the default 4222
+// and a negative port only accepts in process connections.
+func startEmbeddedNats(cfg EmbeddedNats) (*server.Server, error) {
+	opts := &server.Options{
+		ServerName: "embedded",
+		Host:       cfg.Host,
+		Port:       cfg.Port,
+		JetStream:  cfg.JetStream,
+		StoreDir:   cfg.StoreDir,
+		NoSigs:     true,
+	}
+
+	if opts.Host == "" {
+		opts.Host = "127.0.0.1"
+	}
+	if cfg.Port < 0 {
+		opts.DontListen = true
+	}
+
+	ns, err := server.NewServer(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedded NATS server: %w", err)
+	}
+
+	go ns.Start()
+
+	if !ns.ReadyForConnections(embeddedStartTimeout) {
+		ns.Shutdown()
+		return nil, fmt.Errorf("embedded NATS server not ready after %s", embeddedStartTimeout)
+	}
+
+	if opts.DontListen {
+		log.Println("embedded NATS server running (in process only)")
+	} else {
+		log.Printf("embedded NATS server listening on %s", ns.ClientURL())
+	}
+
+	return ns, nil
+}
+
+// shutdownEmbedded stops the embedded server when this config started it.
+func (c *ConfigService) shutdownEmbedded() {
+	if !c.ownsServer || c.natsServer == nil {
+		return
+	}
+
+	c.natsServer.Shutdown()
+	c.natsServer.WaitForShutdown()
+	c.ownsServer = false
+	log.Println("embedded NATS server stopped")
+}
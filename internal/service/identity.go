@@ -1,12 +1,14 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 
 	"github.com/dyammarcano/gin-nats-starter/internal/model"
-	"github.com/nats-io/nats.go"
 
 	"github.com/spf13/cobra"
 	"gorm.io/driver/sqlite"
@@ -18,20 +20,54 @@ func newDatabase(cfg *ConfigService) (*gorm.DB, error) {
 		return nil, fmt.Errorf("database path required")
 	}
 
-	db, err := gorm.Open(sqlite.Open(cfg.Database.DBPath), &gorm.Config{})
+	if err := os.MkdirAll(filepath.Dir(cfg.Database.DBPath), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// the cep and identity workers may share the file, so writers wait for
+	// each other instead of failing with SQLITE_BUSY
+	dsn := cfg.Database.DBPath + "?_busy_timeout=5000&_journal_mode=WAL"
+	// TranslateError reports unique index violations as gorm.ErrDuplicatedKey
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 	return db, nil
 }
 
-func Identity(cmd *cobra.Command, args []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	cfg, err := serviceCommon(cmd.Context(), configStr)
+func closeDatabase(db *gorm.DB) shutdownFunc {
+	return func(context.Context) error {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.Close()
+	}
+}
+
+func Identity(cmd *cobra.Command, _ []string) error {
+	cfg, err := serviceCommon(cmd)
 	if err != nil {
 		return err
 	}
 
+	return runIdentity(cfg)
+}
+
+func runIdentity(cfg *ConfigService) error {
+	pii, err := newPIICipher(cfg.Database.Encryption)
+	if err != nil {
+		return fmt.Errorf("failed to load encryption keys: %w", err)
+	}
+	signer, err := newReceiptSigner(cfg.Privacy)
+	if err != nil {
+		return fmt.Errorf("failed to load receipt key: %w", err)
+	}
+	token, err := secretValue(cfg.Privacy.Token)
+	if err != nil {
+		return fmt.Errorf("failed to load privacy token: %w", err)
+	}
+
 	db, err := newDatabase(cfg)
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
@@ -39,46 +75,69 @@ func Identity(cmd *cobra.Command, args []string) error {
 
 	if err := db.AutoMigrate(
 		&model.Identity{},
+		&model.IdentityTransition{},
+		&model.Address{},
+		&model.PrivacyAudit{},
 		&model.CEP{},
 	); err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
-	_, err = cfg.nc.QueueSubscribe("service.identity", "identity-workers", identityWorkers(db))
-	if err != nil {
+	var clear int64
+	if err := db.Model(&model.Identity{}).Unscoped().Where("data_key = '' OR data_key IS NULL").Count(&clear).Error; err != nil {
+		return fmt.Errorf("failed to count unencrypted identities: %w", err)
+	}
+	if clear > 0 {
+		log.Printf("[identity] %d identities are stored unencrypted and cannot be looked up by document; run rekey", clear)
+	}
+
+	w := NewWorker("identity", "service.identity", validateIdentity(db, pii))
+	crud, routes := identityWorkers(db, cfg.nc, pii)
+	priv, privRoutes := privacyWorkers(db, cfg.nc, pii, signer, token)
+	routes = append(routes, privRoutes...)
+	svc := NewService("identity", "Identity records").Add(w).Add(crud...).Add(priv...)
+	if err := svc.Start(cfg.ctx, cfg.nc); err != nil {
+		return err
+	}
+
+	if err := cfg.announceRoutes("identity", routes); err != nil {
 		return err
 	}
 
 	log.Println("Identity service listening")
-	select {}
+	return cfg.waitForShutdown("identity", svc.Stop, cfg.drain, closeDatabase(db))
 }
 
-func identityWorkers(db *gorm.DB) func(m *nats.Msg) {
-	return func(m *nats.Msg) {
-		log.Printf("[identity] headers=%v data=%s", m.Header, string(m.Data))
-
-		var ident model.Identity
+// IdentityRequest is the body accepted by service.identity.
+type IdentityRequest struct {
+	Document string `json:"document" pattern:"^([0-9]{11}|[0-9]{14})$"`
+}
 
-		if _, ok := m.Header["scheme"]; ok {
-			b, _ := json.Marshal(ident)
-			_ = m.RespondMsg(&nats.Msg{Data: b, Header: nats.Header{"schema": {string(b)}}})
-			return
-		}
+// IdentityResponse reports whether the document looks valid and the name on record.
+type IdentityResponse struct {
+	Valid     bool   `json:"valid"`
+	FoundName string `json:"found_name"`
+}
 
-		var req map[string]string
-		if err := json.Unmarshal(m.Data, &req); err != nil {
-			_ = m.Respond([]byte(`{"error":"bad request"}`))
-			return
-		}
+func validateIdentity(db *gorm.DB, pii *piiCipher) HandlerFunc[IdentityRequest, *IdentityResponse] {
+	return func(ctx context.Context, req *Request[IdentityRequest]) (*IdentityResponse, error) {
+		var ident model.Identity
 
-		docQ := req["document"]
+		docQ := req.Body.Document
 		valid := false
 		if len(docQ) == 11 || len(docQ) == 14 {
 			valid = true
 		}
 
-		_ = db.First(&ident, "cpf = ? OR cnpj = ?", docQ, docQ)
-		b, _ := json.Marshal(map[string]any{"valid": valid, "found_name": ident.Name})
-		_ = m.Respond(b)
+		err := db.WithContext(ctx).First(&ident, "cpf_index = ? OR cnpj_index = ?",
+			pii.blindIndex(docCPF, docQ), pii.blindIndex(docCNPJ, docQ)).Error
+		if err == nil {
+			err = pii.open(&ident)
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[identity] error looking up document: %v", err)
+			ident.Name = ""
+		}
+		return &IdentityResponse{Valid: valid, FoundName: ident.Name}, nil
 	}
 }
@@ -0,0 +1,442 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultIdentityPageSize = 20
+	maxIdentityPageSize     = 100
+)
+
+// IdentityRecord is the public form of model.Identity; ID is its UUID and
+// Status its verification state.
+type IdentityRecord struct {
+	ID        string         `json:"id"`
+	Name      string         `json:"name"`
+	CPF       string         `json:"cpf,omitempty"`
+	CNPJ      string         `json:"cnpj,omitempty"`
+	Status    string         `json:"status"`
+	Verified  bool           `json:"verified"`
+	Address   *AddressRecord `json:"address,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// createdIdentity is the reply of a create, sent with status 201.
+type createdIdentity struct {
+	*IdentityRecord
+}
+
+func (createdIdentity) StatusCode() int {
+	return http.StatusCreated
+}
+
+// deletedIdentity is the empty reply of a delete, sent with status 204.
+type deletedIdentity struct{}
+
+func (deletedIdentity) StatusCode() int {
+	return http.StatusNoContent
+}
+
+// IdentityCreateRequest is the body accepted by service.identity.create.
+// At least one of CPF and CNPJ is required; both are stored unmasked.
+// Identities start pending and are verified by service.identity.verify.
+type IdentityCreateRequest struct {
+	Name    string          `json:"name"`
+	CPF     string          `json:"cpf,omitempty"`
+	CNPJ    string          `json:"cnpj,omitempty"`
+	Address *AddressRequest `json:"address,omitempty"`
+}
+
+// IdentityIDRequest names an identity by UUID. Gateway routes pass it as
+// the {id} path parameter instead.
+type IdentityIDRequest struct {
+	ID string `json:"id,omitempty"`
+}
+
+// IdentityUpdateRequest is the body accepted by service.identity.update.
+// Only the fields present are changed; an empty document clears it.
+// An address replaces the current one. Changing a document or the address
+// sends the identity back to pending verification.
+type IdentityUpdateRequest struct {
+	ID      string          `json:"id,omitempty"`
+	Name    *string         `json:"name,omitempty"`
+	CPF     *string         `json:"cpf,omitempty"`
+	CNPJ    *string         `json:"cnpj,omitempty"`
+	Address *AddressRequest `json:"address,omitempty"`
+}
+
+// IdentityListRequest is the body accepted by service.identity.list; GET
+// routes pass the same fields as query parameters instead. Name matches the
+// whole name ignoring case and accents, since names are stored encrypted;
+// Document matches either the CPF or the CNPJ and Status the verification
+// state.
+type IdentityListRequest struct {
+	Page     int    `json:"page,omitempty"`
+	PageSize int    `json:"page_size,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Document string `json:"document,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Verified *bool  `json:"verified,omitempty"`
+}
+
+// IdentityListResponse is a page of identities and the total matching.
+type IdentityListResponse struct {
+	Items    []IdentityRecord `json:"items"`
+	Page     int              `json:"page"`
+	PageSize int              `json:"page_size"`
+	Total    int64            `json:"total"`
+}
+
+// identityWorkers returns the CRUD and verification endpoints of
+// service.identity and the routes they announce.
+func identityWorkers(db *gorm.DB, nc *nats.Conn, pii *piiCipher) ([]endpoint, []AnnouncedRoute) {
+	v := &verifier{db: db, nc: nc, pii: pii}
+	create := NewWorker("identity-create", "service.identity.create", createIdentity(db, nc, pii))
+	get := NewWorker("identity-get", "service.identity.get", getIdentity(db, pii))
+	update := NewWorker("identity-update", "service.identity.update", updateIdentity(v))
+	remove := NewWorker("identity-delete", "service.identity.delete", deleteIdentity(db, pii))
+	list := NewWorker("identity-list", "service.identity.list", listIdentities(db, pii))
+	verify := NewWorker("identity-verify", "service.identity.verify", verifyIdentity(v))
+	history := NewWorker("identity-transitions", "service.identity.transitions", listTransitions(db, pii))
+
+	listRoute := list.Route(http.MethodGet, "/identities", "3s")
+	listRoute.Query = []string{"page", "page_size", "name", "document", "status", "verified"}
+
+	return []endpoint{create, get, update, remove, list, verify, history}, []AnnouncedRoute{
+		create.Route(http.MethodPost, "/identities", "3s"),
+		get.Route(http.MethodGet, "/identities/{id}", "3s"),
+		update.Route(http.MethodPatch, "/identities/{id}", "3s"),
+		remove.Route(http.MethodDelete, "/identities/{id}", "3s"),
+		listRoute,
+		verify.Route(http.MethodPost, "/identities/{id}/verify", "10s"),
+		history.Route(http.MethodGet, "/identities/{id}/transitions", "3s"),
+	}
+}
+
+func createIdentity(db *gorm.DB, nc *nats.Conn, pii *piiCipher) HandlerFunc[IdentityCreateRequest, *createdIdentity] {
+	return func(ctx context.Context, req *Request[IdentityCreateRequest]) (*createdIdentity, error) {
+		body := req.Body
+		ident := model.Identity{
+			UUID:   uuid.NewString(),
+			Name:   strings.TrimSpace(body.Name),
+			Status: statusPending,
+		}
+		if ident.Name == "" {
+			return nil, errBadRequest("missing name")
+		}
+
+		var err error
+		if ident.CPF, err = identityDocument(docCPF, body.CPF); err != nil {
+			return nil, err
+		}
+		if ident.CNPJ, err = identityDocument(docCNPJ, body.CNPJ); err != nil {
+			return nil, err
+		}
+		if err := checkIdentityDocuments(ctx, db, pii, &ident); err != nil {
+			return nil, err
+		}
+		if body.Address != nil {
+			if ident.Address, err = resolveAddress(ctx, nc, body.Address); err != nil {
+				return nil, err
+			}
+		}
+
+		row, err := pii.seal(&ident)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.WithContext(ctx).Create(row).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return nil, documentConflict(ctx, db, pii, &ident)
+			}
+			return nil, err
+		}
+		ident.Model = row.Model
+
+		return &createdIdentity{identityRecord(&ident)}, nil
+	}
+}
+
+func getIdentity(db *gorm.DB, pii *piiCipher) HandlerFunc[IdentityIDRequest, *IdentityRecord] {
+	return func(ctx context.Context, req *Request[IdentityIDRequest]) (*IdentityRecord, error) {
+		ident, err := findIdentity(ctx, db, pii, identityID(req, req.Body.ID))
+		if err != nil {
+			return nil, err
+		}
+		return identityRecord(ident), nil
+	}
+}
+
+func updateIdentity(v *verifier) HandlerFunc[IdentityUpdateRequest, *IdentityRecord] {
+	db := v.db
+	return func(ctx context.Context, req *Request[IdentityUpdateRequest]) (*IdentityRecord, error) {
+		body := req.Body
+		ident, err := findIdentity(ctx, db, v.pii, identityID(req, body.ID))
+		if err != nil {
+			return nil, err
+		}
+		cpf, cnpj, address := ident.CPF, ident.CNPJ, ident.Address
+
+		if body.Name != nil {
+			if ident.Name = strings.TrimSpace(*body.Name); ident.Name == "" {
+				return nil, errBadRequest("name cannot be empty")
+			}
+		}
+		if body.CPF != nil {
+			if ident.CPF, err = identityDocument(docCPF, *body.CPF); err != nil {
+				return nil, err
+			}
+		}
+		if body.CNPJ != nil {
+			if ident.CNPJ, err = identityDocument(docCNPJ, *body.CNPJ); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkIdentityDocuments(ctx, db, v.pii, ident); err != nil {
+			return nil, err
+		}
+		var addr *model.Address
+		if body.Address != nil {
+			if addr, err = resolveAddress(ctx, v.nc, body.Address); err != nil {
+				return nil, err
+			}
+		}
+
+		row, err := v.pii.seal(ident)
+		if err != nil {
+			return nil, err
+		}
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(row).Select(sealedColumns).Updates(row).Error; err != nil {
+				return err
+			}
+			if addr == nil {
+				return nil
+			}
+			if ident.Address != nil {
+				addr.ID, addr.CreatedAt = ident.Address.ID, ident.Address.CreatedAt
+			}
+			addr.IdentityID = ident.ID
+			return tx.Save(addr).Error
+		})
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, documentConflict(ctx, db, v.pii, ident)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ident.UpdatedAt = row.UpdatedAt
+		if addr != nil {
+			ident.Address = addr
+		}
+
+		// the verification covered the old documents and address
+		var reason string
+		switch {
+		case ident.CPF != cpf || ident.CNPJ != cnpj:
+			reason = "documents changed"
+		case addr != nil && !sameAddress(address, addr):
+			reason = "address changed"
+		}
+		if reason != "" && ident.Status != statusPending {
+			if _, err := v.transition(ctx, ident, statusPending, reason); err != nil {
+				return nil, err
+			}
+		}
+		return identityRecord(ident), nil
+	}
+}
+
+// deleteIdentity soft deletes: the row keeps its DeletedAt and is hidden
+// from every other operation.
+func deleteIdentity(db *gorm.DB, pii *piiCipher) HandlerFunc[IdentityIDRequest, *deletedIdentity] {
+	return func(ctx context.Context, req *Request[IdentityIDRequest]) (*deletedIdentity, error) {
+		ident, err := findIdentity(ctx, db, pii, identityID(req, req.Body.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := db.WithContext(ctx).Delete(ident).Error; err != nil {
+			return nil, err
+		}
+		log.Printf("[identity-delete] deleted %s", ident.UUID)
+		return &deletedIdentity{}, nil
+	}
+}
+
+func listIdentities(db *gorm.DB, pii *piiCipher) HandlerFunc[IdentityListRequest, *IdentityListResponse] {
+	return func(ctx context.Context, req *Request[IdentityListRequest]) (*IdentityListResponse, error) {
+		body := req.Body
+		if body.Page == 0 {
+			body.Page, _ = strconv.Atoi(req.Param(paramQuery, "page"))
+		}
+		if body.PageSize == 0 {
+			body.PageSize, _ = strconv.Atoi(req.Param(paramQuery, "page_size"))
+		}
+		if body.Name == "" {
+			body.Name = req.Param(paramQuery, "name")
+		}
+		if body.Document == "" {
+			body.Document = req.Param(paramQuery, "document")
+		}
+		if body.Status == "" {
+			body.Status = req.Param(paramQuery, "status")
+		}
+		if v := req.Param(paramQuery, "verified"); body.Verified == nil && v != "" {
+			verified, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, errBadRequest("verified must be true or false")
+			}
+			body.Verified = &verified
+		}
+
+		if body.Page <= 0 {
+			body.Page = 1
+		}
+		if body.PageSize <= 0 {
+			body.PageSize = defaultIdentityPageSize
+		}
+		body.PageSize = min(body.PageSize, maxIdentityPageSize)
+
+		q := db.WithContext(ctx).Model(&model.Identity{})
+		if name := strings.TrimSpace(body.Name); name != "" {
+			q = q.Where("name_index = ?", pii.nameIndex(name))
+		}
+		if doc := strings.ToUpper(unmask(body.Document)); doc != "" {
+			q = q.Where("cpf_index = ? OR cnpj_index = ?", pii.blindIndex(docCPF, doc), pii.blindIndex(docCNPJ, doc))
+		}
+		if body.Status != "" {
+			q = q.Where("status = ?", body.Status)
+		}
+		if body.Verified != nil {
+			q = q.Where("verified = ?", *body.Verified)
+		}
+
+		resp := &IdentityListResponse{Items: []IdentityRecord{}, Page: body.Page, PageSize: body.PageSize}
+		if err := q.Count(&resp.Total).Error; err != nil {
+			return nil, err
+		}
+
+		var idents []model.Identity
+		err := q.Order("id").Offset((body.Page - 1) * body.PageSize).Limit(body.PageSize).Preload("Address").Find(&idents).Error
+		if err != nil {
+			return nil, err
+		}
+		for i := range idents {
+			if err := pii.open(&idents[i]); err != nil {
+				return nil, err
+			}
+			resp.Items = append(resp.Items, *identityRecord(&idents[i]))
+		}
+
+		return resp, nil
+	}
+}
+
+// identityID takes the UUID from the body, or else from the {id} path parameter.
+func identityID[T any](req *Request[T], id string) string {
+	if id == "" {
+		id = req.Param(paramPath, "id")
+	}
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+func findIdentity(ctx context.Context, db *gorm.DB, pii *piiCipher, id string) (*model.Identity, error) {
+	if id == "" {
+		return nil, errBadRequest("missing id")
+	}
+	if err := uuid.Validate(id); err != nil {
+		return nil, errBadRequest("invalid id")
+	}
+
+	var ident model.Identity
+	err := db.WithContext(ctx).Preload("Address").Where("uuid = ?", id).First(&ident).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errNotFound("identity %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := pii.open(&ident); err != nil {
+		return nil, err
+	}
+	return &ident, nil
+}
+
+// identityDocument validates a CPF or CNPJ and returns it unmasked; an
+// empty document stays empty.
+func identityDocument(docType, doc string) (string, error) {
+	doc = strings.TrimSpace(doc)
+	if doc == "" {
+		return "", nil
+	}
+
+	if !documentTypes[docType].Validate(doc) {
+		return "", errUnprocessable("%s invalid", docType)
+	}
+	return strings.ToUpper(unmask(doc)), nil
+}
+
+// checkIdentityDocuments requires a document and rejects one already used
+// by another identity.
+func checkIdentityDocuments(ctx context.Context, db *gorm.DB, pii *piiCipher, ident *model.Identity) error {
+	if ident.CPF == "" && ident.CNPJ == "" {
+		return errBadRequest("cpf or cnpj is required")
+	}
+
+	for column, doc := range map[string]string{"cpf": ident.CPF, "cnpj": ident.CNPJ} {
+		if doc == "" {
+			continue
+		}
+
+		var n int64
+		err := db.WithContext(ctx).Model(&model.Identity{}).
+			Where(column+"_index = ? AND uuid <> ?", pii.blindIndex(column, doc), ident.UUID).
+			Count(&n).Error
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return errConflict("%s already registered", column)
+		}
+	}
+	return nil
+}
+
+// documentConflict answers a write rejected by the unique indexes on the
+// documents: another request registered one of them after they were
+// checked.
+func documentConflict(ctx context.Context, db *gorm.DB, pii *piiCipher, ident *model.Identity) error {
+	if err := checkIdentityDocuments(ctx, db, pii, ident); err != nil {
+		return err
+	}
+	return errConflict("document already registered")
+}
+
+func identityRecord(ident *model.Identity) *IdentityRecord {
+	return &IdentityRecord{
+		ID:        ident.UUID,
+		Name:      ident.Name,
+		CPF:       ident.CPF,
+		CNPJ:      ident.CNPJ,
+		Status:    ident.Status,
+		Verified:  ident.Verified,
+		Address:   addressRecord(ident.Address),
+		CreatedAt: ident.CreatedAt,
+		UpdatedAt: ident.UpdatedAt,
+	}
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// testPII builds a cipher with random keys, the active one named main.
+func testPII(t *testing.T) *piiCipher {
+	t.Helper()
+	for _, name := range []string{"TEST_PII_KEY_MAIN", "TEST_PII_INDEX_KEY"} {
+		key := make([]byte, piiKeySize)
+		_, _ = rand.Read(key)
+		t.Setenv(name, base64.StdEncoding.EncodeToString(key))
+	}
+
+	pii, err := newPIICipher(EncryptionConfig{
+		ActiveKey: "main",
+		Keys:      map[string]string{"main": "env:TEST_PII_KEY_MAIN"},
+		IndexKey:  "env:TEST_PII_INDEX_KEY",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pii
+}
+
+func identityDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	return testDB(t, &model.Identity{}, &model.Address{}, &model.IdentityTransition{})
+}
+
+func wantStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var svcErr *ServiceError
+	if !errors.As(err, &svcErr) || svcErr.Status != status {
+		t.Fatalf("err = %v, want %d", err, status)
+	}
+}
+
+const (
+	testCPF  = "52998224725"
+	testCNPJ = "11222333000181"
+)
+
+func TestIdentityDocumentsUnique(t *testing.T) {
+	db := identityDB(t)
+	pii := testPII(t)
+	ctx := context.Background()
+
+	create := func(ident model.Identity) error {
+		ident.UUID = uuid.NewString()
+		row, err := pii.seal(&ident)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.Create(row).Error
+	}
+
+	if err := create(model.Identity{Name: "Ana", CPF: testCPF}); err != nil {
+		t.Fatal(err)
+	}
+	if err := create(model.Identity{Name: "Empresa", CNPJ: testCNPJ}); err != nil {
+		t.Fatal(err)
+	}
+	// identities without one of the documents do not collide on it
+	if err := create(model.Identity{Name: "Outra", CNPJ: "11444777000161"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ident := range []model.Identity{{Name: "Bia", CPF: testCPF}, {Name: "Outra empresa", CNPJ: testCNPJ}} {
+		if err := create(ident); !errors.Is(err, gorm.ErrDuplicatedKey) {
+			t.Fatalf("duplicate %+v: err = %v, want gorm.ErrDuplicatedKey", ident, err)
+		}
+		wantStatus(t, documentConflict(ctx, db, pii, &ident), http.StatusConflict)
+	}
+
+	// a deleted identity frees its documents
+	if err := db.Where("cpf_index = ?", pii.blindIndex(docCPF, testCPF)).Delete(&model.Identity{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := create(model.Identity{Name: "Bia", CPF: testCPF}); err != nil {
+		t.Fatalf("document of a deleted identity: %v", err)
+	}
+}
+
+func TestCreateIdentityConcurrent(t *testing.T) {
+	db := identityDB(t)
+	create := createIdentity(db, nil, testPII(t))
+
+	errs := make([]error, 8)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = create(context.Background(), &Request[IdentityCreateRequest]{
+				Body: IdentityCreateRequest{Name: "Ana", CPF: "529.982.247-25"},
+			})
+		}()
+	}
+	wg.Wait()
+
+	created := 0
+	for _, err := range errs {
+		if err == nil {
+			created++
+			continue
+		}
+		wantStatus(t, err, http.StatusConflict)
+	}
+	if created != 1 {
+		t.Fatalf("%d identities created with the same cpf, want 1", created)
+	}
+}
+
+func TestUpdateIdentityAddress(t *testing.T) {
+	db := identityDB(t)
+	nc := testNats(t)
+	v := &verifier{db: db, nc: nc, pii: testPII(t)}
+	update := updateIdentity(v)
+	ctx := context.Background()
+
+	events, err := nc.SubscribeSync(subjectIdentityEvents + ".>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ident := model.Identity{
+		UUID:     uuid.NewString(),
+		Name:     "Ana",
+		CPF:      testCPF,
+		Status:   statusVerified,
+		Verified: true,
+		Address:  &model.Address{CEP: "01001000", Street: "Praça da Sé", Number: "1", Neighborhood: "Sé", City: "São Paulo", State: "SP"},
+	}
+	row, err := v.pii.seal(&ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(row).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	address := func(number string) *AddressRequest {
+		return &AddressRequest{CEP: "01001-000", Street: "Praça da Sé", Number: number, Neighborhood: "Sé", City: "São Paulo", State: "SP"}
+	}
+	name := "Ana Maria"
+
+	tests := []struct {
+		name   string
+		body   IdentityUpdateRequest
+		status string
+	}{
+		{"name", IdentityUpdateRequest{Name: &name}, statusVerified},
+		{"same address", IdentityUpdateRequest{Address: address("1")}, statusVerified},
+		{"new address", IdentityUpdateRequest{Address: address("2")}, statusPending},
+	}
+	for _, tt := range tests {
+		tt.body.ID = ident.UUID
+		got, err := update(ctx, &Request[IdentityUpdateRequest]{Body: tt.body})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got.Status != tt.status {
+			t.Fatalf("%s: status = %s, want %s", tt.name, got.Status, tt.status)
+		}
+	}
+
+	var transitions []model.IdentityTransition
+	if err := db.Find(&transitions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(transitions) != 1 || transitions[0].From != statusVerified || transitions[0].Reason != "address changed" {
+		t.Fatalf("transitions = %+v, want one from verified for the address", transitions)
+	}
+
+	msg, err := events.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event IdentityEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Subject != subjectIdentityEvents+"."+statusPending || event.ID != ident.UUID || event.Reason != "address changed" {
+		t.Fatalf("event on %s: %+v", msg.Subject, event)
+	}
+}
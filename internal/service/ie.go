@@ -0,0 +1,232 @@
+package service
+
+import (
+	"slices"
+	"strings"
+)
+
+// ieStates holds the Inscrição Estadual rules of each state, as published
+// by SINTEGRA. Only the current formats are accepted; rural producer
+// numbers of São Paulo are not.
+var ieStates = map[string]*digitDocument{
+	"ac": {lengths: []int{13}, prefix: "01", mask: "##.###.###/###-##", complete: completeIE13},
+	"al": {lengths: []int{9}, prefix: "24", accept: ieAL, complete: completeIEAL},
+	"ap": {lengths: []int{9}, prefix: "03", complete: completeIEAP},
+	"am": {lengths: []int{9}, complete: completeIE9},
+	"ba": {lengths: []int{9, 8}, mask: "#######-##", complete: completeIEBA},
+	"ce": {lengths: []int{9}, complete: completeIE9},
+	"df": {lengths: []int{13}, prefix: "07", mask: "##.######.###-##", complete: completeIE13},
+	"es": {lengths: []int{9}, complete: completeIE9},
+	"go": {lengths: []int{9}, accept: ieGO, mask: "##.###.###-#", complete: completeIEGO},
+	"ma": {lengths: []int{9}, prefix: "12", complete: completeIE9},
+	"mt": {lengths: []int{11}, complete: completeIEMT},
+	"ms": {lengths: []int{9}, accept: ieMS, complete: completeIE9},
+	"mg": {lengths: []int{13}, mask: "###.###.###/####", complete: completeIEMG},
+	"pa": {lengths: []int{9}, prefix: "15", complete: completeIE9},
+	"pb": {lengths: []int{9}, complete: completeIE9},
+	"pr": {lengths: []int{10}, mask: "########-##", complete: completeIEPR},
+	"pe": {lengths: []int{9}, mask: "#######-##", complete: completeIEPE},
+	"pi": {lengths: []int{9}, complete: completeIE9},
+	"rj": {lengths: []int{8}, mask: "##.###.##-#", complete: completeIERJ},
+	"rn": {lengths: []int{9, 10}, prefix: "20", complete: completeIERN},
+	"rs": {lengths: []int{10}, mask: "###/#######", complete: completeIERS},
+	"ro": {lengths: []int{14}, complete: completeIERO},
+	"rr": {lengths: []int{9}, prefix: "24", complete: completeIERR},
+	"sc": {lengths: []int{9}, mask: "###.###.###", complete: completeIE9},
+	"sp": {lengths: []int{12}, mask: "###.###.###.###", complete: completeIESP},
+	"se": {lengths: []int{9}, complete: completeIE9},
+	"to": {lengths: []int{9, 11}, accept: ieTO, complete: completeIETO},
+}
+
+func init() {
+	for uf, t := range ieStates {
+		t.label = "Inscrição Estadual (" + strings.ToUpper(uf) + ")"
+		registerDocumentType("ie-"+uf, t)
+	}
+}
+
+// completeIE9 is the rule shared by most states: 8 digits weighted 9 to 2
+// and a modulo 11 check digit.
+func completeIE9(d []int) {
+	d[8] = mod11(weightedSum(d, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+// completeIE13 is used by Acre and the Distrito Federal.
+func completeIE13(d []int) {
+	d[11] = mod11(weightedSum(d, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2))
+	d[12] = mod11(weightedSum(d, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+// ieAL accepts the company types of Alagoas in the third digit.
+func ieAL(d []int) bool {
+	return slices.Contains([]int{0, 3, 5, 7, 8}, d[2])
+}
+
+func completeIEAL(d []int) {
+	d[8] = (weightedSum(d, 9, 8, 7, 6, 5, 4, 3, 2) * 10) % 11 % 10
+}
+
+// completeIEAP adds a constant and picks the digit replacing 11 according
+// to the range the number falls in.
+func completeIEAP(d []int) {
+	n := digitsValue(d[:8])
+	p, dd := 0, 0
+	switch {
+	case n >= 3000001 && n <= 3017000:
+		p, dd = 5, 0
+	case n >= 3017001 && n <= 3019022:
+		p, dd = 9, 1
+	}
+
+	switch r := 11 - (p+weightedSum(d, 9, 8, 7, 6, 5, 4, 3, 2))%11; r {
+	case 10:
+		d[8] = 0
+	case 11:
+		d[8] = dd
+	default:
+		d[8] = r
+	}
+}
+
+// completeIEBA handles the 8 and 9 digit numbers of Bahia. The last check
+// digit is computed first, and the modulo is 11 when the number starts
+// with 6, 7 or 9 (its second digit for 9 digit numbers) and 10 otherwise.
+func completeIEBA(d []int) {
+	base := len(d) - 2
+	lead := d[0]
+	if len(d) == 9 {
+		lead = d[1]
+	}
+
+	digit := func(sum int) int {
+		if lead == 6 || lead == 7 || lead == 9 {
+			return mod11(sum)
+		}
+		return (10 - sum%10) % 10
+	}
+
+	sum := 0
+	for i := range base {
+		sum += d[i] * (base + 1 - i)
+	}
+	d[base+1] = digit(sum)
+
+	sum = d[base+1] * 2
+	for i := range base {
+		sum += d[i] * (base + 2 - i)
+	}
+	d[base] = digit(sum)
+}
+
+// ieGO accepts the prefixes assigned in Goiás.
+func ieGO(d []int) bool {
+	p := d[0]*10 + d[1]
+	return p == 10 || p == 11 || p == 15 || (p >= 20 && p <= 29)
+}
+
+func completeIEGO(d []int) {
+	switch r := weightedSum(d, 9, 8, 7, 6, 5, 4, 3, 2) % 11; r {
+	case 0:
+		d[8] = 0
+	case 1:
+		d[8] = 0
+		if n := digitsValue(d[:8]); n >= 10103105 && n <= 10119997 {
+			d[8] = 1
+		}
+	default:
+		d[8] = 11 - r
+	}
+}
+
+func completeIEMT(d []int) {
+	d[10] = mod11(weightedSum(d, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+// ieMS accepts the 28 prefix and the 50 one used since 2021.
+func ieMS(d []int) bool {
+	p := d[0]*10 + d[1]
+	return p == 28 || p == 50
+}
+
+// completeIEMG computes the first digit by inserting a 0 after the city
+// code and summing the digits of the products by 1 and 2 alternately.
+func completeIEMG(d []int) {
+	padded := slices.Concat(d[:3], []int{0}, d[3:11])
+	sum := 0
+	for i, v := range padded {
+		p := v * (1 + i%2)
+		sum += p/10 + p%10
+	}
+	d[11] = (10 - sum%10) % 10
+	d[12] = mod11(weightedSum(d, 3, 2, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+func completeIEPR(d []int) {
+	d[8] = mod11(weightedSum(d, 3, 2, 7, 6, 5, 4, 3, 2))
+	d[9] = mod11(weightedSum(d, 4, 3, 2, 7, 6, 5, 4, 3, 2))
+}
+
+func completeIEPE(d []int) {
+	d[7] = mod11(weightedSum(d, 8, 7, 6, 5, 4, 3, 2))
+	d[8] = mod11(weightedSum(d, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+func completeIERJ(d []int) {
+	d[7] = mod11(weightedSum(d, 2, 7, 6, 5, 4, 3, 2))
+}
+
+// completeIERN handles the 9 and 10 digit numbers of Rio Grande do Norte.
+func completeIERN(d []int) {
+	sum := 0
+	for i := range len(d) - 1 {
+		sum += d[i] * (len(d) - i)
+	}
+	d[len(d)-1] = (sum * 10) % 11 % 10
+}
+
+func completeIERS(d []int) {
+	d[9] = mod11(weightedSum(d, 2, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+// completeIERO keeps only the units of 10 and 11.
+func completeIERO(d []int) {
+	d[13] = (11 - weightedSum(d, 6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2)%11) % 10
+}
+
+func completeIERR(d []int) {
+	d[8] = weightedSum(d, 1, 2, 3, 4, 5, 6, 7, 8) % 9
+}
+
+// completeIESP computes the digits of São Paulo, the first one in the
+// ninth position, keeping the units of the remainder.
+func completeIESP(d []int) {
+	d[8] = weightedSum(d, 1, 3, 4, 5, 6, 7, 8, 10) % 11 % 10
+	d[11] = weightedSum(d, 3, 2, 10, 9, 8, 7, 6, 5, 4, 3, 2) % 11 % 10
+}
+
+// ieTO accepts the company types 01, 02, 03 and 99 in the third and fourth
+// digits of the 11 digit format.
+func ieTO(d []int) bool {
+	if len(d) != 11 {
+		return true
+	}
+	t := d[2]*10 + d[3]
+	return t == 1 || t == 2 || t == 3 || t == 99
+}
+
+// completeIETO skips the company type of the 11 digit format.
+func completeIETO(d []int) {
+	base := d[:8]
+	if len(d) == 11 {
+		base = slices.Concat(d[:2], d[4:10])
+	}
+	d[len(d)-1] = mod11(weightedSum(base, 9, 8, 7, 6, 5, 4, 3, 2))
+}
+
+func digitsValue(d []int) int {
+	n := 0
+	for _, v := range d {
+		n = n*10 + v
+	}
+	return n
+}
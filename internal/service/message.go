@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Headers set by the gateway on every request message. OpenAPI parameters
+// are forwarded as "<In>-<name>", e.g. a path parameter {cep} arrives as
+// "Path-cep" and a query parameter ?page=2 as "Query-page".
+const (
+	headerMethod = "Http-Method"
+	headerRoute  = "Http-Route"
+
+	headerPathPrefix   = "Path-"
+	headerQueryPrefix  = "Query-"
+	headerHeaderPrefix = "Header-"
+	headerCookiePrefix = "Cookie-"
+)
+
+// Headers understood by the gateway on reply messages. "Status" is reserved
+// by NATS for protocol status codes, so the HTTP status travels as
+// "Status-Code". Any "Response-<Name>" header is returned to the client as
+// "<Name>".
+const (
+	headerStatusCode     = "Status-Code"
+	headerContentType    = "Content-Type"
+	headerResponsePrefix = "Response-"
+
+	// set by nats.go micro services when a handler replies with an error
+	headerServiceError     = "Nats-Service-Error"
+	headerServiceErrorCode = "Nats-Service-Error-Code"
+)
+
+// Parameter locations as declared by the OpenAPI "in" field.
+const (
+	paramPath   = "path"
+	paramQuery  = "query"
+	paramHeader = "header"
+	paramCookie = "cookie"
+)
+
+var paramPrefixes = map[string]string{
+	paramPath:   headerPathPrefix,
+	paramQuery:  headerQueryPrefix,
+	paramHeader: headerHeaderPrefix,
+	paramCookie: headerCookiePrefix,
+}
+
+var templateParam = regexp.MustCompile(`\{([^}/]+)\}`)
+
+// ginPath converts an OpenAPI path template (/lookup/cep/{cep}) into the
+// gin route syntax (/lookup/cep/:cep).
+func ginPath(p string) string {
+	return templateParam.ReplaceAllString(p, ":$1")
+}
+
+// paramHeaderKey returns the NATS header carrying the given parameter.
+func paramHeaderKey(in, name string) string {
+	return paramPrefixes[in] + name
+}
+
+// msgParam reads a forwarded OpenAPI parameter from request headers.
+func msgParam(h micro.Headers, in, name string) string {
+	return h.Get(paramHeaderKey(in, name))
+}
+
+// replyStatus resolves the HTTP status a reply message asks for, defaulting
+// to 200 when the responder did not set one.
+func replyStatus(m *nats.Msg) int {
+	if m.Header == nil {
+		return http.StatusOK
+	}
+
+	for _, key := range []string{headerStatusCode, headerServiceErrorCode} {
+		if code, err := strconv.Atoi(m.Header.Get(key)); err == nil && code >= 100 && code <= 599 {
+			return code
+		}
+	}
+
+	if m.Header.Get(headerServiceError) != "" {
+		return http.StatusInternalServerError
+	}
+
+	return http.StatusOK
+}
+
+// replyHopHeaders are never returned to the client: they describe the
+// HTTP connection or body framing, which the gateway owns. The content type
+// travels as its own reply header.
+var replyHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Content-Type":      true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Te":                true,
+	"Trailer":           true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+// replyHeaders returns the "Response-" headers of a reply with the prefix
+// stripped, leaving out replyHopHeaders.
+func replyHeaders(m *nats.Msg) map[string][]string {
+	out := make(map[string][]string)
+	for k, v := range m.Header {
+		name, ok := strings.CutPrefix(k, headerResponsePrefix)
+		if !ok || name == "" || replyHopHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			continue
+		}
+		out[name] = v
+	}
+	return out
+}
+
+// respondJSON replies to a request with v encoded as JSON and the given HTTP status.
+func respondJSON(r micro.Request, status int, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return respondRaw(r, status, "application/json", b)
+}
+
+// respondRaw replies with a pre encoded body and content type. Statuses of
+// 400 and above are sent as micro errors so they show up in $SRV.STATS.
+func respondRaw(r micro.Request, status int, contentType string, data []byte) error {
+	headers := micro.WithHeaders(micro.Headers{
+		headerStatusCode:  {strconv.Itoa(status)},
+		headerContentType: {contentType},
+	})
+
+	if status >= http.StatusBadRequest {
+		return r.Error(strconv.Itoa(status), http.StatusText(status), data, headers)
+	}
+	return r.Respond(data, headers)
+}
+
+// respondError replies with the {"error": message} body used across services.
+func respondError(r micro.Request, status int, message string) error {
+	return respondJSON(r, status, map[string]string{"error": message})
+}
+
+// serviceCallTimeout bounds a request one worker makes to another.
+const serviceCallTimeout = 3 * time.Second
+
+// requestMsg sends a request and, when nothing serves its subject, tells
+// the monitor on subjectNoResponders: the server answers those requests
+// to the requester only, so the monitor cannot see them on the bus.
+func requestMsg(ctx context.Context, nc *nats.Conn, msg *nats.Msg) (*nats.Msg, error) {
+	resp, err := nc.RequestMsgWithContext(ctx, msg)
+	if errors.Is(err, nats.ErrNoResponders) {
+		_ = nc.Publish(subjectNoResponders, []byte(msg.Subject))
+	}
+	return resp, err
+}
+
+// callService sends body to a worker subject and decodes a successful
+// reply into out, returning the reply status. Transport failures and
+// server errors are returned as errors.
+func callService(ctx context.Context, nc *nats.Conn, subject string, body, out any) (int, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, serviceCallTimeout)
+	defer cancel()
+
+	resp, err := requestMsg(ctx, nc, &nats.Msg{Subject: subject, Data: data})
+	if err != nil {
+		return 0, fmt.Errorf("error requesting %s: %w", subject, err)
+	}
+
+	status := replyStatus(resp)
+	if status >= http.StatusInternalServerError {
+		return status, fmt.Errorf("%s replied %d: %s", subject, status, string(resp.Data))
+	}
+	if status < http.StatusBadRequest {
+		if err := json.Unmarshal(resp.Data, out); err != nil {
+			return status, fmt.Errorf("error decoding %s reply: %w", subject, err)
+		}
+	}
+	return status, nil
+}
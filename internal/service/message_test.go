@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+func TestGinPath(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/health", "/health"},
+		{"/lookup/cep/{cep}", "/lookup/cep/:cep"},
+		{"/users/{id}/orders/{orderId}", "/users/:id/orders/:orderId"},
+		{"/{a}/{b}/{c}", "/:a/:b/:c"},
+		{"/files/{name}.json", "/files/:name.json"},
+		{"/v1/{tenant_id}/items", "/v1/:tenant_id/items"},
+		// braces spanning a segment are not a parameter
+		{"/odd/{a/b}", "/odd/{a/b}"},
+	}
+	for _, tt := range tests {
+		if got := ginPath(tt.in); got != tt.want {
+			t.Errorf("ginPath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestForwardParams(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	route := &Route{
+		target: "/users/{id}/orders/{orderId}",
+		method: http.MethodGet,
+		params: openapi3.Parameters{
+			{Value: openapi3.NewPathParameter("id")},
+			{Value: openapi3.NewPathParameter("orderId")},
+			{Value: openapi3.NewQueryParameter("tag")},
+			{Value: openapi3.NewQueryParameter("page")},
+			{Value: openapi3.NewHeaderParameter("X-Request-Id")},
+			{Value: openapi3.NewHeaderParameter("X-Missing")},
+			{Value: openapi3.NewCookieParameter("session")},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		header map[string]string
+		want   nats.Header
+	}{
+		{
+			name: "path params",
+			url:  "/users/42/orders/a-7",
+			want: nats.Header{
+				"Path-id":      {"42"},
+				"Path-orderId": {"a-7"},
+			},
+		},
+		{
+			name: "repeated query values",
+			url:  "/users/42/orders/a-7?tag=x&tag=y&tag=x&page=2&other=1",
+			want: nats.Header{
+				"Path-id":      {"42"},
+				"Path-orderId": {"a-7"},
+				"Query-tag":    {"x", "y", "x"},
+				"Query-page":   {"2"},
+			},
+		},
+		{
+			name:   "headers and cookies",
+			url:    "/users/42/orders/a-7?page=",
+			header: map[string]string{"X-Request-Id": "req-1", "Cookie": "session=s1; other=o", "X-Other": "no"},
+			want: nats.Header{
+				"Path-id":             {"42"},
+				"Path-orderId":        {"a-7"},
+				"Query-page":          {""},
+				"Header-X-Request-Id": {"req-1"},
+				"Cookie-session":      {"s1"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &nats.Msg{Header: nats.Header{}}
+			engine := gin.New()
+			engine.GET(ginPath(route.target), func(c *gin.Context) {
+				forwardParams(c, msg, route)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			engine.ServeHTTP(httptest.NewRecorder(), req)
+
+			tt.want[headerMethod] = []string{http.MethodGet}
+			tt.want[headerRoute] = []string{route.target}
+			if len(msg.Header) != len(tt.want) {
+				t.Fatalf("headers = %v, want %v", msg.Header, tt.want)
+			}
+			for k, v := range tt.want {
+				if got := msg.Header.Values(k); !slices.Equal(got, v) {
+					t.Fatalf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestReplyStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		header nats.Header
+		want   int
+	}{
+		{"no headers", nil, http.StatusOK},
+		{"empty headers", nats.Header{}, http.StatusOK},
+		{"status", nats.Header{headerStatusCode: {"201"}}, http.StatusCreated},
+		{"service error code", nats.Header{headerServiceError: {"not found"}, headerServiceErrorCode: {"404"}}, http.StatusNotFound},
+		{"status wins over service error", nats.Header{headerStatusCode: {"409"}, headerServiceErrorCode: {"500"}}, http.StatusConflict},
+		{"malformed status", nats.Header{headerStatusCode: {"abc"}}, http.StatusOK},
+		{"out of range status", nats.Header{headerStatusCode: {"99"}}, http.StatusOK},
+		{"status too large", nats.Header{headerStatusCode: {"600"}}, http.StatusOK},
+		{"malformed status, service error code", nats.Header{headerStatusCode: {"4o4"}, headerServiceErrorCode: {"503"}}, http.StatusServiceUnavailable},
+		{"service error without code", nats.Header{headerServiceError: {"boom"}}, http.StatusInternalServerError},
+		{"service error, malformed code", nats.Header{headerServiceError: {"boom"}, headerServiceErrorCode: {"x"}}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := replyStatus(&nats.Msg{Header: tt.header}); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	resp := &nats.Msg{
+		Data: []byte("id;name\n1;Ana\n"),
+		Header: nats.Header{
+			headerStatusCode:                        {"206"},
+			headerContentType:                       {"text/csv"},
+			headerResponsePrefix + "X-Total-Count":  {"10"},
+			headerResponsePrefix + "Link":           {"</p/1>", "</p/3>"},
+			headerResponsePrefix + "Content-Length": {"1"},
+			headerResponsePrefix + "connection":     {"close"},
+			headerResponsePrefix + "Content-Type":   {"text/html"},
+			headerResponsePrefix:                    {"empty"},
+			headerServiceError:                      {"internal detail"},
+			"X-Internal":                            {"secret"},
+		},
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeReply(c, resp)
+
+	if w.Code != http.StatusPartialContent || w.Body.String() != string(resp.Data) {
+		t.Fatalf("reply = %d %q", w.Code, w.Body.String())
+	}
+	want := http.Header{
+		"Content-Type":  {"text/csv"},
+		"X-Total-Count": {"10"},
+		"Link":          {"</p/1>", "</p/3>"},
+	}
+	if len(w.Header()) != len(want) {
+		t.Fatalf("headers = %v, want %v", w.Header(), want)
+	}
+	for k, v := range want {
+		if got := w.Header().Values(k); !slices.Equal(got, v) {
+			t.Fatalf("%s = %q, want %q", k, got, v)
+		}
+	}
+}
+
+func TestWriteNatsError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"no responders", nats.ErrNoResponders, http.StatusServiceUnavailable},
+		{"wrapped no responders", fmt.Errorf("error requesting service.x: %w", nats.ErrNoResponders), http.StatusServiceUnavailable},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"timeout", nats.ErrTimeout, http.StatusGatewayTimeout},
+		{"other", errors.New("connection closed"), http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		writeNatsError(c, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+
+	// a request to a subject nothing serves maps to 503
+	nc := testNats(t)
+	_, err := requestMsg(context.Background(), nc, &nats.Msg{Subject: "service.missing"})
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeNatsError(c, err)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("no responders: status = %d, want 503 (%v)", w.Code, err)
+	}
+}
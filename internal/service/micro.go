@@ -0,0 +1,356 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// serviceVersion is reported by every service in $SRV.INFO.
+const serviceVersion = "1.0.0"
+
+// defaultConcurrency is the number of requests a service handles at once.
+const defaultConcurrency = 16
+
+// endpoint is implemented by Worker so endpoints of any request and
+// response type can be added to the same service.
+type endpoint interface {
+	endpointName() string
+	endpointSubject() string
+	endpointMetadata() map[string]string
+	microHandler(ctx context.Context) micro.Handler
+}
+
+// Service groups endpoints into a nats.go micro service, which answers the
+// $SRV.PING, $SRV.INFO and $SRV.STATS discovery requests. micro calls the
+// handlers of an endpoint one at a time, so requests are handed to a pool
+// of up to concurrency goroutines instead.
+type Service struct {
+	name        string
+	description string
+	version     string
+	metadata    map[string]string
+	concurrency int
+	endpoints   []endpoint
+	running     micro.Service
+
+	sem      chan struct{}
+	inflight sync.WaitGroup
+	mu       sync.Mutex
+	stopping bool
+	stats    map[string]*HandlerStats
+}
+
+// ServiceOption customizes a service.
+type ServiceOption func(*Service)
+
+// WithVersion overrides the reported service version.
+func WithVersion(version string) ServiceOption {
+	return func(s *Service) { s.version = version }
+}
+
+// WithMetadata adds metadata reported in $SRV.INFO.
+func WithMetadata(metadata map[string]string) ServiceOption {
+	return func(s *Service) {
+		for k, v := range metadata {
+			s.metadata[k] = v
+		}
+	}
+}
+
+// WithConcurrency sets how many requests the service handles at once.
+func WithConcurrency(n int) ServiceOption {
+	return func(s *Service) { s.concurrency = n }
+}
+
+// NewService creates a service; endpoints are added with Add before Start.
+func NewService(name, description string, opts ...ServiceOption) *Service {
+	s := &Service{
+		name:        name,
+		description: description,
+		version:     serviceVersion,
+		metadata:    map[string]string{},
+		concurrency: defaultConcurrency,
+		stats:       map[string]*HandlerStats{},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.concurrency < 1 {
+		s.concurrency = 1
+	}
+	s.sem = make(chan struct{}, s.concurrency)
+	return s
+}
+
+// Add registers endpoints on the service.
+func (s *Service) Add(eps ...endpoint) *Service {
+	s.endpoints = append(s.endpoints, eps...)
+	return s
+}
+
+// Start registers the service on the connection. Handlers run with a
+// context derived from ctx.
+func (s *Service) Start(ctx context.Context, nc *nats.Conn) error {
+	svc, err := micro.AddService(nc, micro.Config{
+		Name:         s.name,
+		Version:      s.version,
+		Description:  s.description,
+		Metadata:     s.metadata,
+		QueueGroup:   s.name + "-workers",
+		StatsHandler: func(ep *micro.Endpoint) any { return s.handlerStats(ep.Name) },
+	})
+	if err != nil {
+		return fmt.Errorf("[%s] error registering service: %w", s.name, err)
+	}
+	s.running = svc
+
+	for _, ep := range s.endpoints {
+		err := svc.AddEndpoint(ep.endpointName(), s.dispatch(nc, ep.endpointName(), ep.microHandler(ctx)),
+			micro.WithEndpointSubject(ep.endpointSubject()),
+			micro.WithEndpointMetadata(ep.endpointMetadata()),
+		)
+		if err != nil {
+			_ = s.Stop(ctx)
+			return fmt.Errorf("[%s] error adding endpoint %s: %w", s.name, ep.endpointName(), err)
+		}
+	}
+
+	log.Printf("[%s] registered %s %s handling %d requests at once", s.name, s.name, s.version, s.concurrency)
+	return nil
+}
+
+// Stop drains the endpoint subscriptions and waits, until ctx is done, for
+// the requests being handled. Requests still delivered by the drain are
+// handled in the subscription callback, so the connection drain that
+// follows waits for them.
+func (s *Service) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	var err error
+	if s.running != nil {
+		err = s.running.Stop()
+		s.running = nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("[%s] requests still running: %w", s.name, ctx.Err()))
+	}
+	return err
+}
+
+// dispatch hands each request of an endpoint to the pool, waiting for a
+// free slot so a busy service stops taking messages off its subscription.
+func (s *Service) dispatch(nc *nats.Conn, name string, h micro.Handler) micro.Handler {
+	return micro.HandlerFunc(func(r micro.Request) {
+		s.sem <- struct{}{}
+
+		s.mu.Lock()
+		if s.stopping {
+			s.mu.Unlock()
+			s.handle(nc, name, h, r)
+			<-s.sem
+			return
+		}
+		s.inflight.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				<-s.sem
+				s.inflight.Done()
+			}()
+			s.handle(nc, name, h, r)
+		}()
+	})
+}
+
+func (s *Service) handle(nc *nats.Conn, name string, h micro.Handler, r micro.Request) {
+	req := &pooledRequest{Request: r, nc: nc}
+	start := time.Now()
+	h.Handle(req)
+	elapsed := time.Since(start)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.stats[name]
+	if !ok {
+		st = &HandlerStats{}
+		s.stats[name] = st
+	}
+	st.NumRequests++
+	st.ProcessingTime += elapsed
+	if st.Latency == nil {
+		st.Latency = make([]int64, len(latencyBounds)+1)
+	}
+	st.Latency[latencyBucket(elapsed)]++
+	if req.err != "" {
+		st.NumErrors++
+		st.LastError = req.err
+	}
+}
+
+// HandlerStats are the outcomes of the requests an endpoint handled,
+// reported as the data of its $SRV.STATS entry. micro counts a request
+// once it is handed to the pool, so its own error count and processing
+// time stay at zero. Latency counts the requests by processing time in
+// the buckets of latencyBounds, the last one holding slower requests.
+type HandlerStats struct {
+	NumRequests    int           `json:"num_requests"`
+	NumErrors      int           `json:"num_errors"`
+	LastError      string        `json:"last_error,omitempty"`
+	ProcessingTime time.Duration `json:"processing_time"`
+	Latency        []int64       `json:"latency,omitempty"`
+}
+
+// latencyBounds are the upper bounds of the latency histogram buckets.
+var latencyBounds = []time.Duration{
+	time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// latencyBucket returns the histogram bucket counting a request of d.
+func latencyBucket(d time.Duration) int {
+	return sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+}
+
+func (s *Service) handlerStats(name string) HandlerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.stats[name]; ok {
+		out := *st
+		out.Latency = slices.Clone(st.Latency)
+		return out
+	}
+	return HandlerStats{}
+}
+
+// pooledRequest publishes replies on the connection itself: the
+// micro.Request methods record the outcome for the micro callback, which
+// has already returned when a pooled handler replies.
+type pooledRequest struct {
+	micro.Request
+	nc  *nats.Conn
+	err string
+}
+
+func (r *pooledRequest) Respond(data []byte, opts ...micro.RespondOpt) error {
+	return r.publish(&nats.Msg{Data: data}, opts)
+}
+
+func (r *pooledRequest) RespondJSON(v any, opts ...micro.RespondOpt) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return micro.ErrMarshalResponse
+	}
+	return r.Respond(data, opts...)
+}
+
+func (r *pooledRequest) Error(code, description string, data []byte, opts ...micro.RespondOpt) error {
+	if code == "" || description == "" {
+		return fmt.Errorf("%w: error code and description", micro.ErrArgRequired)
+	}
+	r.err = code + ":" + description
+
+	msg := &nats.Msg{Data: data, Header: nats.Header{
+		micro.ErrorHeader:     {description},
+		micro.ErrorCodeHeader: {code},
+	}}
+	return r.publish(msg, opts)
+}
+
+func (r *pooledRequest) publish(msg *nats.Msg, opts []micro.RespondOpt) error {
+	if r.Reply() == "" {
+		return nats.ErrMsgNoReply
+	}
+	for _, opt := range opts {
+		opt(msg)
+	}
+	msg.Subject = r.Reply()
+	return r.nc.PublishMsg(msg)
+}
+
+// ServiceStatus is the combined $SRV.INFO and $SRV.STATS of one instance.
+type ServiceStatus struct {
+	Info  micro.Info   `json:"info"`
+	Stats *micro.Stats `json:"stats,omitempty"`
+}
+
+// discoverServices collects every running service instance on the bus.
+func discoverServices(nc *nats.Conn, wait time.Duration) ([]ServiceStatus, error) {
+	infos, err := requestMany(nc, "$SRV.INFO", wait)
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := requestMany(nc, "$SRV.STATS", wait)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*micro.Stats)
+	for _, data := range stats {
+		var st micro.Stats
+		if err := json.Unmarshal(data, &st); err == nil {
+			byID[st.ID] = &st
+		}
+	}
+
+	out := make([]ServiceStatus, 0, len(infos))
+	for _, data := range infos {
+		var info micro.Info
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		out = append(out, ServiceStatus{Info: info, Stats: byID[info.ID]})
+	}
+
+	return out, nil
+}
+
+// requestMany publishes a request and gathers every reply received within wait.
+func requestMany(nc *nats.Conn, subject string, wait time.Duration) ([][]byte, error) {
+	inbox := nc.NewRespInbox()
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	if err := nc.PublishRequest(subject, inbox, nil); err != nil {
+		return nil, err
+	}
+
+	var out [][]byte
+	deadline := time.Now().Add(wait)
+	for {
+		m, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			if errors.Is(err, nats.ErrTimeout) {
+				return out, nil
+			}
+			return out, err
+		}
+		out = append(out, m.Data)
+	}
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type sleepRequest struct {
+	Fail bool `json:"fail,omitempty"`
+}
+
+func TestServiceConcurrency(t *testing.T) {
+	nc := testNats(t)
+
+	const concurrency = 3
+	var running, peak atomic.Int32
+	w := NewWorker("sleep", "service.sleep", func(_ context.Context, req *Request[sleepRequest]) (map[string]bool, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+		if req.Body.Fail {
+			return nil, errConflict("failed")
+		}
+		return map[string]bool{"ok": true}, nil
+	})
+
+	svc := NewService("sleep", "sleeps", WithConcurrency(concurrency)).Add(w)
+	if err := svc.Start(context.Background(), nc); err != nil {
+		t.Fatal(err)
+	}
+
+	// 6 requests of 100ms, 3 at once
+	started := time.Now()
+	statuses := make([]int, 6)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var out map[string]bool
+			statuses[i], _ = callService(context.Background(), nc, "service.sleep", sleepRequest{Fail: i == 0}, &out)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	if p := peak.Load(); p != concurrency {
+		t.Fatalf("peak concurrency %d, want %d", p, concurrency)
+	}
+	// no more than 3 ran at once, so they took at least two rounds; how much
+	// longer depends on the machine
+	if elapsed < 200*time.Millisecond {
+		t.Fatalf("6 requests took %s, want at least 200ms", elapsed)
+	}
+	for i, status := range statuses {
+		want := http.StatusOK
+		if i == 0 {
+			want = http.StatusConflict
+		}
+		if status != want {
+			t.Fatalf("request %d: status %d, want %d", i, status, want)
+		}
+	}
+
+	services, err := discoverServices(nc, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("%d service instances registered, want 1", len(services))
+	}
+	ep := services[0].Stats.Endpoints[0]
+	var hs HandlerStats
+	if err := json.Unmarshal(ep.Data, &hs); err != nil {
+		t.Fatal(err)
+	}
+	if hs.NumRequests != 6 || hs.NumErrors != 1 || hs.LastError != "409:Conflict" || hs.ProcessingTime < 600*time.Millisecond {
+		t.Fatalf("handler stats %+v", hs)
+	}
+
+	// Stop waits for the requests being handled
+	reply := nc.NewRespInbox()
+	sub, err := nc.SubscribeSync(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.PublishMsg(&nats.Msg{Subject: "service.sleep", Reply: reply, Data: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for running.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := svc.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if running.Load() != 0 {
+		t.Fatal("Stop returned while a request was running")
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("no reply to the request running on Stop: %v", err)
+	}
+}
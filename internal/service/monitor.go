@@ -1,13 +1,492 @@
 package service
 
-import "github.com/spf13/cobra"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// monitorWindow is the sliding window throughput and recent latency
+	// are computed over.
+	monitorWindow = 60 * time.Second
+	// monitorBuffer is the number of sampled replies queued for processing.
+	monitorBuffer = 64 * 1024
+
+	defaultMonitorPort     = 8081
+	defaultMonitorInterval = 5 * time.Second
+
+	// subjectNoResponders receives the subject of every request that
+	// found no responders, see requestMsg.
+	subjectNoResponders = "monitor.noresponders"
+)
+
+// MonitorConfig configures the traffic observer. Interval is how often the
+// services are asked for their stats.
+type MonitorConfig struct {
+	Port     int           `yaml:"port"`
+	Interval time.Duration `yaml:"interval"`
+}
 
 func Monitor(cmd *cobra.Command, _ []string) error {
-	configStr := cmd.Flag("config").Value.String()
-	_, err := serviceCommon(cmd.Context(), configStr)
+	cfg, err := serviceCommon(cmd)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return runMonitor(cfg)
+}
+
+// runMonitor reports the traffic of every service on the bus. Per subject
+// counts and latency histograms come from the $SRV.STATS of the micro
+// services, and requests without responders are reported by their
+// senders. The monitor only subscribes to reply inboxes, to sample status
+// codes, so it never counts as a responder and requests to a service that
+// is down still fail fast with no responders.
+func runMonitor(cfg *ConfigService) error {
+	mon := newTrafficMonitor()
+
+	replies := make(chan *nats.Msg, monitorBuffer)
+	if _, err := cfg.nc.ChanSubscribe(nats.InboxPrefix+">", replies); err != nil {
+		return fmt.Errorf("error subscribing to reply inboxes: %w", err)
+	}
+	_, err := cfg.nc.Subscribe(subjectNoResponders, func(msg *nats.Msg) {
+		mon.observeNoResponders(string(msg.Data))
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", subjectNoResponders, err)
+	}
+
+	go mon.consume(cfg.ctx, replies)
+	go mon.run(cfg)
+
+	port := cfg.Monitor.Port
+	if port == 0 {
+		port = defaultMonitorPort
+	}
+
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+	setupHealthEndpoints(engine)
+	engine.GET("/", func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(dashboardHTML))
+	})
+	engine.GET("/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, mon.snapshot(time.Now()))
+	})
+
+	srv := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: engine}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("starting monitor on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
+			cfg.cancel()
+		}
+	}()
+
+	shutdownErr := cfg.waitForShutdown("monitor", srv.Shutdown, cfg.drain)
+	select {
+	case err := <-serveErr:
+		return err
+	default:
+		return shutdownErr
+	}
+}
+
+// trafficMonitor keeps the stats of each subject, summed over the instances
+// serving it, and the status codes of the replies seen on the bus.
+type trafficMonitor struct {
+	mu       sync.Mutex
+	started  time.Time
+	subjects map[string]*subjectStats
+	replies  int64
+	status   map[int]int64
+}
+
+// subjectStats holds the latest totals of a subject and the totals seen
+// over the window, oldest first. noResponders counts the requests that
+// found no service since the monitor started.
+type subjectStats struct {
+	responders int
+	statsPoint
+	lastError    string
+	history      []statsPoint
+	noResponders int64
+}
+
+// statsPoint holds the totals of a subject at one time; latency is the
+// histogram of HandlerStats, summed over the instances.
+type statsPoint struct {
+	at         time.Time
+	requests   int64
+	errors     int64
+	processing time.Duration
+	latency    []int64
+}
+
+// SubjectSnapshot is the state of one subject reported by the monitor.
+type SubjectSnapshot struct {
+	Subject       string          `json:"subject"`
+	Responders    int             `json:"responders"`
+	Requests      int64           `json:"requests"`
+	Errors        int64           `json:"errors"`
+	ErrorRate     float64         `json:"error_rate"`
+	ThroughputRPS float64         `json:"throughput_rps"`
+	Latency       LatencySnapshot `json:"latency_ms"`
+	NoResponders  int64           `json:"no_responders"`
+	LastError     string          `json:"last_error,omitempty"`
+}
+
+// LatencySnapshot holds the average processing time of a subject since its
+// services started and over the window, and its percentiles over the
+// window, or since the start when the window saw no request. Percentiles
+// are the upper bound of the histogram bucket they fall in.
+type LatencySnapshot struct {
+	Average float64 `json:"average"`
+	Recent  float64 `json:"recent"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// MonitorSnapshot is the body of GET /stats. Replies and Status cover the
+// replies of every worker, as they cannot be told apart by subject from the
+// reply alone.
+type MonitorSnapshot struct {
+	StartedAt     time.Time         `json:"started_at"`
+	UptimeSeconds int64             `json:"uptime_seconds"`
+	WindowSeconds int               `json:"window_seconds"`
+	Replies       int64             `json:"replies"`
+	Status        map[string]int64  `json:"status"`
+	Subjects      []SubjectSnapshot `json:"subjects"`
+}
+
+func newTrafficMonitor() *trafficMonitor {
+	return &trafficMonitor{
+		started:  time.Now(),
+		subjects: make(map[string]*subjectStats),
+		status:   make(map[int]int64),
+	}
+}
+
+func (m *trafficMonitor) consume(ctx context.Context, msgs <-chan *nats.Msg) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-msgs:
+			m.observeReply(msg)
+		}
+	}
+}
+
+// observeReply counts the replies of workers, which carry a status code.
+// Other inbox traffic, such as $SRV discovery, is ignored.
+func (m *trafficMonitor) observeReply(msg *nats.Msg) {
+	if msg.Header == nil || (msg.Header.Get(headerStatusCode) == "" && msg.Header.Get(headerServiceError) == "") {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.replies++
+	m.status[replyStatus(msg)]++
+}
+
+// observeNoResponders counts a request to subject that found no service.
+func (m *trafficMonitor) observeNoResponders(subject string) {
+	if subject == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st, ok := m.subjects[subject]
+	if !ok {
+		st = &subjectStats{}
+		m.subjects[subject] = st
+	}
+	st.noResponders++
+}
+
+// run polls the stats of the services until the monitor stops.
+func (m *trafficMonitor) run(cfg *ConfigService) {
+	interval := cfg.Monitor.Interval
+	if interval <= 0 {
+		interval = defaultMonitorInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	m.refresh(cfg.nc, time.Now())
+	for {
+		select {
+		case <-cfg.ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.refresh(cfg.nc, now)
+		}
+	}
+}
+
+func (m *trafficMonitor) refresh(nc *nats.Conn, now time.Time) {
+	services, err := discoverServices(nc, discoveryWait)
+	if err != nil {
+		log.Printf("[monitor] error discovering services: %v", err)
+		return
+	}
+	m.update(services, now)
+}
+
+// update sums the endpoint stats of every instance by subject. A subject
+// whose totals went down lost or restarted an instance, so its history
+// starts over.
+func (m *trafficMonitor) update(services []ServiceStatus, now time.Time) {
+	totals := make(map[string]*subjectStats)
+	for _, svc := range services {
+		for _, ep := range svc.Info.Endpoints {
+			st, ok := totals[ep.Subject]
+			if !ok {
+				st = &subjectStats{}
+				totals[ep.Subject] = st
+			}
+			st.responders++
+		}
+		if svc.Stats == nil {
+			continue
+		}
+		for _, ep := range svc.Stats.Endpoints {
+			st := totals[ep.Subject]
+			if st == nil {
+				continue
+			}
+			hs := HandlerStats{
+				NumRequests:    ep.NumRequests,
+				NumErrors:      ep.NumErrors,
+				LastError:      ep.LastError,
+				ProcessingTime: ep.ProcessingTime,
+			}
+			if len(ep.Data) > 0 {
+				// services of this module report the outcome of their
+				// handlers there, see Service
+				_ = json.Unmarshal(ep.Data, &hs)
+			}
+			st.requests += int64(hs.NumRequests)
+			st.errors += int64(hs.NumErrors)
+			st.processing += hs.ProcessingTime
+			if len(hs.Latency) == len(latencyBounds)+1 {
+				if st.latency == nil {
+					st.latency = make([]int64, len(hs.Latency))
+				}
+				for i, n := range hs.Latency {
+					st.latency[i] += n
+				}
+			}
+			if hs.LastError != "" {
+				st.lastError = hs.LastError
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for subject, st := range m.subjects {
+		if _, ok := totals[subject]; !ok {
+			// keep a subject whose services are all down, showing no responders
+			st.responders = 0
+			st.history = nil
+		}
+	}
+	for subject, st := range totals {
+		st.at = now
+		if prev, ok := m.subjects[subject]; ok {
+			st.noResponders = prev.noResponders
+			if st.requests >= prev.requests {
+				st.history = prev.history
+				if st.lastError == "" {
+					st.lastError = prev.lastError
+				}
+			}
+		}
+
+		st.history = append(st.history, st.statsPoint)
+		for len(st.history) > 1 && now.Sub(st.history[0].at) > monitorWindow {
+			st.history = st.history[1:]
+		}
+		m.subjects[subject] = st
+	}
+}
+
+func (m *trafficMonitor) snapshot(now time.Time) MonitorSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := MonitorSnapshot{
+		StartedAt:     m.started,
+		UptimeSeconds: int64(now.Sub(m.started) / time.Second),
+		WindowSeconds: int(monitorWindow / time.Second),
+		Replies:       m.replies,
+		Status:        make(map[string]int64, len(m.status)),
+		Subjects:      make([]SubjectSnapshot, 0, len(m.subjects)),
+	}
+	for code, n := range m.status {
+		out.Status[strconv.Itoa(code)] = n
+	}
+
+	for subject, st := range m.subjects {
+		s := SubjectSnapshot{
+			Subject:      subject,
+			Responders:   st.responders,
+			Requests:     st.requests,
+			Errors:       st.errors,
+			LastError:    st.lastError,
+			NoResponders: st.noResponders,
+			Latency:      LatencySnapshot{Average: averageMillis(st.processing, st.requests)},
+		}
+		if st.requests > 0 {
+			s.ErrorRate = float64(st.errors) / float64(st.requests)
+		}
+
+		latency := st.latency
+		if n := len(st.history); n > 1 {
+			first, last := st.history[0], st.history[n-1]
+			if secs := last.at.Sub(first.at).Seconds(); secs > 0 {
+				s.ThroughputRPS = float64(last.requests-first.requests) / secs
+			}
+			s.Latency.Recent = averageMillis(last.processing-first.processing, last.requests-first.requests)
+			if last.requests > first.requests {
+				latency = subtractBuckets(last.latency, first.latency)
+			}
+		}
+		s.Latency.P50 = percentileMillis(latency, 0.50)
+		s.Latency.P95 = percentileMillis(latency, 0.95)
+		s.Latency.P99 = percentileMillis(latency, 0.99)
+		out.Subjects = append(out.Subjects, s)
+	}
+
+	sort.Slice(out.Subjects, func(i, j int) bool { return out.Subjects[i].Subject < out.Subjects[j].Subject })
+	return out
+}
+
+func averageMillis(total time.Duration, n int64) float64 {
+	if n <= 0 {
+		return 0
+	}
+	return millis(total / time.Duration(n))
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// subtractBuckets returns the requests counted by the histogram last and
+// not by the earlier histogram first.
+func subtractBuckets(last, first []int64) []int64 {
+	out := slices.Clone(last)
+	for i := range out {
+		if i < len(first) {
+			out[i] -= first[i]
+		}
+	}
+	return out
+}
+
+// percentileMillis returns the upper bound of the histogram bucket holding
+// the p quantile; requests slower than the last bound are reported at it.
+func percentileMillis(buckets []int64, p float64) float64 {
+	var total int64
+	for _, n := range buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(p * float64(total)))
+	var seen int64
+	for i, n := range buckets {
+		if seen += n; seen >= rank {
+			return millis(latencyBounds[min(i, len(latencyBounds)-1)])
+		}
+	}
+	return millis(latencyBounds[len(latencyBounds)-1])
+}
+
+// dashboardHTML polls /stats and renders one row per subject.
+const dashboardHTML = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NATS mesh monitor</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: .4em .8em; border-bottom: 1px solid #ddd; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+tr.bad td { background: #fdecea; }
+tr.down td { background: #f5f5f5; color: #999; }
+</style>
+</head>
+<body>
+<h1>NATS mesh monitor</h1>
+<p id="summary"></p>
+<p id="status"></p>
+<table>
+<thead>
+<tr><th>subject</th><th>responders</th><th>req/s</th><th>requests</th><th>errors</th><th>error rate</th><th>no responders</th><th>avg ms</th><th>recent ms</th><th>p50 ms</th><th>p95 ms</th><th>p99 ms</th><th>last error</th></tr>
+</thead>
+<tbody id="subjects"></tbody>
+</table>
+<script>
+async function refresh() {
+  try {
+    const res = await fetch("stats");
+    const s = await res.json();
+    document.getElementById("summary").textContent =
+      "up " + s.uptime_seconds + "s, throughput and recent latency over the last " + s.window_seconds + "s";
+    document.getElementById("status").textContent =
+      s.replies + " replies seen (" + Object.entries(s.status).map(([k, v]) => k + ": " + v).join(", ") +
+      ")";
+    const rows = s.subjects.map(x => {
+      const cls = x.responders === 0 ? "down" : (x.error_rate > 0.05 ? "bad" : "");
+      const cells = [x.subject, x.responders, x.throughput_rps.toFixed(2), x.requests, x.errors,
+        (x.error_rate * 100).toFixed(1) + "%", x.no_responders, x.latency_ms.average, x.latency_ms.recent,
+        x.latency_ms.p50, x.latency_ms.p95, x.latency_ms.p99, x.last_error || ""];
+      const tr = document.createElement("tr");
+      tr.className = cls;
+      for (const c of cells) {
+        const td = document.createElement("td");
+        td.textContent = c;
+        tr.appendChild(td);
+      }
+      return tr;
+    });
+    document.getElementById("subjects").replaceChildren(...rows);
+  } catch (e) {
+    document.getElementById("summary").textContent = "error loading stats: " + e;
+  }
 }
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
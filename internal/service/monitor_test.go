@@ -0,0 +1,192 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// serviceStatus returns an instance serving subject that reports hs.
+func serviceStatus(t *testing.T, subject string, hs HandlerStats) ServiceStatus {
+	t.Helper()
+	data, err := json.Marshal(hs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ServiceStatus{
+		Info:  micro.Info{Endpoints: []micro.EndpointInfo{{Name: "ep", Subject: subject}}},
+		Stats: &micro.Stats{Endpoints: []*micro.EndpointStats{{Name: "ep", Subject: subject, Data: data}}},
+	}
+}
+
+// handled returns the stats of n requests of d each, errors of them
+// failing.
+func handled(n, errors int, d time.Duration) HandlerStats {
+	hs := HandlerStats{
+		NumRequests:    n,
+		NumErrors:      errors,
+		ProcessingTime: time.Duration(n) * d,
+		Latency:        make([]int64, len(latencyBounds)+1),
+	}
+	hs.Latency[latencyBucket(d)] = int64(n)
+	return hs
+}
+
+// plus returns the stats of a and b handled by the same instance.
+func plus(a, b HandlerStats) HandlerStats {
+	out := HandlerStats{
+		NumRequests:    a.NumRequests + b.NumRequests,
+		NumErrors:      a.NumErrors + b.NumErrors,
+		ProcessingTime: a.ProcessingTime + b.ProcessingTime,
+		Latency:        make([]int64, len(latencyBounds)+1),
+	}
+	for i := range out.Latency {
+		out.Latency[i] = a.Latency[i] + b.Latency[i]
+	}
+	return out
+}
+
+func subjectSnapshot(t *testing.T, m *trafficMonitor, now time.Time, subject string) SubjectSnapshot {
+	t.Helper()
+	for _, s := range m.snapshot(now).Subjects {
+		if s.Subject == subject {
+			return s
+		}
+	}
+	t.Fatalf("no subject %s", subject)
+	return SubjectSnapshot{}
+}
+
+func TestTrafficMonitor(t *testing.T) {
+	const subject = "service.a"
+	m := newTrafficMonitor()
+	t0 := time.Now()
+
+	// two instances of 10 requests at 10ms, one failing each
+	first := handled(10, 1, 10*time.Millisecond)
+	m.update([]ServiceStatus{serviceStatus(t, subject, first), serviceStatus(t, subject, first)}, t0)
+	s := subjectSnapshot(t, m, t0, subject)
+	if s.Responders != 2 || s.Requests != 20 || s.Errors != 2 || s.ErrorRate != 0.1 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+	// a single sample has no window: percentiles cover every request
+	if s.ThroughputRPS != 0 || s.Latency.Average != 10 || s.Latency.P50 != 10 || s.Latency.P99 != 10 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+
+	// 50 more requests at 100ms on each instance over 10s
+	second := plus(first, handled(50, 0, 100*time.Millisecond))
+	t1 := t0.Add(10 * time.Second)
+	m.update([]ServiceStatus{serviceStatus(t, subject, second), serviceStatus(t, subject, second)}, t1)
+	s = subjectSnapshot(t, m, t1, subject)
+	if s.Requests != 120 || s.ThroughputRPS != 10 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+	if s.Latency.Recent != 100 || s.Latency.P50 != 100 || s.Latency.P99 != 100 {
+		t.Fatalf("latency = %+v", s.Latency)
+	}
+	if s.ErrorRate != 2.0/120 || s.Latency.Average != 85 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+
+	// samples older than the window are dropped; without requests in the
+	// window percentiles cover every request
+	t2 := t0.Add(monitorWindow + 5*time.Second)
+	m.update([]ServiceStatus{serviceStatus(t, subject, second), serviceStatus(t, subject, second)}, t2)
+	if n := len(m.subjects[subject].history); n != 2 {
+		t.Fatalf("history has %d samples, want 2", n)
+	}
+	s = subjectSnapshot(t, m, t2, subject)
+	if s.ThroughputRPS != 0 || s.Latency.Recent != 0 || s.Latency.P50 != 100 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+
+	// a restarted instance lowers the totals: the window starts over
+	t3 := t2.Add(5 * time.Second)
+	m.update([]ServiceStatus{serviceStatus(t, subject, second), serviceStatus(t, subject, first)}, t3)
+	if n := len(m.subjects[subject].history); n != 1 {
+		t.Fatalf("history has %d samples, want 1", n)
+	}
+	s = subjectSnapshot(t, m, t3, subject)
+	if s.Requests != 70 || s.ThroughputRPS != 0 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+
+	// a subject whose services are gone is kept without responders
+	m.update(nil, t3.Add(5*time.Second))
+	if s = subjectSnapshot(t, m, t3, subject); s.Responders != 0 || s.Requests != 70 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+}
+
+func TestPercentileMillis(t *testing.T) {
+	buckets := make([]int64, len(latencyBounds)+1)
+	buckets[latencyBucket(time.Millisecond)] = 90
+	buckets[latencyBucket(50*time.Millisecond)] = 9
+	buckets[len(latencyBounds)] = 1
+
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{0.5, 1},
+		{0.9, 1},
+		{0.95, 50},
+		{0.99, 50},
+		// slower than the last bound
+		{1, 10000},
+	}
+	for _, tt := range tests {
+		if got := percentileMillis(buckets, tt.p); got != tt.want {
+			t.Errorf("percentileMillis(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if got := percentileMillis(make([]int64, len(buckets)), 0.5); got != 0 {
+		t.Errorf("percentileMillis of no requests = %v", got)
+	}
+}
+
+func TestMonitorNoResponders(t *testing.T) {
+	nc := testNats(t)
+	m := newTrafficMonitor()
+	sub, err := nc.Subscribe(subjectNoResponders, func(msg *nats.Msg) {
+		m.observeNoResponders(string(msg.Data))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range 2 {
+		if _, err := callService(ctx, nc, "service.missing", nil, nil); err == nil {
+			t.Fatal("called a missing service")
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s := m.snapshot(time.Now())
+		if len(s.Subjects) == 1 && s.Subjects[0].NoResponders == 2 {
+			if s.Subjects[0].Subject != "service.missing" || s.Subjects[0].Responders != 0 {
+				t.Fatalf("snapshot = %+v", s.Subjects[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("subjects = %+v", s.Subjects)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the count survives the subject being polled
+	m.update([]ServiceStatus{serviceStatus(t, "service.missing", handled(1, 0, time.Millisecond))}, time.Now())
+	if s := subjectSnapshot(t, m, time.Now(), "service.missing"); s.NoResponders != 2 || s.Responders != 1 {
+		t.Fatalf("snapshot = %+v", s)
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi2"
+	"github.com/getkin/kin-openapi/openapi2conv"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/go-openapi/loads"
+	"gopkg.in/yaml.v3"
+)
+
+// specVersion holds the top level version markers used to pick a loader.
+type specVersion struct {
+	OpenAPI string `yaml:"openapi"`
+	Swagger string `yaml:"swagger"`
+}
+
+// loadOpenAPI parses an OpenAPI 3.0/3.1 document, falling back to the
+// Swagger 2.0 loader (converted to OpenAPI 3) for legacy specs.
+func loadOpenAPI(filePath string) (*openapi3.T, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading OpenAPI file: %w", err)
+	}
+
+	return loadOpenAPIData(filePath, data)
+}
+
+func loadOpenAPIData(filePath string, data []byte) (*openapi3.T, error) {
+	var version specVersion
+	if err := yaml.Unmarshal(data, &version); err != nil {
+		return nil, fmt.Errorf("error parsing OpenAPI file: %w", err)
+	}
+
+	var (
+		doc *openapi3.T
+		err error
+	)
+
+	switch {
+	case strings.HasPrefix(version.OpenAPI, "3."):
+		doc, err = loadOpenAPI3(filePath, data)
+	case strings.HasPrefix(version.Swagger, "2."):
+		doc, err = loadSwagger2(filePath)
+	default:
+		return nil, fmt.Errorf("unsupported spec version (openapi=%q swagger=%q)", version.OpenAPI, version.Swagger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if doc.Paths == nil || doc.Paths.Len() == 0 {
+		return nil, fmt.Errorf("openapi spec is missing paths")
+	}
+
+	if doc.Info == nil {
+		return nil, fmt.Errorf("openapi spec is missing info")
+	}
+
+	if doc.Info.Title == "" {
+		return nil, fmt.Errorf("openapi spec is missing info title")
+	}
+
+	return doc, nil
+}
+
+func loadOpenAPI3(filePath string, data []byte) (*openapi3.T, error) {
+	location, err := specLocation(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+
+	doc, err := loader.LoadFromDataWithPath(data, location)
+	if err != nil {
+		return nil, fmt.Errorf("error loading OpenAPI file: %w", err)
+	}
+
+	// kin-openapi validates against the 3.0 rules; 3.1 documents are loaded
+	// and resolved but not held to the stricter 3.0 validation.
+	if strings.HasPrefix(doc.OpenAPI, "3.0") {
+		if err := doc.Validate(loader.Context, openapi3.DisableExamplesValidation()); err != nil {
+			return nil, fmt.Errorf("invalid OpenAPI file: %w", err)
+		}
+	}
+
+	return doc, nil
+}
+
+func loadSwagger2(filePath string) (*openapi3.T, error) {
+	legacy, err := loads.Spec(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading Swagger file: %w", err)
+	}
+
+	raw, err := json.Marshal(legacy.Spec())
+	if err != nil {
+		return nil, fmt.Errorf("error encoding Swagger file: %w", err)
+	}
+
+	var doc2 openapi2.T
+	if err := json.Unmarshal(raw, &doc2); err != nil {
+		return nil, fmt.Errorf("error decoding Swagger file: %w", err)
+	}
+
+	location, err := specLocation(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+
+	doc, err := openapi2conv.ToV3WithLoader(&doc2, loader, location)
+	if err != nil {
+		return nil, fmt.Errorf("error converting Swagger file: %w", err)
+	}
+
+	// without a host the converter drops basePath, keep it as a relative server
+	if len(doc.Servers) == 0 && doc2.BasePath != "" {
+		doc.Servers = openapi3.Servers{{URL: doc2.BasePath}}
+	}
+
+	return doc, nil
+}
+
+func specLocation(filePath string) (*url.URL, error) {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving OpenAPI path: %w", err)
+	}
+
+	return &url.URL{Path: filepath.ToSlash(abs)}, nil
+}
+
+// specBasePath returns the path prefix declared by the first server entry,
+// or an empty string when routes are mounted at the root.
+func specBasePath(doc *openapi3.T) (string, error) {
+	base, err := doc.Servers.BasePath()
+	if err != nil {
+		return "", fmt.Errorf("invalid server url: %w", err)
+	}
+
+	base = path.Clean("/" + base)
+	if base == "/" {
+		return "", nil
+	}
+
+	return base, nil
+}
+
+func checkPathItem(p string, pathItem *openapi3.PathItem) error {
+	if pathItem == nil || len(pathItem.Operations()) == 0 {
+		return fmt.Errorf("path item is empty for path: %s", p)
+	}
+
+	return nil
+}
+
+// operationParameters merges path level parameters with the operation ones,
+// the operation definition winning when both declare the same name and location.
+func operationParameters(pathItem *openapi3.PathItem, operation *openapi3.Operation) openapi3.Parameters {
+	params := make(openapi3.Parameters, 0, len(pathItem.Parameters)+len(operation.Parameters))
+	seen := make(map[string]bool)
+
+	for _, ref := range operation.Parameters {
+		if ref == nil || ref.Value == nil {
+			continue
+		}
+		seen[ref.Value.In+":"+ref.Value.Name] = true
+		params = append(params, ref)
+	}
+
+	for _, ref := range pathItem.Parameters {
+		if ref == nil || ref.Value == nil || seen[ref.Value.In+":"+ref.Value.Name] {
+			continue
+		}
+		params = append(params, ref)
+	}
+
+	return params
+}
+
+func getExtensionString(ext any) string {
+	if ext == nil {
+		return ""
+	}
+	if s, ok := ext.(string); ok {
+		return s
+	}
+	return ""
+}
+
+func getExtensionInt(ext any) int {
+	switch v := ext.(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+func getExtensionDuration(ext any, def time.Duration) time.Duration {
+	if ext == nil {
+		return def
+	}
+	if s, ok := ext.(string); ok {
+		if d, err := time.ParseDuration(s); err == nil {
+			return d
+		}
+	}
+	return def
+}
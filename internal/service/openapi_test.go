@@ -0,0 +1,174 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const openAPI30Spec = `openapi: 3.0.3
+info:
+  title: v30
+  version: "1"
+servers:
+  - url: /api/
+paths:
+  /items/{id}:
+    parameters:
+      - name: id
+        in: path
+        required: true
+        schema:
+          type: string
+    get:
+      x-nats-subject: service.items.get
+      responses:
+        "200":
+          description: ok
+`
+
+// openAPI31Spec uses a type list, which 3.0 validation would reject.
+const openAPI31Spec = `openapi: 3.1.0
+info:
+  title: v31
+  version: "1"
+servers:
+  - url: https://api.example.com/v2
+paths:
+  /items:
+    post:
+      x-nats-subject: service.items.create
+      requestBody:
+        content:
+          application/json:
+            schema:
+              type: object
+              properties:
+                name:
+                  type: [string, "null"]
+      responses:
+        "201":
+          description: created
+`
+
+const swagger2Spec = `{
+  "swagger": "2.0",
+  "info": {"title": "legacy", "version": "1"},
+  "basePath": "/legacy",
+  "paths": {
+    "/items/{id}": {
+      "get": {
+        "x-nats-subject": "service.items.get",
+        "parameters": [{"name": "id", "in": "path", "required": true, "type": "string"}],
+        "responses": {"200": {"description": "ok"}}
+      }
+    }
+  }
+}`
+
+const swagger2HostSpec = `swagger: "2.0"
+info:
+  title: legacy
+  version: "1"
+host: api.example.com
+schemes: [https]
+basePath: /legacy/v1
+paths:
+  /items:
+    get:
+      x-nats-subject: service.items.list
+      responses:
+        "200":
+          description: ok
+`
+
+func TestLoadOpenAPI(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		spec    string
+		base    string
+		path    string
+		method  string
+		subject string
+		err     string
+	}{
+		{"openapi 3.0", "openapi.yaml", openAPI30Spec, "/api", "/items/{id}", "GET", "service.items.get", ""},
+		{"openapi 3.1", "openapi.yaml", openAPI31Spec, "/v2", "/items", "POST", "service.items.create", ""},
+		{"swagger 2.0", "swagger.json", swagger2Spec, "/legacy", "/items/{id}", "GET", "service.items.get", ""},
+		{"swagger 2.0 with host", "swagger.yaml", swagger2HostSpec, "/legacy/v1", "/items", "GET", "service.items.list", ""},
+		{"3.0 without info", "openapi.yaml", strings.Replace(openAPI30Spec, "info:\n  title: v30\n  version: \"1\"\n", "", 1), "", "", "", "", "info"},
+		{"3.1 without info", "openapi.yaml", strings.Replace(openAPI31Spec, "info:\n  title: v31\n  version: \"1\"\n", "", 1), "", "", "", "", "missing info"},
+		{"3.1 without title", "openapi.yaml", strings.Replace(openAPI31Spec, "  title: v31\n", "", 1), "", "", "", "", "missing info title"},
+		{"3.1 without paths", "openapi.yaml", openAPI31Spec[:strings.Index(openAPI31Spec, "paths:")], "", "", "", "", "missing paths"},
+		{"2.0 without paths", "swagger.yaml", swagger2HostSpec[:strings.Index(swagger2HostSpec, "paths:")], "", "", "", "", "missing paths"},
+		{"no version", "openapi.yaml", "info:\n  title: x\n", "", "", "", "", "unsupported spec version"},
+		{"version 4", "openapi.yaml", "openapi: 4.0.0\n", "", "", "", "", "unsupported spec version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.spec), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			doc, err := loadOpenAPI(file)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			base, err := specBasePath(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base != tt.base {
+				t.Fatalf("base path = %q, want %q", base, tt.base)
+			}
+
+			item := doc.Paths.Value(tt.path)
+			if item == nil {
+				t.Fatalf("no path %s in %v", tt.path, doc.Paths.InMatchingOrder())
+			}
+			op := item.GetOperation(tt.method)
+			if op == nil {
+				t.Fatalf("no %s %s", tt.method, tt.path)
+			}
+			if got := getExtensionString(op.Extensions["x-nats-subject"]); got != tt.subject {
+				t.Fatalf("subject = %q, want %q", got, tt.subject)
+			}
+		})
+	}
+}
+
+func TestSpecBasePath(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{strings.Replace(openAPI30Spec, "  - url: /api/\n", "  - url: /\n", 1), ""},
+		{strings.Replace(openAPI30Spec, "servers:\n  - url: /api/\n", "", 1), ""},
+		{strings.Replace(openAPI30Spec, "  - url: /api/\n", "  - url: http://localhost:8080/a/b/../c\n", 1), "/a/c"},
+		{strings.Replace(openAPI30Spec, "  - url: /api/\n", "  - url: /api\n  - url: /other\n", 1), "/api"},
+	}
+	for i, tt := range tests {
+		doc, err := loadOpenAPIData(filepath.Join(t.TempDir(), "openapi.yaml"), []byte(tt.spec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := specBasePath(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%d: base path = %q, want %q", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+)
+
+// piiKeySize is the size of every key: AES-256 for encryption, HMAC-SHA256
+// for the blind indexes.
+const piiKeySize = 32
+
+// sealedColumns are the identity columns written by piiCipher.seal.
+var sealedColumns = []string{"name", "cpf", "cnpj", "name_index", "cpf_index", "cnpj_index", "data_key"}
+
+// EncryptionConfig holds the keys protecting personal data at rest, each
+// a base64 encoded 32 byte key referenced as "env:NAME" or "file:PATH"
+// (see secretValue). Keys maps key ids to the keys encrypting the data key
+// of each row: new rows use ActiveKey and the others are kept to read rows
+// written before a rotation. IndexKey keys the hashes used to look rows up.
+type EncryptionConfig struct {
+	ActiveKey string            `yaml:"activeKey"`
+	Keys      map[string]string `yaml:"keys"`
+	IndexKey  string            `yaml:"indexKey"`
+}
+
+// piiCipher encrypts the name and documents of identities with envelope
+// encryption: each row has its own data key, stored wrapped by a key
+// encryption key as "<key id>:<base64>".
+type piiCipher struct {
+	active   string
+	keks     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+func newPIICipher(cfg EncryptionConfig) (*piiCipher, error) {
+	c := &piiCipher{active: strings.ToLower(cfg.ActiveKey), keks: map[string]cipher.AEAD{}}
+
+	for id, ref := range cfg.Keys {
+		key, err := loadPIIKey(ref)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+		if c.keks[strings.ToLower(id)], err = newAEAD(key); err != nil {
+			return nil, fmt.Errorf("encryption key %s: %w", id, err)
+		}
+	}
+	if c.active == "" {
+		return nil, fmt.Errorf("encryption activeKey is required")
+	}
+	if _, ok := c.keks[c.active]; !ok {
+		return nil, fmt.Errorf("encryption activeKey %s is not in keys", c.active)
+	}
+
+	var err error
+	if c.indexKey, err = loadPIIKey(cfg.IndexKey); err != nil {
+		return nil, fmt.Errorf("encryption indexKey: %w", err)
+	}
+	return c, nil
+}
+
+// loadPIIKey reads a key through secretValue and decodes it.
+func loadPIIKey(ref string) ([]byte, error) {
+	encoded, err := secretValue(ref)
+	if err != nil {
+		return nil, err
+	}
+	return decodePIIKey(encoded)
+}
+
+func decodePIIKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(key) != piiKeySize {
+		return nil, fmt.Errorf("want %d bytes, got %d", piiKeySize, len(key))
+	}
+	return key, nil
+}
+
+// secretValue resolves a secret given in the config as "env:NAME", read
+// from the environment, or "file:PATH", read from a file such as a mounted
+// secret. Secrets themselves are never accepted in the config file.
+func secretValue(ref string) (string, error) {
+	kind, name, _ := strings.Cut(strings.TrimSpace(ref), ":")
+	name = strings.TrimSpace(name)
+
+	var v string
+	switch {
+	case kind == "":
+		return "", fmt.Errorf("not configured")
+	case kind == "env" && name != "":
+		if v = os.Getenv(name); v == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+	case kind == "file" && name != "":
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		v = string(b)
+	default:
+		return "", fmt.Errorf("must be env:NAME or file:PATH")
+	}
+
+	if v = strings.TrimSpace(v); v == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return v, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blindIndex is the keyed hash of a value, so equal values can be matched
+// without storing them. kind keeps the hashes of CPFs, CNPJs and names apart.
+func (c *piiCipher) blindIndex(kind, value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(kind + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// nameIndex hashes a name ignoring case and accents.
+func (c *piiCipher) nameIndex(name string) string {
+	return c.blindIndex("name", model.SearchKey(name))
+}
+
+// seal returns the row to store for ident: its name and documents
+// encrypted under a fresh data key wrapped by the active key, and their
+// blind indexes. ident itself keeps the clear values.
+func (c *piiCipher) seal(ident *model.Identity) (*model.Identity, error) {
+	dek := make([]byte, piiKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	row := *ident
+	row.CPFIndex = c.blindIndex(docCPF, ident.CPF)
+	row.CNPJIndex = c.blindIndex(docCNPJ, ident.CNPJ)
+	row.NameIndex = c.nameIndex(ident.Name)
+
+	// the UUID is bound to every ciphertext so values cannot be moved
+	// between rows or fields
+	wrapped := sealValue(c.keks[c.active], dek, "data_key:"+ident.UUID)
+	row.DataKey = c.active + ":" + base64.StdEncoding.EncodeToString(wrapped)
+	for field, v := range map[string]*string{"name": &row.Name, "cpf": &row.CPF, "cnpj": &row.CNPJ} {
+		if *v != "" {
+			*v = base64.StdEncoding.EncodeToString(sealValue(aead, []byte(*v), field+":"+ident.UUID))
+		}
+	}
+	return &row, nil
+}
+
+// open decrypts the name and documents of a stored row in place. Rows
+// without a data key predate encryption and are left as they are.
+func (c *piiCipher) open(ident *model.Identity) error {
+	if ident.DataKey == "" {
+		return nil
+	}
+
+	id, encoded, ok := strings.Cut(ident.DataKey, ":")
+	kek := c.keks[id]
+	if !ok || kek == nil {
+		return fmt.Errorf("identity %s: unknown encryption key %q", ident.UUID, id)
+	}
+	dek, err := openValue(kek, encoded, "data_key:"+ident.UUID)
+	if err != nil {
+		return fmt.Errorf("identity %s: failed to decrypt data key: %w", ident.UUID, err)
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return err
+	}
+
+	for field, v := range map[string]*string{"name": &ident.Name, "cpf": &ident.CPF, "cnpj": &ident.CNPJ} {
+		if *v == "" {
+			continue
+		}
+		plain, err := openValue(aead, *v, field+":"+ident.UUID)
+		if err != nil {
+			return fmt.Errorf("identity %s: failed to decrypt %s: %w", ident.UUID, field, err)
+		}
+		*v = string(plain)
+	}
+	return nil
+}
+
+// sealValue encrypts plain with a random nonce, prepended to the result.
+func sealValue(aead cipher.AEAD, plain []byte, aad string) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, _ = rand.Read(nonce)
+	return aead.Seal(nonce, nonce, plain, []byte(aad))
+}
+
+func openValue(aead cipher.AEAD, encoded, aad string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(aad))
+}
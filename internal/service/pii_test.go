@@ -0,0 +1,207 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+)
+
+// setPIIKeys puts a random key in TEST_PII_KEY_<ID> for each id.
+func setPIIKeys(t *testing.T, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		key := make([]byte, piiKeySize)
+		_, _ = rand.Read(key)
+		t.Setenv("TEST_PII_KEY_"+strings.ToUpper(id), base64.StdEncoding.EncodeToString(key))
+	}
+}
+
+// piiWith builds a cipher holding the keys ids, the first one active, and
+// the index key of testPII.
+func piiWith(t *testing.T, ids ...string) *piiCipher {
+	t.Helper()
+	keys := make(map[string]string, len(ids))
+	for _, id := range ids {
+		keys[id] = "env:TEST_PII_KEY_" + strings.ToUpper(id)
+	}
+	pii, err := newPIICipher(EncryptionConfig{ActiveKey: ids[0], Keys: keys, IndexKey: "env:TEST_PII_INDEX_KEY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pii
+}
+
+func TestPIISealOpen(t *testing.T) {
+	pii := testPII(t)
+	ident := &model.Identity{UUID: uuid.NewString(), Name: "Ana Lúcia", CPF: testCPF}
+
+	row, err := pii.seal(ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.Name != "Ana Lúcia" || ident.CPF != testCPF {
+		t.Fatalf("seal changed the identity: %+v", ident)
+	}
+	if row.Name == ident.Name || row.CPF == ident.CPF || row.CNPJ != "" || !strings.HasPrefix(row.DataKey, "main:") {
+		t.Fatalf("sealed row %+v", row)
+	}
+	if row.CPFIndex != pii.blindIndex(docCPF, testCPF) || row.CNPJIndex != "" || row.NameIndex != pii.nameIndex("ANA LUCIA") {
+		t.Fatalf("blind indexes of %+v", row)
+	}
+
+	// each seal uses a new data key
+	again, err := pii.seal(ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.CPF == row.CPF || again.DataKey == row.DataKey || again.CPFIndex != row.CPFIndex {
+		t.Fatal("sealing twice gave the same ciphertext or another index")
+	}
+
+	opened := *row
+	if err := pii.open(&opened); err != nil {
+		t.Fatal(err)
+	}
+	if opened.Name != ident.Name || opened.CPF != ident.CPF || opened.CNPJ != "" {
+		t.Fatalf("opened %+v", opened)
+	}
+
+	// rows written before encryption are read as they are
+	legacy := &model.Identity{UUID: uuid.NewString(), Name: "Bia", CPF: testCPF}
+	if err := pii.open(legacy); err != nil || legacy.Name != "Bia" {
+		t.Fatalf("legacy row: %v, %+v", err, legacy)
+	}
+
+	if pii.blindIndex(docCPF, "123") == pii.blindIndex(docCNPJ, "123") {
+		t.Error("a CPF and a CNPJ with the same digits share a blind index")
+	}
+}
+
+func TestPIIOpenTampered(t *testing.T) {
+	pii := testPII(t)
+	row, err := pii.seal(&model.Identity{UUID: uuid.NewString(), Name: "Ana", CPF: testCPF, CNPJ: testCNPJ})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := pii.seal(&model.Identity{UUID: uuid.NewString(), Name: "Bia", CPF: "11144477735"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(r *model.Identity)
+	}{
+		{"fields swapped", func(r *model.Identity) { r.CPF, r.CNPJ = r.CNPJ, r.CPF }},
+		{"value from another row", func(r *model.Identity) { r.CPF = other.CPF }},
+		{"data key from another row", func(r *model.Identity) { r.DataKey = other.DataKey }},
+		{"moved to another uuid", func(r *model.Identity) { r.UUID = other.UUID }},
+		{"unknown key", func(r *model.Identity) { r.DataKey = "old" + strings.TrimPrefix(r.DataKey, "main") }},
+		{"not base64", func(r *model.Identity) { r.Name = "Ana" }},
+	}
+	for _, tt := range tests {
+		r := *row
+		tt.tamper(&r)
+		if err := pii.open(&r); err == nil {
+			t.Errorf("%s: opened %+v", tt.name, r)
+		}
+	}
+}
+
+func TestNewPIICipherErrors(t *testing.T) {
+	setPIIKeys(t, "main", "index")
+	t.Setenv("TEST_PII_KEY_SHORT", base64.StdEncoding.EncodeToString([]byte("short")))
+
+	tests := []struct {
+		name string
+		cfg  EncryptionConfig
+	}{
+		{"no active key", EncryptionConfig{Keys: map[string]string{"main": "env:TEST_PII_KEY_MAIN"}, IndexKey: "env:TEST_PII_KEY_INDEX"}},
+		{"active key missing", EncryptionConfig{ActiveKey: "new", Keys: map[string]string{"main": "env:TEST_PII_KEY_MAIN"}, IndexKey: "env:TEST_PII_KEY_INDEX"}},
+		{"short key", EncryptionConfig{ActiveKey: "main", Keys: map[string]string{"main": "env:TEST_PII_KEY_SHORT"}, IndexKey: "env:TEST_PII_KEY_INDEX"}},
+		{"key in the config", EncryptionConfig{ActiveKey: "main", Keys: map[string]string{"main": "c2VjcmV0"}, IndexKey: "env:TEST_PII_KEY_INDEX"}},
+		{"no index key", EncryptionConfig{ActiveKey: "main", Keys: map[string]string{"main": "env:TEST_PII_KEY_MAIN"}}},
+	}
+	for _, tt := range tests {
+		if _, err := newPIICipher(tt.cfg); err == nil {
+			t.Errorf("%s: cipher created", tt.name)
+		}
+	}
+}
+
+func TestRekeyIdentities(t *testing.T) {
+	db := identityDB(t)
+	testPII(t) // sets the index key
+	setPIIKeys(t, "old", "new")
+	before := piiWith(t, "old")
+	ctx := context.Background()
+
+	idents := []model.Identity{
+		{UUID: uuid.NewString(), Name: "Ana", CPF: testCPF},
+		{UUID: uuid.NewString(), Name: "Empresa", CNPJ: testCNPJ},
+		{UUID: uuid.NewString(), Name: "Apagada", CPF: "11144477735"},
+	}
+	for i := range idents {
+		row, err := before.seal(&idents[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Where("uuid = ?", idents[2].UUID).Delete(&model.Identity{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	// written before encryption was enabled
+	legacy := model.Identity{UUID: uuid.NewString(), Name: "Legado", CPF: "39053344705"}
+	if err := db.Create(&legacy).Error; err != nil {
+		t.Fatal(err)
+	}
+	idents = append(idents, legacy)
+
+	var stored []model.Identity
+	if err := db.Unscoped().Order("id").Find(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	rekeyed, encrypted, err := rekeyIdentities(ctx, db, piiWith(t, "new", "old"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed != 4 || encrypted != 1 {
+		t.Fatalf("rekeyed %d, encrypted %d, want 4 and 1", rekeyed, encrypted)
+	}
+
+	// the rows now open with the new key alone, and keep their indexes
+	after := piiWith(t, "new")
+	var rows []model.Identity
+	if err := db.Unscoped().Order("id").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if !strings.HasPrefix(row.DataKey, "new:") {
+			t.Fatalf("%s: data key %s", row.UUID, row.DataKey)
+		}
+		if !row.UpdatedAt.Equal(stored[i].UpdatedAt) {
+			t.Errorf("%s: updated_at changed", row.UUID)
+		}
+		if err := after.open(&row); err != nil {
+			t.Fatal(err)
+		}
+		want := idents[i]
+		if row.UUID != want.UUID || row.Name != want.Name || row.CPF != want.CPF || row.CNPJ != want.CNPJ {
+			t.Errorf("row %d: %+v, want %+v", i, row, want)
+		}
+		if row.CPFIndex != after.blindIndex(docCPF, want.CPF) || row.NameIndex != after.nameIndex(want.Name) {
+			t.Errorf("%s: blind indexes not kept", row.UUID)
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package service
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"gorm.io/gorm"
+)
+
+// headerPrivacyToken carries the token of the data subject requests.
+const headerPrivacyToken = "X-Privacy-Token"
+
+// Operations and erasure modes of the data subject requests.
+const (
+	privacyExport = "export"
+	privacyErase  = "erasure"
+
+	eraseDelete    = "delete"
+	eraseAnonymize = "anonymize"
+)
+
+// PrivacyConfig configures the data subject requests, both secrets given
+// as "env:NAME" or "file:PATH" like the encryption keys. ReceiptKey is the
+// base64 encoded 32 byte Ed25519 seed signing their receipts; Token is the
+// token callers must present in the X-Privacy-Token header.
+type PrivacyConfig struct {
+	ReceiptKey string `yaml:"receiptKey"`
+	Token      string `yaml:"token"`
+}
+
+// PrivacyExportRequest is the body accepted by service.identity.export.
+// Document is the CPF or CNPJ of the data subject; Reason, such as the
+// ticket of the request, is kept in the receipt.
+type PrivacyExportRequest struct {
+	Document string `json:"document"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// PrivacyEraseRequest is the body accepted by service.identity.erase. Mode
+// "delete" removes the records; "anonymize" keeps them without anything
+// that identifies the subject.
+type PrivacyEraseRequest struct {
+	Document string `json:"document"`
+	Mode     string `json:"mode"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// PrivacyReceipt attests a data subject request was served. Signature is
+// the Ed25519 signature, by PublicKey, of the receipt encoded as JSON
+// without it.
+type PrivacyReceipt struct {
+	ID          string    `json:"id"`
+	Operation   string    `json:"operation"`
+	Mode        string    `json:"mode,omitempty"`
+	Subject     string    `json:"subject"`
+	Reason      string    `json:"reason,omitempty"`
+	Identities  int       `json:"identities"`
+	Addresses   int       `json:"addresses"`
+	Transitions int       `json:"transitions"`
+	At          time.Time `json:"at"`
+	PublicKey   string    `json:"public_key"`
+	Signature   string    `json:"signature,omitempty"`
+}
+
+// ExportedIdentity is an identity as held, soft deleted ones included,
+// with its verification history.
+type ExportedIdentity struct {
+	*IdentityRecord
+	DeletedAt   *time.Time         `json:"deleted_at,omitempty"`
+	Transitions []TransitionRecord `json:"transitions"`
+}
+
+// PrivacyExport is everything held about a data subject: the identities
+// with their addresses and history, the receipts of earlier requests and
+// the receipt of this one.
+type PrivacyExport struct {
+	Document   string             `json:"document"`
+	Identities []ExportedIdentity `json:"identities"`
+	Requests   []PrivacyReceipt   `json:"requests"`
+	Receipt    *PrivacyReceipt    `json:"receipt"`
+}
+
+// receiptSigner signs the receipts of data subject requests.
+type receiptSigner struct {
+	key ed25519.PrivateKey
+}
+
+func newReceiptSigner(cfg PrivacyConfig) (*receiptSigner, error) {
+	seed, err := loadPIIKey(cfg.ReceiptKey)
+	if err != nil {
+		return nil, fmt.Errorf("privacy receiptKey: %w", err)
+	}
+	return &receiptSigner{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (s *receiptSigner) sign(r *PrivacyReceipt) error {
+	r.PublicKey = base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, data))
+	return nil
+}
+
+// Verify checks the signature of a receipt against its public key. Callers
+// holding a receipt must also check that key is the one they trust.
+func (r PrivacyReceipt) Verify() error {
+	pub, err := base64.StdEncoding.DecodeString(r.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid receipt public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid receipt signature: %w", err)
+	}
+
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return fmt.Errorf("receipt signature does not match")
+	}
+	return nil
+}
+
+// privacy serves the data subject requests of the LGPD.
+type privacy struct {
+	db     *gorm.DB
+	nc     *nats.Conn
+	pii    *piiCipher
+	signer *receiptSigner
+}
+
+// privacyWorkers returns the export and erasure endpoints of
+// service.identity and the routes they announce. Both take the document in
+// the body so it stays out of URLs, and require the configured token.
+func privacyWorkers(db *gorm.DB, nc *nats.Conn, pii *piiCipher, signer *receiptSigner, token string) ([]endpoint, []AnnouncedRoute) {
+	p := &privacy{db: db, nc: nc, pii: pii, signer: signer}
+	auth := WithMiddleware(tokenMiddleware(token))
+	export := NewWorker("identity-export", "service.identity.export", exportSubject(p), auth)
+	erase := NewWorker("identity-erase", "service.identity.erase", eraseSubject(p), auth)
+
+	routes := []AnnouncedRoute{
+		export.Route(http.MethodPost, "/privacy/export", "10s"),
+		erase.Route(http.MethodPost, "/privacy/erase", "10s"),
+	}
+	for i := range routes {
+		routes[i].Headers = []string{headerPrivacyToken}
+	}
+	return []endpoint{export, erase}, routes
+}
+
+func exportSubject(p *privacy) HandlerFunc[PrivacyExportRequest, *PrivacyExport] {
+	return func(ctx context.Context, req *Request[PrivacyExportRequest]) (*PrivacyExport, error) {
+		kind, doc, err := subjectDocument(req.Body.Document)
+		if err != nil {
+			return nil, err
+		}
+		subject := p.pii.blindIndex(kind, doc)
+
+		resp := &PrivacyExport{Document: doc, Identities: []ExportedIdentity{}, Requests: []PrivacyReceipt{}}
+		receipt := &PrivacyReceipt{Operation: privacyExport, Subject: subject, Reason: req.Body.Reason}
+
+		err = p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			idents, err := p.subjectIdentities(tx, kind, doc)
+			if err != nil {
+				return err
+			}
+
+			for i := range idents {
+				ident := &idents[i]
+				var rows []model.IdentityTransition
+				if err := tx.Unscoped().Where("identity_id = ?", ident.ID).Order("id").Find(&rows).Error; err != nil {
+					return err
+				}
+
+				exp := ExportedIdentity{IdentityRecord: identityRecord(ident), Transitions: make([]TransitionRecord, 0, len(rows))}
+				if ident.DeletedAt.Valid {
+					exp.DeletedAt = &ident.DeletedAt.Time
+				}
+				for j := range rows {
+					exp.Transitions = append(exp.Transitions, *transitionRecord(&rows[j]))
+				}
+				resp.Identities = append(resp.Identities, exp)
+
+				receipt.Transitions += len(rows)
+				if ident.Address != nil {
+					receipt.Addresses++
+				}
+			}
+			receipt.Identities = len(idents)
+
+			var audits []model.PrivacyAudit
+			if err := tx.Where("subject = ?", subject).Order("id").Find(&audits).Error; err != nil {
+				return err
+			}
+			for _, a := range audits {
+				var r PrivacyReceipt
+				if err := json.Unmarshal([]byte(a.Receipt), &r); err != nil {
+					return fmt.Errorf("receipt %s: %w", a.UUID, err)
+				}
+				resp.Requests = append(resp.Requests, r)
+			}
+
+			return p.record(tx, receipt)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Receipt = receipt
+		log.Printf("[identity-export] exported %d identities, receipt %s", receipt.Identities, receipt.ID)
+		return resp, nil
+	}
+}
+
+// eraseSubject removes a data subject for good, soft deleted identities
+// included. Deleting removes the identities, their addresses and their
+// history. Anonymizing keeps them for statistics: names, documents and
+// their hashes are cleared, the UUID is replaced, the address keeps only
+// its city and state, the history loses its reasons and the identities
+// are soft deleted.
+func eraseSubject(p *privacy) HandlerFunc[PrivacyEraseRequest, *PrivacyReceipt] {
+	return func(ctx context.Context, req *Request[PrivacyEraseRequest]) (*PrivacyReceipt, error) {
+		mode := strings.ToLower(strings.TrimSpace(req.Body.Mode))
+		if mode != eraseDelete && mode != eraseAnonymize {
+			return nil, errBadRequest("mode must be %s or %s", eraseDelete, eraseAnonymize)
+		}
+		kind, doc, err := subjectDocument(req.Body.Document)
+		if err != nil {
+			return nil, err
+		}
+
+		receipt := &PrivacyReceipt{
+			Operation: privacyErase,
+			Mode:      mode,
+			Subject:   p.pii.blindIndex(kind, doc),
+			Reason:    req.Body.Reason,
+		}
+		var erased []string
+
+		err = p.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			idents, err := p.subjectIdentities(tx, kind, doc)
+			if err != nil {
+				return err
+			}
+			receipt.Identities = len(idents)
+			if len(idents) == 0 {
+				return p.record(tx, receipt)
+			}
+
+			ids := make([]uint, 0, len(idents))
+			for _, ident := range idents {
+				ids = append(ids, ident.ID)
+				erased = append(erased, ident.UUID)
+			}
+
+			var addrs, trans *gorm.DB
+			if mode == eraseDelete {
+				addrs = tx.Unscoped().Where("identity_id IN ?", ids).Delete(&model.Address{})
+				trans = tx.Unscoped().Where("identity_id IN ?", ids).Delete(&model.IdentityTransition{})
+			} else {
+				addrs = tx.Unscoped().Model(&model.Address{}).Where("identity_id IN ?", ids).
+					Updates(map[string]any{"cep": "", "street": "", "number": "", "complement": "", "neighborhood": ""})
+				trans = tx.Unscoped().Model(&model.IdentityTransition{}).Where("identity_id IN ?", ids).
+					Update("reason", "")
+			}
+			if addrs.Error != nil {
+				return addrs.Error
+			}
+			if trans.Error != nil {
+				return trans.Error
+			}
+			receipt.Addresses, receipt.Transitions = int(addrs.RowsAffected), int(trans.RowsAffected)
+
+			if mode == eraseDelete {
+				if err := tx.Unscoped().Delete(&model.Identity{}, ids).Error; err != nil {
+					return err
+				}
+			} else {
+				for _, id := range ids {
+					err := tx.Unscoped().Model(&model.Identity{}).Where("id = ?", id).Updates(map[string]any{
+						"uuid":       uuid.NewString(),
+						"name":       "",
+						"cpf":        "",
+						"cnpj":       "",
+						"name_index": "",
+						"cpf_index":  "",
+						"cnpj_index": "",
+						"data_key":   "",
+						"deleted_at": gorm.Expr("COALESCE(deleted_at, ?)", time.Now()),
+					}).Error
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			return p.record(tx, receipt)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, id := range erased {
+			data, _ := json.Marshal(IdentityEvent{ID: id, To: "erased", Reason: mode, At: receipt.At})
+			if err := p.nc.Publish(subjectIdentityEvents+".erased", data); err != nil {
+				log.Printf("[identity-erase] error publishing event for %s: %v", id, err)
+			}
+		}
+
+		log.Printf("[identity-erase] %s %d identities, receipt %s", mode, receipt.Identities, receipt.ID)
+		return receipt, nil
+	}
+}
+
+// tokenMiddleware rejects requests without the token in X-Privacy-Token,
+// forwarded by the gateway as a header parameter. The NATS subjects are
+// open to any client of the account, so the check is made here rather than
+// in the gateway.
+func tokenMiddleware(token string) Middleware {
+	want := []byte(token)
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, r micro.Request) {
+			got := []byte(msgParam(r.Headers(), paramHeader, headerPrivacyToken))
+			if subtle.ConstantTimeCompare(got, want) != 1 {
+				_ = respondError(r, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next(ctx, r)
+		}
+	}
+}
+
+// subjectIdentities finds the identities, soft deleted ones included, of a
+// document, with their addresses. Rows stored before encryption was
+// enabled are matched on the clear document.
+func (p *privacy) subjectIdentities(tx *gorm.DB, kind, doc string) ([]model.Identity, error) {
+	var idents []model.Identity
+	err := tx.Unscoped().Preload("Address").
+		Where(kind+"_index = ? OR (COALESCE(data_key, '') = '' AND "+kind+" = ?)", p.pii.blindIndex(kind, doc), doc).
+		Order("id").Find(&idents).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range idents {
+		if err := p.pii.open(&idents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return idents, nil
+}
+
+// record signs the receipt and stores it in the audit table.
+func (p *privacy) record(tx *gorm.DB, r *PrivacyReceipt) error {
+	r.ID, r.At = uuid.NewString(), time.Now().UTC()
+	if err := p.signer.sign(r); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return tx.Create(&model.PrivacyAudit{UUID: r.ID, Operation: r.Operation, Subject: r.Subject, Receipt: string(data)}).Error
+}
+
+// subjectDocument validates the CPF or CNPJ of a data subject and returns
+// its kind and unmasked form.
+func subjectDocument(doc string) (string, string, error) {
+	kind := docCNPJ
+	if len(unmask(doc)) == 11 {
+		kind = docCPF
+	}
+
+	doc, err := identityDocument(kind, doc)
+	if err != nil {
+		return "", "", err
+	}
+	if doc == "" {
+		return "", "", errBadRequest("missing document")
+	}
+	return kind, doc, nil
+}
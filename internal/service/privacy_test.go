@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+)
+
+func testSigner(t *testing.T, id string) *receiptSigner {
+	t.Helper()
+	setPIIKeys(t, id)
+	signer, err := newReceiptSigner(PrivacyConfig{ReceiptKey: "env:TEST_PII_KEY_" + id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestReceiptSignVerify(t *testing.T) {
+	signer := testSigner(t, "RECEIPT")
+	other := testSigner(t, "OTHER")
+
+	receipt := PrivacyReceipt{
+		ID:         uuid.NewString(),
+		Operation:  privacyErase,
+		Mode:       eraseDelete,
+		Subject:    "subject",
+		Identities: 2,
+		Addresses:  1,
+		At:         time.Now().UTC(),
+	}
+	if err := signer.sign(&receipt); err != nil {
+		t.Fatal(err)
+	}
+	if err := receipt.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receipt verifies as stored and returned, encoded as JSON
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded PrivacyReceipt
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := decoded.Verify(); err != nil {
+		t.Fatalf("decoded receipt: %v", err)
+	}
+
+	forged := receipt
+	if err := other.sign(&forged); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(r *PrivacyReceipt)
+	}{
+		{"identities", func(r *PrivacyReceipt) { r.Identities = 1 }},
+		{"mode", func(r *PrivacyReceipt) { r.Mode = eraseAnonymize }},
+		{"subject", func(r *PrivacyReceipt) { r.Subject = "another" }},
+		{"time", func(r *PrivacyReceipt) { r.At = r.At.Add(time.Second) }},
+		{"public key", func(r *PrivacyReceipt) { r.PublicKey = forged.PublicKey }},
+		{"signature", func(r *PrivacyReceipt) { r.Signature = forged.Signature }},
+		{"no signature", func(r *PrivacyReceipt) { r.Signature = "" }},
+		{"bad public key", func(r *PrivacyReceipt) { r.PublicKey = base64.StdEncoding.EncodeToString([]byte("short")) }},
+	}
+	for _, tt := range tests {
+		r := receipt
+		tt.tamper(&r)
+		if err := r.Verify(); err == nil {
+			t.Errorf("%s changed: receipt verifies", tt.name)
+		}
+	}
+	if err := forged.Verify(); err != nil {
+		t.Errorf("receipt signed by another key: %v", err)
+	}
+}
+
+func TestPrivacyReceipts(t *testing.T) {
+	db := testDB(t, &model.Identity{}, &model.Address{}, &model.IdentityTransition{}, &model.PrivacyAudit{})
+	p := &privacy{db: db, nc: testNats(t), pii: testPII(t), signer: testSigner(t, "RECEIPT")}
+	ctx := context.Background()
+
+	row, err := p.pii.seal(&model.Identity{UUID: uuid.NewString(), Name: "Ana", CPF: testCPF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(row).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	erased, err := eraseSubject(p)(ctx, &Request[PrivacyEraseRequest]{
+		Body: PrivacyEraseRequest{Document: "529.982.247-25", Mode: eraseDelete, Reason: "ticket 1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if erased.Identities != 1 || erased.Subject != p.pii.blindIndex(docCPF, testCPF) {
+		t.Fatalf("erasure receipt %+v", erased)
+	}
+	if err := erased.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the export lists the stored receipt of the erasure, still verifiable,
+	// and returns its own
+	export, err := exportSubject(p)(ctx, &Request[PrivacyExportRequest]{Body: PrivacyExportRequest{Document: testCPF}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Identities) != 0 || len(export.Requests) != 1 || export.Requests[0].ID != erased.ID {
+		t.Fatalf("export %+v", export)
+	}
+	if err := export.Requests[0].Verify(); err != nil {
+		t.Fatalf("stored erasure receipt: %v", err)
+	}
+	if err := export.Receipt.Verify(); err != nil {
+		t.Fatalf("export receipt: %v", err)
+	}
+}
+
+func TestPrivacyAnnouncedRoutes(t *testing.T) {
+	db := testDB(t, &model.Identity{}, &model.Address{}, &model.IdentityTransition{}, &model.PrivacyAudit{})
+	nc := testNats(t)
+	eps, routes := privacyWorkers(db, nc, testPII(t), testSigner(t, "RECEIPT"), "t0ken")
+	startTestService(t, nc, eps...)
+
+	// the spec of testProxy does not declare the privacy routes, so they
+	// are only served as announced
+	px := testProxy(t, nc, "s3cret")
+	px.announce(RouteAnnouncement{Service: "identity", Instance: "a", Routes: routes})
+	waitRoutes(t, px, "GET-/v1/health/spec service.spec",
+		"POST-/v1/privacy/export service.identity.export", "POST-/v1/privacy/erase service.identity.erase")
+
+	tests := []struct {
+		path, token string
+		status      int
+	}{
+		{"/v1/privacy/export", "t0ken", http.StatusOK},
+		{"/v1/privacy/export", "", http.StatusUnauthorized},
+		{"/v1/privacy/export", "wrong", http.StatusUnauthorized},
+		{"/v1/privacy/erase", "t0ken", http.StatusOK},
+		{"/v1/privacy/erase", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		body := `{"document": "529.982.247-25", "mode": "delete"}`
+		req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.token != "" {
+			req.Header.Set(headerPrivacyToken, tt.token)
+		}
+		rec := httptest.NewRecorder()
+		px.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s with token %q: status %d, want %d: %s", tt.path, tt.token, rec.Code, tt.status, rec.Body.String())
+		}
+	}
+}
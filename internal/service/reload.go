@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// reloadDebounce groups the burst of events editors emit on a single save.
+const reloadDebounce = 300 * time.Millisecond
+
+// apply builds a router for the spec and swaps it in. On any error the
+// previously active routing is left untouched.
+func (p *Proxy) apply(doc *openapi3.T) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	routes, err := p.buildRoutes(doc)
+	if err != nil {
+		return err
+	}
+	basePath, err := specBasePath(doc)
+	if err != nil {
+		return err
+	}
+
+	prev, prevBase := p.specRoutes, p.basePath
+	p.specRoutes, p.basePath = routes, basePath
+	if err := p.rebuildLocked(); err != nil {
+		p.specRoutes, p.basePath = prev, prevBase
+		return err
+	}
+
+	return nil
+}
+
+// rebuildLocked merges the spec routes with the ones announced by workers,
+// spec routes taking precedence, and swaps in a router serving them. The
+// caller must hold p.mu.
+func (p *Proxy) rebuildLocked() error {
+	routes := make(map[string]*Route, len(p.specRoutes))
+	for _, inst := range p.announced {
+		for _, ar := range inst.routes {
+			// checked when announced, under the base path of that time
+			if r, err := announcedRoute(ar, p.basePath); err == nil {
+				routes[fmt.Sprintf("%s-%s", r.method, r.target)] = r
+			}
+		}
+	}
+	for k, r := range p.specRoutes {
+		routes[k] = r
+	}
+
+	engine, err := p.buildEngine(routes)
+	if err != nil {
+		return err
+	}
+
+	added, removed, changed := diffRoutes(p.registeredRoutes, routes)
+	p.registeredRoutes = routes
+	p.engine.Store(engine)
+
+	for _, k := range added {
+		log.Printf("[api] route added %s -> %s", k, routes[k].subject)
+	}
+	for _, k := range removed {
+		log.Printf("[api] route removed %s", k)
+	}
+	for _, k := range changed {
+		log.Printf("[api] route changed %s -> %s", k, routes[k].subject)
+	}
+
+	return nil
+}
+
+// reload loads the spec from data and applies it, logging rejected specs.
+func (p *Proxy) reload(source, filePath string, data []byte) {
+	var (
+		doc *openapi3.T
+		err error
+	)
+
+	if data == nil {
+		doc, err = loadOpenAPI(filePath)
+	} else {
+		doc, err = loadOpenAPIData(filePath, data)
+	}
+	if err == nil {
+		err = p.apply(doc)
+	}
+	if err != nil {
+		log.Printf("[api] rejected spec from %s, keeping previous routes: %v", source, err)
+		return
+	}
+
+	p.mu.Lock()
+	n := len(p.registeredRoutes)
+	p.mu.Unlock()
+
+	log.Printf("[api] reloaded spec from %s (%d routes)", source, n)
+}
+
+// watchFile reloads the spec whenever the file changes on disk. The parent
+// directory is watched so editors replacing the file by rename are seen too.
+func (p *Proxy) watchFile(ctx context.Context, filePath string) error {
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("error resolving OpenAPI path: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating spec watcher: %w", err)
+	}
+
+	if err := watcher.Add(filepath.Dir(abs)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("error watching %s: %w", abs, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var timer *time.Timer
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != abs || !ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDebounce, func() { p.reload(abs, abs, nil) })
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[api] spec watcher error: %v", err)
+			}
+		}
+	}()
+
+	log.Printf("[api] watching %s for changes", abs)
+	return nil
+}
+
+// watchKV reloads the spec from a NATS KV key. filePath is only used as
+// the base location for relative $refs.
+func (p *Proxy) watchKV(ctx context.Context, kvCfg OpenApiKV, filePath string) error {
+	js, err := jetstream.New(p.nc)
+	if err != nil {
+		return fmt.Errorf("error creating jetstream context: %w", err)
+	}
+
+	kv, err := js.KeyValue(ctx, kvCfg.Bucket)
+	if err != nil {
+		return fmt.Errorf("error opening kv bucket %s: %w", kvCfg.Bucket, err)
+	}
+
+	key := kvCfg.Key
+	if key == "" {
+		key = "openapi"
+	}
+
+	w, err := kv.Watch(ctx, key)
+	if err != nil {
+		return fmt.Errorf("error watching kv key %s: %w", key, err)
+	}
+
+	source := fmt.Sprintf("kv %s/%s", kvCfg.Bucket, key)
+	go func() {
+		defer func() { _ = w.Stop() }()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-w.Updates():
+				if !ok {
+					return
+				}
+				// a nil entry marks the end of the initial values
+				if entry == nil || entry.Operation() != jetstream.KeyValuePut {
+					continue
+				}
+				p.reload(source, filePath, entry.Value())
+			}
+		}
+	}()
+
+	log.Printf("[api] watching %s for changes", source)
+	return nil
+}
+
+// diffRoutes returns the sorted keys added, removed and changed between two route sets.
+func diffRoutes(prev, next map[string]*Route) (added, removed, changed []string) {
+	for k, r := range next {
+		old, ok := prev[k]
+		switch {
+		case !ok:
+			added = append(added, k)
+		case !sameRoute(old, r):
+			changed = append(changed, k)
+		}
+	}
+
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			removed = append(removed, k)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+func sameRoute(a, b *Route) bool {
+	if a.subject != b.subject || a.timeout != b.timeout || a.batch != b.batch {
+		return false
+	}
+
+	ja, errA := json.Marshal(a.operation)
+	jb, errB := json.Marshal(b.operation)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestDiffRoutes(t *testing.T) {
+	route := func(subject string, timeout time.Duration, batch int) *Route {
+		return &Route{subject: subject, timeout: timeout, batch: batch, operation: openapi3.NewOperation()}
+	}
+	prev := map[string]*Route{
+		"GET-/a":  route("service.a", time.Second, 0),
+		"POST-/b": route("service.b", time.Second, 100),
+		"POST-/c": route("service.c", time.Second, 0),
+		"GET-/d":  route("service.d", time.Second, 0),
+	}
+	next := map[string]*Route{
+		"GET-/a":  route("service.a", time.Second, 0),
+		"POST-/b": route("service.b", time.Second, 500),
+		"POST-/c": route("service.c", 2*time.Second, 0),
+		"GET-/e":  route("service.e", time.Second, 0),
+	}
+
+	added, removed, changed := diffRoutes(prev, next)
+	if !equalStrings(added, []string{"GET-/e"}) {
+		t.Errorf("added = %v", added)
+	}
+	if !equalStrings(removed, []string{"GET-/d"}) {
+		t.Errorf("removed = %v", removed)
+	}
+	if !equalStrings(changed, []string{"POST-/b", "POST-/c"}) {
+		t.Errorf("changed = %v", changed)
+	}
+}
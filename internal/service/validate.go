@@ -0,0 +1,115 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+)
+
+// ValidationError points at a single violation inside the request body.
+type ValidationError struct {
+	Pointer string `json:"pointer"`
+	Keyword string `json:"keyword,omitempty"`
+	Reason  string `json:"reason"`
+}
+
+// stringFormats are the formats request bodies are checked against.
+// kin-openapi only looks formats up in its package-level registry, with no
+// per-loader or per-request option, so they are added there the first time
+// a body is validated rather than when the package is imported, and never
+// replace a format defined elsewhere.
+var stringFormats = map[string]openapi3.StringFormatValidator{
+	"email": openapi3.NewRegexpFormatValidator(openapi3.FormatOfStringForEmail),
+	"uuid":  openapi3.NewRegexpFormatValidator(openapi3.FormatOfStringForUUIDOfRFC4122),
+	"ipv4":  openapi3.NewIPValidator(true),
+	"ipv6":  openapi3.NewIPValidator(false),
+}
+
+var defineFormats sync.Once
+
+func defineStringFormats() {
+	for name, validator := range stringFormats {
+		if _, ok := openapi3.SchemaStringFormats[name]; !ok {
+			openapi3.DefineStringFormatValidator(name, validator)
+		}
+	}
+}
+
+// validateRequestBody checks the incoming body against the operation
+// requestBody schema. The body is left readable for the proxy afterwards,
+// with schema defaults applied.
+func validateRequestBody(ctx context.Context, req *http.Request, operation *openapi3.Operation) []ValidationError {
+	if operation == nil || operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return nil
+	}
+	defineFormats.Do(defineStringFormats)
+
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	input := &openapi3filter.RequestValidationInput{
+		Request: req,
+		Options: &openapi3filter.Options{MultiError: true},
+	}
+
+	err := openapi3filter.ValidateRequestBody(ctx, input, operation.RequestBody.Value)
+	if err == nil {
+		return nil
+	}
+
+	return collectValidationErrors(err)
+}
+
+func collectValidationErrors(err error) []ValidationError {
+	var multi openapi3.MultiError
+	if errors.As(err, &multi) {
+		out := make([]ValidationError, 0, len(multi))
+		for _, e := range multi {
+			out = append(out, collectValidationErrors(e)...)
+		}
+		return out
+	}
+
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return []ValidationError{{
+			Pointer: jsonPointer(schemaErr.JSONPointer()),
+			Keyword: schemaErr.SchemaField,
+			Reason:  schemaErr.Reason,
+		}}
+	}
+
+	var reqErr *openapi3filter.RequestError
+	if errors.As(err, &reqErr) {
+		if errors.As(reqErr.Err, &multi) || errors.As(reqErr.Err, &schemaErr) {
+			return collectValidationErrors(reqErr.Err)
+		}
+		if errors.Is(reqErr.Err, openapi3filter.ErrInvalidRequired) {
+			return []ValidationError{{Pointer: "", Keyword: "required", Reason: "request body is required"}}
+		}
+	}
+
+	return []ValidationError{{Pointer: "", Reason: err.Error()}}
+}
+
+// jsonPointer renders reference tokens as an RFC 6901 pointer.
+func jsonPointer(tokens []string) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteByte('/')
+		sb.WriteString(escaper.Replace(t))
+	}
+
+	return sb.String()
+}
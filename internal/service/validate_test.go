@@ -0,0 +1,43 @@
+package service
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+func TestValidateRequestBodyFormats(t *testing.T) {
+	schema := openapi3.NewObjectSchema().
+		WithProperty("email", openapi3.NewStringSchema().WithFormat("email")).
+		WithProperty("id", openapi3.NewStringSchema().WithFormat("uuid")).
+		WithProperty("ip", openapi3.NewStringSchema().WithFormat("ipv4"))
+	operation := openapi3.NewOperation()
+	operation.RequestBody = &openapi3.RequestBodyRef{
+		Value: openapi3.NewRequestBody().WithRequired(true).WithJSONSchema(schema),
+	}
+
+	tests := []struct {
+		body string
+		want []string
+	}{
+		{`{"email":"ana@example.com","id":"6f1c1b9e-2f4a-4d8e-9c1a-3b5e7d9f1a2b","ip":"10.0.0.1"}`, nil},
+		{`{"email":"ana"}`, []string{"/email"}},
+		{`{"id":"42"}`, []string{"/id"}},
+		{`{"ip":"::1"}`, []string{"/ip"}},
+		{`{"email":"ana","ip":"x"}`, []string{"/email", "/ip"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		details := validateRequestBody(context.Background(), req, operation)
+		got := make([]string, 0, len(details))
+		for _, d := range details {
+			got = append(got, d.Pointer)
+		}
+		if !equalStrings(got, tt.want) {
+			t.Errorf("%s: violations at %v (%+v), want %v", tt.body, got, details, tt.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/nats-io/nats.go"
+	"gorm.io/gorm"
+)
+
+// Verification states of an identity.
+const (
+	statusPending         = "pending"
+	statusDocumentChecked = "document-checked"
+	statusAddressChecked  = "address-checked"
+	statusVerified        = "verified"
+	statusRejected        = "rejected"
+)
+
+// verificationTransitions lists the states each state may move to. Any
+// state returns to pending when the documents of the identity change.
+var verificationTransitions = map[string][]string{
+	statusPending:         {statusDocumentChecked, statusRejected},
+	statusDocumentChecked: {statusAddressChecked, statusRejected, statusPending},
+	statusAddressChecked:  {statusVerified, statusRejected, statusPending},
+	statusVerified:        {statusPending},
+	statusRejected:        {statusPending},
+}
+
+// subjectIdentityEvents prefixes the state change events, published as
+// events.identity.<state>.
+const subjectIdentityEvents = "events.identity"
+
+// IdentityEvent is published on every state change.
+type IdentityEvent struct {
+	ID     string    `json:"id"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// TransitionRecord is the public form of model.IdentityTransition.
+type TransitionRecord struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// VerifyRequest is the body accepted by service.identity.verify. The CEP
+// of the identity's address is confirmed on service.cep and, when given,
+// must lie in City and State. Without a CEP the stored address is used.
+type VerifyRequest struct {
+	ID    string `json:"id,omitempty"`
+	CEP   string `json:"cep,omitempty" pattern:"^[0-9]{5}-?[0-9]{3}$"`
+	City  string `json:"city,omitempty"`
+	State string `json:"state,omitempty" pattern:"^[A-Za-z]{2}$"`
+}
+
+// VerifyResponse is the identity after a verification run and the
+// transitions the run made.
+type VerifyResponse struct {
+	Identity    *IdentityRecord    `json:"identity"`
+	Transitions []TransitionRecord `json:"transitions"`
+}
+
+// TransitionsResponse is the verification history of an identity.
+type TransitionsResponse struct {
+	Transitions []TransitionRecord `json:"transitions"`
+}
+
+// verifier moves identities through the verification states, recording
+// each transition and announcing it on NATS.
+type verifier struct {
+	db  *gorm.DB
+	nc  *nats.Conn
+	pii *piiCipher
+}
+
+// transition moves ident from its current state to `to`. The update only
+// applies if no one changed the state meanwhile.
+func (v *verifier) transition(ctx context.Context, ident *model.Identity, to, reason string) (*TransitionRecord, error) {
+	from := ident.Status
+	if !slices.Contains(verificationTransitions[from], to) {
+		return nil, errConflict("cannot move from %s to %s", from, to)
+	}
+
+	rec := model.IdentityTransition{IdentityID: ident.ID, From: from, To: to, Reason: reason}
+	err := v.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&model.Identity{}).
+			Where("id = ? AND status = ?", ident.ID, from).
+			Updates(map[string]any{"status": to, "verified": to == statusVerified})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errConflict("identity %s changed state concurrently", ident.UUID)
+		}
+		return tx.Create(&rec).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ident.Status, ident.Verified = to, to == statusVerified
+	tr := transitionRecord(&rec)
+
+	data, _ := json.Marshal(IdentityEvent{ID: ident.UUID, From: from, To: to, Reason: reason, At: tr.At})
+	if err := v.nc.Publish(subjectIdentityEvents+"."+to, data); err != nil {
+		log.Printf("[identity-verify] error publishing event for %s: %v", ident.UUID, err)
+	}
+
+	return tr, nil
+}
+
+// verifyIdentity runs the checks left for an identity: its documents on
+// service.cpfcnpj, then its address on service.cep. A failed check rejects
+// the identity; an unavailable service leaves it in its current state so
+// the run can be retried. A rejected identity starts over.
+func verifyIdentity(v *verifier) HandlerFunc[VerifyRequest, *VerifyResponse] {
+	return func(ctx context.Context, req *Request[VerifyRequest]) (*VerifyResponse, error) {
+		ident, err := findIdentity(ctx, v.db, v.pii, identityID(req, req.Body.ID))
+		if err != nil {
+			return nil, err
+		}
+		if ident.Status == statusVerified {
+			return nil, errConflict("identity %s is already verified", ident.UUID)
+		}
+
+		resp := &VerifyResponse{Transitions: []TransitionRecord{}}
+		move := func(to, reason string) error {
+			tr, err := v.transition(ctx, ident, to, reason)
+			if err != nil {
+				return err
+			}
+			resp.Transitions = append(resp.Transitions, *tr)
+			return nil
+		}
+
+		if ident.Status == statusRejected {
+			if err := move(statusPending, "verification restarted"); err != nil {
+				return nil, err
+			}
+		}
+
+		for ident.Status != statusVerified && ident.Status != statusRejected {
+			var to, reason string
+			switch ident.Status {
+			case statusPending:
+				to, reason, err = v.checkDocuments(ctx, ident)
+			case statusDocumentChecked:
+				to, reason, err = v.checkAddress(ctx, ident, req.Body)
+			case statusAddressChecked:
+				to, reason = statusVerified, "all checks passed"
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := move(to, reason); err != nil {
+				return nil, err
+			}
+		}
+
+		resp.Identity = identityRecord(ident)
+		return resp, nil
+	}
+}
+
+// checkDocuments validates the CPF and CNPJ of ident on service.cpfcnpj.
+func (v *verifier) checkDocuments(ctx context.Context, ident *model.Identity) (string, string, error) {
+	for _, doc := range []struct{ kind, value string }{{docCPF, ident.CPF}, {docCNPJ, ident.CNPJ}} {
+		if doc.value == "" {
+			continue
+		}
+
+		var resp CpfCnpjResponse
+		status, err := callService(ctx, v.nc, "service.cpfcnpj", CpfCnpjRequest{CpfCnpj: doc.value}, &resp)
+		if err != nil || status >= http.StatusInternalServerError {
+			log.Printf("[identity-verify] error validating %s of %s: status %d: %v", doc.kind, ident.UUID, status, err)
+			return "", "", errUnavailable("document validation unavailable")
+		}
+		if status != http.StatusOK || !resp.IsValid || resp.Type != doc.kind {
+			return statusRejected, doc.kind + " invalid", nil
+		}
+	}
+
+	return statusDocumentChecked, "documents valid", nil
+}
+
+// checkAddress confirms the CEP on service.cep and that it lies in the
+// given city and state, or those of the identity's address.
+func (v *verifier) checkAddress(ctx context.Context, ident *model.Identity, body VerifyRequest) (string, string, error) {
+	if body.CEP == "" && ident.Address != nil {
+		body.CEP, body.City, body.State = ident.Address.CEP, ident.Address.City, ident.Address.State
+	}
+	cep := normalizeCEP(body.CEP)
+	if len(cep) != 8 {
+		return "", "", errBadRequest("cep is required to check the address")
+	}
+
+	var addr CepAddress
+	status, err := callService(ctx, v.nc, "service.cep", CepRequest{CEP: cep}, &addr)
+	switch {
+	case err != nil:
+		log.Printf("[identity-verify] error looking up cep %s: %v", cep, err)
+		return "", "", errUnavailable("address lookup unavailable")
+	case status == http.StatusNotFound:
+		return statusRejected, fmt.Sprintf("cep %s not found", cep), nil
+	case status != http.StatusOK:
+		return "", "", errUnavailable("address lookup unavailable")
+	}
+
+	if body.State != "" && !strings.EqualFold(body.State, addr.UF) {
+		return statusRejected, fmt.Sprintf("cep %s is in %s, not %s", cep, addr.UF, strings.ToUpper(body.State)), nil
+	}
+	if body.City != "" && model.SearchKey(body.City) != model.SearchKey(addr.Cidade) {
+		return statusRejected, fmt.Sprintf("cep %s is in %s, not %s", cep, addr.Cidade, body.City), nil
+	}
+
+	return statusAddressChecked, fmt.Sprintf("cep %s in %s/%s", cep, addr.Cidade, addr.UF), nil
+}
+
+// listTransitions returns the verification history of an identity, oldest first.
+func listTransitions(db *gorm.DB, pii *piiCipher) HandlerFunc[IdentityIDRequest, *TransitionsResponse] {
+	return func(ctx context.Context, req *Request[IdentityIDRequest]) (*TransitionsResponse, error) {
+		ident, err := findIdentity(ctx, db, pii, identityID(req, req.Body.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		var rows []model.IdentityTransition
+		if err := db.WithContext(ctx).Where("identity_id = ?", ident.ID).Order("id").Find(&rows).Error; err != nil {
+			return nil, err
+		}
+
+		resp := &TransitionsResponse{Transitions: make([]TransitionRecord, 0, len(rows))}
+		for i := range rows {
+			resp.Transitions = append(resp.Transitions, *transitionRecord(&rows[i]))
+		}
+		return resp, nil
+	}
+}
+
+func transitionRecord(t *model.IdentityTransition) *TransitionRecord {
+	return &TransitionRecord{From: t.From, To: t.To, Reason: t.Reason, At: t.CreatedAt}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// verificationStubs serves service.cpfcnpj, accepting testCPF and testCNPJ
+// only, and service.cep, knowing 01001-000 in São Paulo, SP. Each fails
+// while its flag is set.
+func verificationStubs(t *testing.T, nc *nats.Conn) (docsDown, cepDown *atomic.Bool) {
+	t.Helper()
+	docsDown, cepDown = new(atomic.Bool), new(atomic.Bool)
+
+	docs := NewWorker("cpfcnpj", "service.cpfcnpj", func(_ context.Context, req *Request[CpfCnpjRequest]) (*CpfCnpjResponse, error) {
+		if docsDown.Load() {
+			return nil, errUnavailable("down")
+		}
+		switch req.Body.CpfCnpj {
+		case testCPF:
+			return &CpfCnpjResponse{Document: testCPF, Type: docCPF, IsValid: true}, nil
+		case testCNPJ:
+			return &CpfCnpjResponse{Document: testCNPJ, Type: docCNPJ, IsValid: true}, nil
+		}
+		return &CpfCnpjResponse{Document: req.Body.CpfCnpj, Type: docCPF}, nil
+	})
+	cep := NewWorker("cep", "service.cep", func(_ context.Context, req *Request[CepRequest]) (*CepAddress, error) {
+		if cepDown.Load() {
+			return nil, errUnavailable("down")
+		}
+		if req.Body.CEP != "01001000" {
+			return nil, errNotFound("cep %s not found", req.Body.CEP)
+		}
+		return &CepAddress{CEP: "01001000", Logradouro: "Praça da Sé", Bairro: "Sé", Cidade: "São Paulo", UF: "SP"}, nil
+	})
+	startTestService(t, nc, docs, cep)
+	return docsDown, cepDown
+}
+
+// storeIdentity saves a pending identity and returns its id.
+func storeIdentity(t *testing.T, v *verifier, ident model.Identity) string {
+	t.Helper()
+	ident.UUID = uuid.NewString()
+	ident.Status = statusPending
+	row, err := v.pii.seal(&ident)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.db.Create(row).Error; err != nil {
+		t.Fatal(err)
+	}
+	return ident.UUID
+}
+
+func transitionStates(resp *VerifyResponse) []string {
+	out := make([]string, 0, len(resp.Transitions))
+	for _, tr := range resp.Transitions {
+		out = append(out, tr.To)
+	}
+	return out
+}
+
+func TestVerifyIdentity(t *testing.T) {
+	nc := testNats(t)
+	v := &verifier{db: identityDB(t), nc: nc, pii: testPII(t)}
+	verificationStubs(t, nc)
+	verify := verifyIdentity(v)
+
+	se := func() *model.Address {
+		return &model.Address{CEP: "01001000", Street: "Praça da Sé", Number: "1", City: "São Paulo", State: "SP"}
+	}
+	all := []string{statusDocumentChecked, statusAddressChecked, statusVerified}
+
+	tests := []struct {
+		name   string
+		ident  model.Identity
+		body   VerifyRequest
+		states []string
+		reason string
+	}{
+		{"verified", model.Identity{Name: "Ana", CPF: testCPF, CNPJ: testCNPJ, Address: se()}, VerifyRequest{}, all, "all checks passed"},
+		{"cep given", model.Identity{Name: "Bia"}, VerifyRequest{CEP: "01001-000", City: "sao paulo", State: "sp"}, all, "all checks passed"},
+		{"invalid document", model.Identity{Name: "Caio", CPF: "12345678900", Address: se()}, VerifyRequest{}, []string{statusRejected}, "cpf invalid"},
+		{"unknown cep", model.Identity{Name: "Davi"}, VerifyRequest{CEP: "99999-999"}, []string{statusDocumentChecked, statusRejected}, "cep 99999999 not found"},
+		{"other state", model.Identity{Name: "Eva", Address: se()}, VerifyRequest{CEP: "01001000", State: "RJ"}, []string{statusDocumentChecked, statusRejected}, "cep 01001000 is in SP, not RJ"},
+		{"other city", model.Identity{Name: "Fabio", Address: se()}, VerifyRequest{CEP: "01001000", City: "Campinas"}, []string{statusDocumentChecked, statusRejected}, "cep 01001000 is in São Paulo, not Campinas"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.body.ID = storeIdentity(t, v, tt.ident)
+			resp, err := verify(context.Background(), &Request[VerifyRequest]{Body: tt.body})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := transitionStates(resp); !equalStrings(got, tt.states) {
+				t.Fatalf("transitions = %v, want %v", got, tt.states)
+			}
+			final := tt.states[len(tt.states)-1]
+			if resp.Identity.Status != final || resp.Identity.Verified != (final == statusVerified) {
+				t.Fatalf("identity = %+v, want %s", resp.Identity, final)
+			}
+			if got := resp.Transitions[len(resp.Transitions)-1].Reason; got != tt.reason {
+				t.Fatalf("reason = %q, want %q", got, tt.reason)
+			}
+
+			// the run is recorded
+			var rows []model.IdentityTransition
+			if err := v.db.Joins("JOIN identities ON identities.id = identity_transitions.identity_id").
+				Where("identities.uuid = ?", tt.body.ID).Find(&rows).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(rows) != len(tt.states) {
+				t.Fatalf("%d transitions recorded, want %d", len(rows), len(tt.states))
+			}
+		})
+	}
+}
+
+func TestVerifyIdentityRestart(t *testing.T) {
+	nc := testNats(t)
+	v := &verifier{db: identityDB(t), nc: nc, pii: testPII(t)}
+	verificationStubs(t, nc)
+	verify := verifyIdentity(v)
+	ctx := context.Background()
+
+	id := storeIdentity(t, v, model.Identity{Name: "Ana", CPF: testCPF})
+	if _, err := verify(ctx, &Request[VerifyRequest]{Body: VerifyRequest{ID: id, CEP: "99999999"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rejected identity starts over
+	resp, err := verify(ctx, &Request[VerifyRequest]{Body: VerifyRequest{ID: id, CEP: "01001000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{statusPending, statusDocumentChecked, statusAddressChecked, statusVerified}
+	if got := transitionStates(resp); !equalStrings(got, want) {
+		t.Fatalf("transitions = %v, want %v", got, want)
+	}
+	if resp.Transitions[0].From != statusRejected || resp.Transitions[0].Reason != "verification restarted" {
+		t.Fatalf("first transition = %+v", resp.Transitions[0])
+	}
+
+	// a verified identity is not verified again
+	_, err = verify(ctx, &Request[VerifyRequest]{Body: VerifyRequest{ID: id, CEP: "01001000"}})
+	wantStatus(t, err, http.StatusConflict)
+}
+
+func TestVerifyIdentityUnavailable(t *testing.T) {
+	nc := testNats(t)
+	v := &verifier{db: identityDB(t), nc: nc, pii: testPII(t)}
+	verify := verifyIdentity(v)
+	ctx := context.Background()
+	id := storeIdentity(t, v, model.Identity{Name: "Ana", CPF: testCPF})
+	body := VerifyRequest{ID: id, CEP: "01001000"}
+
+	status := func() string {
+		t.Helper()
+		ident, err := findIdentity(ctx, v.db, v.pii, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ident.Status
+	}
+
+	// no service answers
+	_, err := verify(ctx, &Request[VerifyRequest]{Body: body})
+	wantStatus(t, err, http.StatusBadGateway)
+	if got := status(); got != statusPending {
+		t.Fatalf("status = %s, want %s", got, statusPending)
+	}
+
+	// services failing leave the identity where the run stopped
+	docsDown, cepDown := verificationStubs(t, nc)
+	docsDown.Store(true)
+	cepDown.Store(true)
+	_, err = verify(ctx, &Request[VerifyRequest]{Body: body})
+	wantStatus(t, err, http.StatusBadGateway)
+	if got := status(); got != statusPending {
+		t.Fatalf("status = %s, want %s", got, statusPending)
+	}
+
+	docsDown.Store(false)
+	_, err = verify(ctx, &Request[VerifyRequest]{Body: body})
+	wantStatus(t, err, http.StatusBadGateway)
+	if got := status(); got != statusDocumentChecked {
+		t.Fatalf("status = %s, want %s", got, statusDocumentChecked)
+	}
+
+	// the retry carries on from there
+	cepDown.Store(false)
+	resp, err := verify(ctx, &Request[VerifyRequest]{Body: body})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{statusAddressChecked, statusVerified}
+	if got := transitionStates(resp); !equalStrings(got, want) {
+		t.Fatalf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestTransitionConcurrent(t *testing.T) {
+	v := &verifier{db: identityDB(t), nc: testNats(t), pii: testPII(t)}
+	ctx := context.Background()
+	id := storeIdentity(t, v, model.Identity{Name: "Ana"})
+
+	// two runs load the identity while it is pending
+	first, err := findIdentity(ctx, v.db, v.pii, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := findIdentity(ctx, v.db, v.pii, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.transition(ctx, first, statusDocumentChecked, "documents valid"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = v.transition(ctx, second, statusRejected, "cpf invalid")
+	wantStatus(t, err, http.StatusConflict)
+	if second.Status != statusPending {
+		t.Fatalf("losing run moved to %s", second.Status)
+	}
+
+	// transitions outside the state machine are refused
+	_, err = v.transition(ctx, first, statusVerified, "skipped")
+	wantStatus(t, err, http.StatusConflict)
+
+	var n int64
+	if err := v.db.Model(&model.IdentityTransition{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("%d transitions recorded, want 1", n)
+	}
+}
+
+func TestVerifyIdentityEvents(t *testing.T) {
+	nc := testNats(t)
+	v := &verifier{db: identityDB(t), nc: nc, pii: testPII(t)}
+	verificationStubs(t, nc)
+
+	events, err := nc.SubscribeSync(subjectIdentityEvents + ".>")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const name = "Ana Souza"
+	id := storeIdentity(t, v, model.Identity{Name: name, CPF: testCPF, CNPJ: testCNPJ})
+	body := VerifyRequest{ID: id, CEP: "01001000"}
+	if _, err := verifyIdentity(v)(context.Background(), &Request[VerifyRequest]{Body: body}); err != nil {
+		t.Fatal(err)
+	}
+
+	from := statusPending
+	for _, to := range []string{statusDocumentChecked, statusAddressChecked, statusVerified} {
+		msg, err := events.NextMsg(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Subject != subjectIdentityEvents+"."+to {
+			t.Fatalf("event on %s, want %s", msg.Subject, to)
+		}
+
+		var event IdentityEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.ID != id || event.From != from || event.To != to || event.At.IsZero() {
+			t.Fatalf("event = %+v", event)
+		}
+		from = to
+
+		// the event names the identity by its id only
+		for _, pii := range []string{name, testCPF, testCNPJ, "529.982.247-25", "11.222.333/0001-81"} {
+			if strings.Contains(string(msg.Data), pii) {
+				t.Fatalf("event %s carries %q", msg.Data, pii)
+			}
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dyammarcano/gin-nats-starter/internal/model"
+)
+
+// ErrLocationNotFound is returned by a provider that cannot geocode a place.
+var ErrLocationNotFound = errors.New("location not found")
+
+// Location is a geocoded place.
+type Location struct {
+	Name      string  `json:"name"`
+	State     string  `json:"state,omitempty"`
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Conditions are the current weather conditions at a location, in metric
+// units whatever the provider.
+type Conditions struct {
+	Temperature         float64   `json:"temperature_c"`
+	ApparentTemperature float64   `json:"apparent_temperature_c"`
+	Humidity            float64   `json:"humidity_percent"`
+	Precipitation       float64   `json:"precipitation_mm"`
+	WindSpeed           float64   `json:"wind_speed_kmh"`
+	WindDirection       float64   `json:"wind_direction_deg"`
+	WeatherCode         int       `json:"weather_code"`
+	Description         string    `json:"description"`
+	IsDay               bool      `json:"is_day"`
+	ObservedAt          time.Time `json:"observed_at"`
+}
+
+// WeatherProvider resolves places and reports their current conditions.
+// Geocode only returns a city of state, given as a UF or a name, when state
+// is not empty.
+type WeatherProvider interface {
+	Name() string
+	Geocode(ctx context.Context, city, state, country string) (Location, error)
+	Current(ctx context.Context, loc Location) (Conditions, error)
+}
+
+// ClimaConfig selects the weather provider used by service.clima.
+type ClimaConfig struct {
+	Provider     string        `yaml:"provider"`
+	BaseUrl      string        `yaml:"baseUrl"`
+	GeocodingUrl string        `yaml:"geocodingUrl"`
+	Country      string        `yaml:"country"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+const (
+	providerOpenMeteo = "open-meteo"
+	providerStub      = "stub"
+
+	defaultForecastUrl  = "https://api.open-meteo.com/v1/forecast"
+	defaultGeocodingUrl = "https://geocoding-api.open-meteo.com/v1/search"
+	defaultClimaTimeout = 3 * time.Second
+
+	// geocodeCandidates is the number of places with the name of a city
+	// asked to the geocoder, to find the one in the requested state.
+	geocodeCandidates = 10
+)
+
+// stateNames maps the UFs to the state names reported by geocoders.
+var stateNames = map[string]string{
+	"AC": "Acre", "AL": "Alagoas", "AP": "Amapá", "AM": "Amazonas",
+	"BA": "Bahia", "CE": "Ceará", "DF": "Distrito Federal", "ES": "Espírito Santo",
+	"GO": "Goiás", "MA": "Maranhão", "MT": "Mato Grosso", "MS": "Mato Grosso do Sul",
+	"MG": "Minas Gerais", "PA": "Pará", "PB": "Paraíba", "PR": "Paraná",
+	"PE": "Pernambuco", "PI": "Piauí", "RJ": "Rio de Janeiro", "RN": "Rio Grande do Norte",
+	"RS": "Rio Grande do Sul", "RO": "Rondônia", "RR": "Roraima", "SC": "Santa Catarina",
+	"SP": "São Paulo", "SE": "Sergipe", "TO": "Tocantins",
+}
+
+// sameState reports whether a geocoded state name is state, given as a UF
+// or a name, ignoring case and accents.
+func sameState(name, state string) bool {
+	if n, ok := stateNames[strings.ToUpper(strings.TrimSpace(state))]; ok {
+		state = n
+	}
+	return model.SearchKey(name) == model.SearchKey(state)
+}
+
+// newWeatherProvider builds the configured provider, Open-Meteo by default.
+func newWeatherProvider(cfg ClimaConfig) (WeatherProvider, error) {
+	switch strings.ToLower(cfg.Provider) {
+	case "", providerOpenMeteo:
+		timeout := cfg.Timeout
+		if timeout <= 0 {
+			timeout = defaultClimaTimeout
+		}
+		p := &openMeteo{
+			forecastUrl:  cfg.BaseUrl,
+			geocodingUrl: cfg.GeocodingUrl,
+			client:       &http.Client{Timeout: timeout},
+		}
+		if p.forecastUrl == "" {
+			p.forecastUrl = defaultForecastUrl
+		}
+		if p.geocodingUrl == "" {
+			p.geocodingUrl = defaultGeocodingUrl
+		}
+		return p, nil
+	case providerStub:
+		return stubWeather{}, nil
+	default:
+		return nil, fmt.Errorf("unknown weather provider %q", cfg.Provider)
+	}
+}
+
+// openMeteo queries the Open-Meteo forecast and geocoding APIs, or any
+// server speaking the same protocol.
+type openMeteo struct {
+	forecastUrl  string
+	geocodingUrl string
+	client       *http.Client
+}
+
+func (p *openMeteo) Name() string {
+	return providerOpenMeteo
+}
+
+func (p *openMeteo) Geocode(ctx context.Context, city, state, country string) (Location, error) {
+	q := url.Values{}
+	q.Set("name", city)
+	q.Set("count", strconv.Itoa(geocodeCandidates))
+	q.Set("language", "pt")
+	q.Set("format", "json")
+	if country != "" {
+		q.Set("countryCode", country)
+	}
+
+	var out struct {
+		Results []struct {
+			Name        string  `json:"name"`
+			Admin1      string  `json:"admin1"`
+			CountryCode string  `json:"country_code"`
+			Latitude    float64 `json:"latitude"`
+			Longitude   float64 `json:"longitude"`
+		} `json:"results"`
+	}
+	if err := p.get(ctx, p.geocodingUrl, q, &out); err != nil {
+		return Location{}, err
+	}
+
+	for _, r := range out.Results {
+		if state != "" && !sameState(r.Admin1, state) {
+			continue
+		}
+		return Location{
+			Name:      r.Name,
+			State:     r.Admin1,
+			Country:   r.CountryCode,
+			Latitude:  r.Latitude,
+			Longitude: r.Longitude,
+		}, nil
+	}
+
+	return Location{}, ErrLocationNotFound
+}
+
+func (p *openMeteo) Current(ctx context.Context, loc Location) (Conditions, error) {
+	q := url.Values{}
+	q.Set("latitude", fmt.Sprintf("%.4f", loc.Latitude))
+	q.Set("longitude", fmt.Sprintf("%.4f", loc.Longitude))
+	q.Set("current", "temperature_2m,apparent_temperature,relative_humidity_2m,precipitation,wind_speed_10m,wind_direction_10m,weather_code,is_day")
+	q.Set("wind_speed_unit", "kmh")
+	q.Set("timeformat", "unixtime")
+
+	var out struct {
+		Current struct {
+			Time                int64   `json:"time"`
+			Temperature         float64 `json:"temperature_2m"`
+			ApparentTemperature float64 `json:"apparent_temperature"`
+			Humidity            float64 `json:"relative_humidity_2m"`
+			Precipitation       float64 `json:"precipitation"`
+			WindSpeed           float64 `json:"wind_speed_10m"`
+			WindDirection       float64 `json:"wind_direction_10m"`
+			WeatherCode         int     `json:"weather_code"`
+			IsDay               int     `json:"is_day"`
+		} `json:"current"`
+	}
+	if err := p.get(ctx, p.forecastUrl, q, &out); err != nil {
+		return Conditions{}, err
+	}
+
+	c := out.Current
+	return Conditions{
+		Temperature:         c.Temperature,
+		ApparentTemperature: c.ApparentTemperature,
+		Humidity:            c.Humidity,
+		Precipitation:       c.Precipitation,
+		WindSpeed:           c.WindSpeed,
+		WindDirection:       c.WindDirection,
+		WeatherCode:         c.WeatherCode,
+		Description:         weatherDescription(c.WeatherCode),
+		IsDay:               c.IsDay == 1,
+		ObservedAt:          time.Unix(c.Time, 0).UTC(),
+	}, nil
+}
+
+func (p *openMeteo) get(ctx context.Context, base string, q url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error querying %s, status: %s", base, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("error decoding %s response: %w", base, err)
+	}
+
+	return nil
+}
+
+// stubWeather answers without network access, deriving stable coordinates
+// and conditions from the input. It is meant for local runs and tests.
+type stubWeather struct{}
+
+func (stubWeather) Name() string {
+	return providerStub
+}
+
+func (stubWeather) Geocode(_ context.Context, city, state, country string) (Location, error) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.ToLower(city)))
+	sum := h.Sum32()
+
+	return Location{
+		Name:      city,
+		State:     state,
+		Country:   country,
+		Latitude:  float64(int(sum%2800)-3300) / 100,
+		Longitude: float64(int(sum/2800%4000)-7300) / 100,
+	}, nil
+}
+
+func (stubWeather) Current(_ context.Context, loc Location) (Conditions, error) {
+	seed := int(loc.Latitude*100) ^ int(loc.Longitude*100)
+	if seed < 0 {
+		seed = -seed
+	}
+
+	code := []int{0, 1, 2, 3, 61, 80}[seed%6]
+	temp := 15 + float64(seed%200)/10
+
+	return Conditions{
+		Temperature:         temp,
+		ApparentTemperature: temp + 1.5,
+		Humidity:            float64(40 + seed%55),
+		Precipitation:       0,
+		WindSpeed:           float64(seed % 30),
+		WindDirection:       float64(seed % 360),
+		WeatherCode:         code,
+		Description:         weatherDescription(code),
+		IsDay:               true,
+		ObservedAt:          time.Now().UTC().Truncate(15 * time.Minute),
+	}, nil
+}
+
+// weatherCodes describes the WMO weather interpretation codes.
+var weatherCodes = map[int]string{
+	0:  "céu limpo",
+	1:  "predominantemente limpo",
+	2:  "parcialmente nublado",
+	3:  "nublado",
+	45: "nevoeiro",
+	48: "nevoeiro com geada",
+	51: "garoa fraca",
+	53: "garoa moderada",
+	55: "garoa intensa",
+	56: "garoa congelante fraca",
+	57: "garoa congelante intensa",
+	61: "chuva fraca",
+	63: "chuva moderada",
+	65: "chuva forte",
+	66: "chuva congelante fraca",
+	67: "chuva congelante forte",
+	71: "neve fraca",
+	73: "neve moderada",
+	75: "neve forte",
+	77: "grãos de neve",
+	80: "pancadas de chuva fracas",
+	81: "pancadas de chuva moderadas",
+	82: "pancadas de chuva violentas",
+	85: "pancadas de neve fracas",
+	86: "pancadas de neve fortes",
+	95: "trovoada",
+	96: "trovoada com granizo fraco",
+	99: "trovoada com granizo forte",
+}
+
+func weatherDescription(code int) string {
+	if d, ok := weatherCodes[code]; ok {
+		return d
+	}
+	return "desconhecido"
+}
@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Request is a decoded message handed to a typed handler.
+type Request[T any] struct {
+	Body T
+	Raw  micro.Request
+}
+
+// Param returns a parameter forwarded by the gateway, see msgParam.
+func (r *Request[T]) Param(in, name string) string {
+	return msgParam(r.Raw.Headers(), in, name)
+}
+
+// HandlerFunc handles one decoded request and returns the reply body.
+type HandlerFunc[Req, Resp any] func(ctx context.Context, req *Request[Req]) (Resp, error)
+
+// MsgHandler is the raw form of a handler that middleware wraps.
+type MsgHandler func(ctx context.Context, req micro.Request)
+
+// Middleware decorates message handling, e.g. logging or auth checks.
+type Middleware func(next MsgHandler) MsgHandler
+
+// MessageDecoder lets a request body decode itself, for messages that are
+// not a single JSON document such as NDJSON.
+type MessageDecoder interface {
+	DecodeMessage(data []byte) error
+}
+
+// StatusCoder lets a response choose its HTTP status, e.g. 201 on create.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// ServiceError is returned by handlers to reply {"error": Message} with Status.
+type ServiceError struct {
+	Status  int
+	Message string
+}
+
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Status, e.Message)
+}
+
+func errBadRequest(format string, args ...any) error {
+	return &ServiceError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+func errNotFound(format string, args ...any) error {
+	return &ServiceError{Status: http.StatusNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+func errConflict(format string, args ...any) error {
+	return &ServiceError{Status: http.StatusConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+func errUnprocessable(format string, args ...any) error {
+	return &ServiceError{Status: http.StatusUnprocessableEntity, Message: fmt.Sprintf(format, args...)}
+}
+
+func errUnavailable(format string, args ...any) error {
+	return &ServiceError{Status: http.StatusBadGateway, Message: fmt.Sprintf(format, args...)}
+}
+
+type workerOptions struct {
+	middleware []Middleware
+}
+
+// WorkerOption customizes a worker.
+type WorkerOption func(*workerOptions)
+
+// WithMiddleware appends middleware, the first one being the outermost.
+func WithMiddleware(mw ...Middleware) WorkerOption {
+	return func(o *workerOptions) { o.middleware = append(o.middleware, mw...) }
+}
+
+// Worker is a typed handler served as an endpoint of a Service. Decoding,
+// the schema introspection header, error replies, logging and panics are
+// handled the same way for every endpoint.
+type Worker[Req, Resp any] struct {
+	name    string
+	subject string
+	handler HandlerFunc[Req, Resp]
+	opts    workerOptions
+}
+
+// NewWorker creates an endpoint for subject; name is the micro endpoint
+// name and prefixes its log lines.
+func NewWorker[Req, Resp any](name, subject string, handler HandlerFunc[Req, Resp], opts ...WorkerOption) *Worker[Req, Resp] {
+	var o workerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Worker[Req, Resp]{
+		name:    name,
+		subject: subject,
+		handler: handler,
+		opts:    o,
+	}
+}
+
+func (w *Worker[Req, Resp]) endpointName() string {
+	return w.name
+}
+
+func (w *Worker[Req, Resp]) endpointSubject() string {
+	return w.subject
+}
+
+// endpointMetadata publishes the request and response schemas in $SRV.INFO.
+func (w *Worker[Req, Resp]) endpointMetadata() map[string]string {
+	md := make(map[string]string)
+	for k, v := range w.Schema() {
+		if b, err := json.Marshal(v); err == nil {
+			md[k+"_schema"] = string(b)
+		}
+	}
+	return md
+}
+
+func (w *Worker[Req, Resp]) microHandler(ctx context.Context) micro.Handler {
+	return micro.ContextHandler(ctx, w.chain())
+}
+
+// Schema describes the request and response bodies as JSON schemas.
+func (w *Worker[Req, Resp]) Schema() map[string]any {
+	return map[string]any{
+		"request":  jsonSchema(reflect.TypeFor[Req]()),
+		"response": jsonSchema(reflect.TypeFor[Resp]()),
+	}
+}
+
+// Route describes an HTTP route for this worker to announce to the gateway.
+// The request body schema is derived from Req for body carrying methods.
+func (w *Worker[Req, Resp]) Route(method, path, timeout string) AnnouncedRoute {
+	route := AnnouncedRoute{Path: path, Method: method, Subject: w.subject, Timeout: timeout}
+
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		if b, err := json.Marshal(jsonSchema(reflect.TypeFor[Req]())); err == nil {
+			route.RequestBody = b
+		}
+	}
+
+	return route
+}
+
+func (w *Worker[Req, Resp]) chain() MsgHandler {
+	h := w.serve
+	for i := len(w.opts.middleware) - 1; i >= 0; i-- {
+		h = w.opts.middleware[i](h)
+	}
+	return recoverMiddleware(w.name)(logMiddleware(w.name)(h))
+}
+
+func (w *Worker[Req, Resp]) serve(ctx context.Context, r micro.Request) {
+	if _, ok := r.Headers()["schema"]; ok {
+		b, _ := json.Marshal(w.Schema())
+		_ = r.Respond(b, micro.WithHeaders(micro.Headers{"schema": {string(b)}}))
+		return
+	}
+
+	req := &Request[Req]{Raw: r}
+	if len(r.Data()) > 0 {
+		decode := func(data []byte) error { return json.Unmarshal(data, &req.Body) }
+		if d, ok := any(&req.Body).(MessageDecoder); ok {
+			decode = d.DecodeMessage
+		}
+		if err := decode(r.Data()); err != nil {
+			_ = respondError(r, http.StatusBadRequest, "bad request")
+			return
+		}
+	}
+
+	resp, err := w.handler(ctx, req)
+	if err != nil {
+		var svcErr *ServiceError
+		if errors.As(err, &svcErr) {
+			_ = respondError(r, svcErr.Status, svcErr.Message)
+			return
+		}
+		log.Printf("[%s] error handling request: %v", w.name, err)
+		_ = respondError(r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	status := http.StatusOK
+	if sc, ok := any(resp).(StatusCoder); ok {
+		status = sc.StatusCode()
+	}
+
+	if err := respondJSON(r, status, resp); err != nil {
+		log.Printf("[%s] error responding: %v", w.name, err)
+	}
+}
+
+// logMiddleware logs each request without its body or parameters, which
+// carry personal data such as names, CPFs and CNPJs.
+func logMiddleware(name string) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, r micro.Request) {
+			h := r.Headers()
+			log.Printf("[%s] subject=%s method=%s route=%s bytes=%d",
+				name, r.Subject(), h.Get(headerMethod), h.Get(headerRoute), len(r.Data()))
+			next(ctx, r)
+		}
+	}
+}
+
+func recoverMiddleware(name string) Middleware {
+	return func(next MsgHandler) MsgHandler {
+		return func(ctx context.Context, r micro.Request) {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("[%s] panic handling request: %v\n%s", name, p, debug.Stack())
+					_ = respondError(r, http.StatusInternalServerError, "internal error")
+				}
+			}()
+			next(ctx, r)
+		}
+	}
+}
+
+var (
+	timeType    = reflect.TypeFor[time.Time]()
+	rawJSONType = reflect.TypeFor[json.RawMessage]()
+)
+
+// jsonSchema derives a JSON schema from a Go type. Struct fields follow
+// their json tags; fields without omitempty are required, and a `pattern`
+// tag adds a regular expression constraint. A struct reached again from
+// within itself, such as a tree node, is described as any value.
+func jsonSchema(t reflect.Type) map[string]any {
+	return typeSchema(t, make(map[reflect.Type]bool))
+}
+
+// typeSchema is jsonSchema with the structs being described in visiting.
+func typeSchema(t reflect.Type, visiting map[reflect.Type]bool) map[string]any {
+	t = indirect(t)
+
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == rawJSONType:
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem(), visiting)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem(), visiting)}
+	case reflect.Struct:
+		if visiting[t] {
+			return map[string]any{}
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		return structSchema(t, visiting)
+	default:
+		return map[string]any{}
+	}
+}
+
+func structSchema(t reflect.Type, visiting map[reflect.Type]bool) map[string]any {
+	props := make(map[string]any)
+	var required []string
+
+	for i := range t.NumField() {
+		f := t.Field(i)
+		// encoding/json still flattens an embedded struct of unexported type
+		if !f.IsExported() && !(f.Anonymous && f.Type.Kind() == reflect.Struct) {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		// embedded structs are flattened by encoding/json, and so here
+		if name == "" && f.Anonymous && indirect(f.Type).Kind() == reflect.Struct {
+			et := indirect(f.Type)
+			if visiting[et] {
+				continue
+			}
+			visiting[et] = true
+			embedded := structSchema(et, visiting)
+			delete(visiting, et)
+			for k, v := range embedded["properties"].(map[string]any) {
+				props[k] = v
+			}
+			if req, ok := embedded["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		schema := typeSchema(f.Type, visiting)
+		if p := f.Tag.Get("pattern"); p != "" {
+			schema["pattern"] = p
+		}
+		props[name] = schema
+
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type schemaBase struct {
+	ID string `json:"id" pattern:"^[a-z]+$"`
+}
+
+type schemaRequest struct {
+	schemaBase
+	Name     string          `json:"name"`
+	Count    *int            `json:"count,omitempty"`
+	Ratio    float64         `json:"ratio,omitempty"`
+	Tags     []string        `json:"tags,omitempty"`
+	Labels   map[string]bool `json:"labels,omitempty"`
+	When     time.Time       `json:"when"`
+	Extra    json.RawMessage `json:"extra,omitempty"`
+	Skipped  string          `json:"-"`
+	Untagged bool
+	hidden   string
+}
+
+func TestJSONSchema(t *testing.T) {
+	got, err := json.Marshal(jsonSchema(reflect.TypeFor[*schemaRequest]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"properties":{` +
+		`"Untagged":{"type":"boolean"},` +
+		`"count":{"type":"integer"},` +
+		`"extra":{},` +
+		`"id":{"pattern":"^[a-z]+$","type":"string"},` +
+		`"labels":{"additionalProperties":{"type":"boolean"},"type":"object"},` +
+		`"name":{"type":"string"},` +
+		`"ratio":{"type":"number"},` +
+		`"tags":{"items":{"type":"string"},"type":"array"},` +
+		`"when":{"format":"date-time","type":"string"}},` +
+		`"required":["id","name","when","Untagged"],"type":"object"}`
+	if string(got) != want {
+		t.Errorf("schema\n got %s\nwant %s", got, want)
+	}
+}
+
+type schemaNode struct {
+	Name     string       `json:"name"`
+	Parent   *schemaNode  `json:"parent,omitempty"`
+	Children []schemaNode `json:"children,omitempty"`
+	Owner    *schemaOwner `json:"owner,omitempty"`
+}
+
+type schemaOwner struct {
+	Nodes map[string]*schemaNode `json:"nodes,omitempty"`
+}
+
+type schemaPair struct {
+	Left  schemaBase `json:"left"`
+	Right schemaBase `json:"right"`
+}
+
+func TestJSONSchemaRecursive(t *testing.T) {
+	tests := []struct {
+		typ  reflect.Type
+		want string
+	}{
+		// a type reached again from within itself is any value
+		{reflect.TypeFor[schemaNode](), `{"properties":{` +
+			`"children":{"items":{},"type":"array"},` +
+			`"name":{"type":"string"},` +
+			`"owner":{"properties":{"nodes":{"additionalProperties":{},"type":"object"}},"type":"object"},` +
+			`"parent":{}},` +
+			`"required":["name"],"type":"object"}`},
+		// a type used twice side by side is described both times
+		{reflect.TypeFor[schemaPair](), `{"properties":{` +
+			`"left":{"properties":{"id":{"pattern":"^[a-z]+$","type":"string"}},"required":["id"],"type":"object"},` +
+			`"right":{"properties":{"id":{"pattern":"^[a-z]+$","type":"string"}},"required":["id"],"type":"object"}},` +
+			`"required":["left","right"],"type":"object"}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(jsonSchema(tt.typ))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s schema\n got %s\nwant %s", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestWorkerRoutePattern(t *testing.T) {
+	w := NewWorker("cpfcnpj", "service.cpfcnpj", validateCpfCnpj)
+	route, err := announcedRoute(w.Route(http.MethodPost, "/lookup/cpfcnpj", "2s"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body    string
+		invalid []string
+	}{
+		{`{"cpfcnpj": "529.982.247-25"}`, nil},
+		{`{"cpfcnpj": "12.ABC.345/01DE-35"}`, nil},
+		{`{"cpfcnpj": "529 982 247 25"}`, []string{"/cpfcnpj"}},
+		{`{"cpfcnpj": "123"}`, []string{"/cpfcnpj"}},
+		{`{}`, []string{"/cpfcnpj"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/lookup/cpfcnpj", strings.NewReader(tt.body))
+		var got []string
+		for _, d := range validateRequestBody(context.Background(), req, route.operation) {
+			got = append(got, d.Pointer)
+		}
+		if !equalStrings(got, tt.invalid) {
+			t.Errorf("%s: violations at %v, want %v", tt.body, got, tt.invalid)
+		}
+	}
+}